@@ -0,0 +1,175 @@
+// Package client is a Go client of the lattice object API.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxErrorBody bounds how much of an error response body is read.
+const maxErrorBody = 4 << 10
+
+// APIError is returned when the server answers with an error status.
+type APIError struct {
+	StatusCode int
+	Code       string // machine readable, empty if the server didn't send one
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("lattice: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("lattice: %d %s", e.StatusCode, e.Message)
+}
+
+// Client talks to a lattice server.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	token      string
+	retries    int
+	backoff    time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithToken authenticates every request with the bearer token.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithHTTPClient sets the http.Client used to send requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how many times an idempotent request failing with a 5xx
+// is retried, waiting backoff before the first retry and doubling it after
+// every attempt. The default is 3 retries starting at 100ms.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = n
+		c.backoff = backoff
+	}
+}
+
+// New returns a Client of the server at baseURL.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    3,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Put uploads the content of r, streaming it, and returns the ID of the
+// stored object.
+func (c *Client) Put(ctx context.Context, r io.Reader) (string, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, "/objects", r)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", newAPIError(resp)
+	}
+
+	var obj struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return "", fmt.Errorf("lattice: decode response: %w", err)
+	}
+	return obj.ID, nil
+}
+
+// Get downloads the object id. The caller must close the returned reader,
+// which streams the content from the server.
+func (c *Client) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	resp, err := c.doIdempotent(ctx, http.MethodGet, "/objects/"+url.PathEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, newAPIError(resp)
+	}
+	return resp.Body, nil
+}
+
+// doIdempotent sends a body-less request, retrying it on 5xx responses with
+// an exponential backoff.
+func (c *Client) doIdempotent(ctx context.Context, method, path string) (*http.Response, error) {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, method, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 500 || attempt >= c.retries {
+			return resp, nil
+		}
+
+		// drain so the connection can be reused.
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBody))
+		_ = resp.Body.Close()
+
+		t := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// newAPIError reads the error envelope of resp, falling back to the raw body
+// for replies that aren't one.
+func newAPIError(resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	var env struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(b, &env); err == nil && env.Error.Code != "" {
+		return &APIError{StatusCode: resp.StatusCode, Code: env.Error.Code, Message: env.Error.Message}
+	}
+	return &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "content")
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithRetries(3, time.Millisecond))
+	rc, err := c.Get(context.Background(), "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, _ := io.ReadAll(rc); string(b) != "content" || calls.Load() != 3 {
+		t.Fatalf("got %q after %d calls, want content after 3", b, calls.Load())
+	}
+}
+
+func TestGetRetriesExhausted(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		io.WriteString(w, `{"error":{"code":"upstream","message":"backend down"}}`)
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL, WithRetries(2, time.Millisecond)).Get(context.Background(), "id")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want an *APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusBadGateway || apiErr.Code != "upstream" || apiErr.Message != "backend down" {
+		t.Errorf("APIError = %+v", apiErr)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("%d calls, want 1 and 2 retries", calls.Load())
+	}
+}
+
+func TestPutNotRetried(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL, WithRetries(3, time.Millisecond)).Put(context.Background(), nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError || apiErr.Message != "boom" {
+		t.Fatalf("err = %v, want a 500 APIError with the raw body", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Put was sent %d times, want once", calls.Load())
+	}
+}
+
+func TestGetCanceled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := New(srv.URL, WithRetries(10, time.Second)).Get(ctx, "id")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	if _, err := New(srv.URL+"/").Get(context.Background(), "id"); err == nil {
+		t.Error("request without token succeeded")
+	}
+	rc, err := New(srv.URL+"/", WithToken("secret")).Get(context.Background(), "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+}
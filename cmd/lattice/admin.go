@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// logLevelResponse is the body of the loglevel admin routes.
+type logLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// handleGetLogLevel reports the current level of the server logger.
+func handleGetLogLevel(level *slog.LevelVar) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, logLevelResponse{Level: strings.ToLower(level.Level().String())})
+	}
+}
+
+// handleSetLogLevel changes the level of the server logger to the level of
+// a {"level":"debug"} body. The change applies to every logger derived from
+// it, including those of requests already in flight.
+func handleSetLogLevel(level *slog.LevelVar, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req logLevelResponse
+		if err := decodeJSON(w, r, &req); err != nil {
+			WriteError(w, http.StatusBadRequest, "bad_request", "invalid JSON body")
+			return
+		}
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(req.Level)); err != nil {
+			WriteError(w, http.StatusBadRequest, "bad_request", "invalid level, want debug, info, warn or error")
+			return
+		}
+		prev := level.Level()
+		level.Set(l)
+		logger.WithContext(r.Context()).Warn("log level changed", "from", prev, "to", l)
+		recordAudit(r.Context(), AuditEvent{Action: AuditLogLevel, Detail: prev.String() + " to " + l.String()})
+		WriteJSON(w, http.StatusOK, logLevelResponse{Level: strings.ToLower(l.String())})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// TestSetLogLevel toggles a logger from info to debug and checks the same
+// logger now writes debug lines.
+func TestSetLogLevel(t *testing.T) {
+	var (
+		buf   bytes.Buffer
+		level slog.LevelVar
+	)
+	logger := log.New(&buf, &level)
+
+	logger.Debug("before")
+	if entries := logEntries(t, &buf); len(entries) != 0 {
+		t.Fatalf("debug line logged at info: %v", entries)
+	}
+
+	r := httptest.NewRequest(http.MethodPut, "/admin/loglevel", strings.NewReader(`{"level":"debug"}`))
+	w := httptest.NewRecorder()
+	handleSetLogLevel(&level, logger)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var resp logLevelResponse
+	decodeBody(t, w, &resp)
+	if resp.Level != "debug" {
+		t.Errorf("level = %q, want debug", resp.Level)
+	}
+
+	buf.Reset()
+	logger.Debug("after")
+	entries := logEntries(t, &buf)
+	if len(entries) != 1 || entries[0]["msg"] != "after" || entries[0]["level"] != "DEBUG" {
+		t.Fatalf("entries = %v, want the debug line", entries)
+	}
+}
+
+func TestLogLevelRoutes(t *testing.T) {
+	ts := newTestServer(t)
+
+	w := ts.do(http.MethodGet, "/admin/loglevel", rootToken, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get: status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var resp logLevelResponse
+	decodeBody(t, w, &resp)
+	if resp.Level != "info" {
+		t.Errorf("get: level = %q, want info", resp.Level)
+	}
+
+	w = ts.do(http.MethodPut, "/admin/loglevel", rootToken, strings.NewReader(`{"level":"warn"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("put: status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if got := ts.level.Level(); got != slog.LevelWarn {
+		t.Errorf("level = %v, want %v", got, slog.LevelWarn)
+	}
+	if got := len(ts.audit.recorded(AuditLogLevel)); got != 1 {
+		t.Errorf("audited %d level changes, want 1", got)
+	}
+
+	for _, body := range []string{`{"level":"loud"}`, `{"level":`} {
+		w := ts.do(http.MethodPut, "/admin/loglevel", rootToken, strings.NewReader(body))
+		if w.Code != http.StatusBadRequest || errorCode(t, w) != "bad_request" {
+			t.Errorf("put %s: status = %d, want %d: %s", body, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+	if got := ts.level.Level(); got != slog.LevelWarn {
+		t.Errorf("level after invalid puts = %v, want %v", got, slog.LevelWarn)
+	}
+
+	w = ts.do(http.MethodPut, "/admin/loglevel", aliceToken, strings.NewReader(`{"level":"debug"}`))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("non-admin put: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// AuditAction names what an AuditEvent records.
+type AuditAction string
+
+// The actions recorded by the handlers and middleware.
+const (
+	AuditAuthSuccess AuditAction = "auth.success"
+	AuditAuthFailure AuditAction = "auth.failure"
+	AuditRead        AuditAction = "object.read"
+	AuditWrite       AuditAction = "object.write"
+	AuditDelete      AuditAction = "object.delete"
+	AuditRestore     AuditAction = "object.restore"
+	AuditPurge       AuditAction = "object.purge"
+	AuditSignURL     AuditAction = "url.sign"
+	AuditSignedURL   AuditAction = "url.use"
+	AuditKeyExchange AuditAction = "key.exchange"
+	AuditKeyRotation AuditAction = "key.rotate"
+	AuditLogLevel    AuditAction = "admin.loglevel"
+)
+
+// AuditEvent is a security relevant event, kept in the audit trail apart
+// from the operational logs. Subject is empty when the event has no
+// authenticated identity, e.g. a failed authentication or a purge run by the
+// server itself, and Detail holds what else is worth knowing, like why an
+// authentication failed.
+type AuditEvent struct {
+	Time      time.Time   `json:"time"`
+	Action    AuditAction `json:"action"`
+	Subject   string      `json:"subject,omitempty"`
+	ObjectID  string      `json:"object_id,omitempty"`
+	ClientIP  string      `json:"client_ip,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	Detail    string      `json:"detail,omitempty"`
+}
+
+// Auditor records AuditEvents. Record must be safe for concurrent use, and
+// is called on the request path, so it should not block for long.
+type Auditor interface {
+	Record(ctx context.Context, event AuditEvent)
+}
+
+// discardAuditor drops every event, when no audit log is configured.
+type discardAuditor struct{}
+
+func (discardAuditor) Record(context.Context, AuditEvent) {}
+
+type auditKey struct{}
+
+// auditRequest is what Audit knows about a request.
+type auditRequest struct {
+	auditor  Auditor
+	clientIP string
+}
+
+// Audit makes auditor available to recordAudit for the rest of the chain,
+// along with the IP of the client, looking past trusted proxies in the
+// X-Forwarded-For header. It must run after RequestID.
+func Audit(auditor Auditor, trusted []netip.Prefix) Middleware {
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ar := &auditRequest{auditor: auditor, clientIP: clientIP(r, trusted)}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auditKey{}, ar)))
+		})
+	}
+}
+
+// recordAudit records event for the request of ctx, filling in the time, the
+// client IP, the request ID and the authenticated subject unless event sets
+// it. It does nothing outside of Audit.
+func recordAudit(ctx context.Context, event AuditEvent) {
+	ar, ok := ctx.Value(auditKey{}).(*auditRequest)
+	if !ok {
+		return
+	}
+	event.Time, event.ClientIP = time.Now().UTC(), ar.clientIP
+	event.RequestID, _ = RequestIDFromContext(ctx)
+	if event.Subject == "" {
+		if id, ok := IdentityFromContext(ctx); ok {
+			event.Subject = id.Subject
+		}
+	}
+	ar.auditor.Record(ctx, event)
+}
+
+const (
+	// auditQueue is how many events FileAuditor holds before Record blocks.
+	auditQueue = 1024
+	// auditBatch bounds the events written between two syncs.
+	auditBatch = 256
+)
+
+// FileAuditor appends events to a file as JSON lines. Events are queued by
+// Record and written in batches by a single goroutine, the file is synced
+// after every batch, so a burst of events costs one fsync. An event is
+// durable once its batch is synced, and Close flushes the queue.
+type FileAuditor struct {
+	f      *os.File
+	logger log.Logger
+	events chan AuditEvent
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// OpenFileAuditor opens, or creates, the audit log at path for appending and
+// starts writing the events recorded to it. Write errors are logged to
+// logger, as there is no request to fail for them.
+func OpenFileAuditor(path string, logger log.Logger) (*FileAuditor, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	a := &FileAuditor{
+		f:      f,
+		logger: logger,
+		events: make(chan AuditEvent, auditQueue),
+		done:   make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// Record queues event, waiting for room when the queue is full. Events
+// recorded after Close are dropped.
+func (a *FileAuditor) Record(_ context.Context, event AuditEvent) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return
+	}
+	a.events <- event
+}
+
+// Close writes the events still queued, syncs and closes the file.
+func (a *FileAuditor) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.events)
+	a.mu.Unlock()
+	<-a.done
+	return a.f.Close()
+}
+
+func (a *FileAuditor) run() {
+	defer close(a.done)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for event := range a.events {
+		buf.Reset()
+		_ = enc.Encode(event)
+		// take what else is queued, up to a batch.
+	batch:
+		for n := 1; n < auditBatch; n++ {
+			select {
+			case event, ok := <-a.events:
+				if !ok {
+					break batch
+				}
+				_ = enc.Encode(event)
+			default:
+				break batch
+			}
+		}
+		if _, err := a.f.Write(buf.Bytes()); err != nil {
+			a.logger.Error("cannot write audit log", "error", err)
+			continue
+		}
+		if err := a.f.Sync(); err != nil {
+			a.logger.Error("cannot sync audit log", "error", err)
+		}
+	}
+}
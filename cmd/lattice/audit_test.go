@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+func TestAuditRequests(t *testing.T) {
+	ts := newTestServer(t)
+	obj := ts.upload(aliceToken, "audited")
+
+	w := ts.do(http.MethodGet, "/objects/"+obj.ID, "wrong-token", nil)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("wrong token: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	failures := ts.audit.recorded(AuditAuthFailure)
+	if len(failures) != 1 {
+		t.Fatalf("auth failures = %+v, want 1", failures)
+	}
+	if e := failures[0]; e.Subject != "" || e.ClientIP != "192.0.2.1" || e.Detail != "invalid token" ||
+		e.RequestID != w.Header().Get(ts.cfg.RequestIDHeader) || e.Time.IsZero() {
+		t.Errorf("auth failure = %+v", e)
+	}
+	if w := ts.do(http.MethodGet, "/objects/"+obj.ID, "", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("no token: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if got := len(ts.audit.recorded(AuditAuthFailure)); got != 2 {
+		t.Errorf("%d auth failures, want 2", got)
+	}
+	if got := len(ts.audit.recorded(AuditRead)); got != 0 {
+		t.Errorf("%d reads recorded for failed requests, want 0", got)
+	}
+
+	w = ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: status %d: %s", w.Code, w.Body)
+	}
+	reads := ts.audit.recorded(AuditRead)
+	if len(reads) != 1 {
+		t.Fatalf("reads = %+v, want 1", reads)
+	}
+	if e := reads[0]; e.Subject != "alice" || e.ObjectID != obj.ID || e.ClientIP != "192.0.2.1" ||
+		e.RequestID != w.Header().Get(ts.cfg.RequestIDHeader) || e.Time.IsZero() {
+		t.Errorf("read = %+v", e)
+	}
+	// the upload and the download authenticated.
+	if successes := ts.audit.recorded(AuditAuthSuccess); len(successes) != 2 || successes[1].Subject != "alice" {
+		t.Errorf("auth successes = %+v, want 2 of alice", successes)
+	}
+	if writes := ts.audit.recorded(AuditWrite); len(writes) != 1 || writes[0].ObjectID != obj.ID {
+		t.Errorf("writes = %+v, want the upload", writes)
+	}
+}
+
+func TestFileAuditor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	ctx := context.Background()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	write := func(events ...AuditEvent) {
+		t.Helper()
+		a, err := OpenFileAuditor(path, log.Nop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range events {
+			a.Record(ctx, e)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// dropped once closed.
+		a.Record(ctx, AuditEvent{Time: now, Action: AuditDelete})
+		if err := a.Close(); err != nil {
+			t.Errorf("second Close = %v", err)
+		}
+	}
+	want := []AuditEvent{
+		{Time: now, Action: AuditAuthFailure, ClientIP: "192.0.2.1", Detail: "invalid token"},
+		{Time: now, Action: AuditRead, Subject: "alice", ObjectID: "ab01", RequestID: "r1"},
+		{Time: now, Action: AuditPurge, ObjectID: "ab02"},
+	}
+	write(want[:2]...)
+	// reopening appends.
+	write(want[2:]...)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []AuditEvent
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var e AuditEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		got = append(got, e)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("read %d events, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// ErrInvalidToken is returned by a token verifier that doesn't recognize
+// the token.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Identity is the authenticated principal of a request.
+type Identity struct {
+	Subject string
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the Identity stored by Auth.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// Auth authenticates requests with the bearer token of the Authorization
+// header. A missing or malformed header is answered with 401, and a token
+// rejected by verify with 403. On success the Identity returned by verify is
+// stored in the request context.
+func Auth(verify func(token string) (Identity, error)) Middleware {
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := bearerToken(r.Header.Get("Authorization"))
+			if !ok {
+				recordAudit(r.Context(), AuditEvent{Action: AuditAuthFailure, Detail: "missing or malformed bearer token"})
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				WriteError(w, http.StatusUnauthorized, "unauthorized", "missing or malformed bearer token")
+				return
+			}
+			id, err := verify(token)
+			if err != nil {
+				recordAudit(r.Context(), AuditEvent{Action: AuditAuthFailure, Detail: "invalid token"})
+				WriteError(w, http.StatusForbidden, "forbidden", "invalid token")
+				return
+			}
+			ctx := context.WithValue(r.Context(), identityKey{}, id)
+			ctx = log.ContextWith(ctx, "subject", id.Subject)
+			recordAudit(ctx, AuditEvent{Action: AuditAuthSuccess})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// Admin lets through only the requests authenticated by Auth as one of
+// subjects, others are answered with 403. It must run after Auth.
+func Admin(subjects []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isAdmin(r.Context(), subjects) {
+				recordAudit(r.Context(), AuditEvent{Action: AuditAuthFailure, Detail: "admin only"})
+				WriteError(w, http.StatusForbidden, "forbidden", "admin only")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isAdmin reports whether the identity stored in ctx is one of subjects.
+func isAdmin(ctx context.Context, subjects []string) bool {
+	id, ok := IdentityFromContext(ctx)
+	return ok && slices.Contains(subjects, id.Subject)
+}
+
+func bearerToken(h string) (string, bool) {
+	scheme, token, ok := strings.Cut(h, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// staticTokens returns a token verifier accepting the tokens of the given
+// spec, a comma-separated list of token=subject pairs.
+func staticTokens(spec string) (func(token string) (Identity, error), error) {
+	type entry struct {
+		token []byte
+		id    Identity
+	}
+	var entries []entry
+	for pair := range strings.SplitSeq(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		token, subject, ok := strings.Cut(pair, "=")
+		if !ok || token == "" || subject == "" {
+			return nil, fmt.Errorf("invalid token entry %q, want token=subject", pair)
+		}
+		entries = append(entries, entry{token: []byte(token), id: Identity{Subject: subject}})
+	}
+
+	return func(token string) (Identity, error) {
+		for _, e := range entries {
+			if subtle.ConstantTimeCompare(e.token, []byte(token)) == 1 {
+				return e.id, nil
+			}
+		}
+		return Identity{}, ErrInvalidToken
+	}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	verify, err := staticTokens("good=alice, other=bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Identity
+	h := Auth(verify)(HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		if got, ok = IdentityFromContext(r.Context()); !ok {
+			t.Error("no identity in the context")
+		}
+	}))
+
+	for _, tc := range []struct {
+		name, header string
+		status       int
+		subject      string
+	}{
+		{"missing header", "", http.StatusUnauthorized, ""},
+		{"other scheme", "Basic Zm9vOmJhcg==", http.StatusUnauthorized, ""},
+		{"empty token", "Bearer  ", http.StatusUnauthorized, ""},
+		{"bad token", "Bearer bad", http.StatusForbidden, ""},
+		{"happy path", "Bearer good", http.StatusOK, "alice"},
+		{"case insensitive scheme", "bearer other", http.StatusOK, "bob"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got = Identity{}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d", w.Code, tc.status)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); (tc.status == http.StatusUnauthorized) != (challenge == "Bearer") {
+				t.Errorf("WWW-Authenticate = %q", challenge)
+			}
+			if got.Subject != tc.subject {
+				t.Errorf("subject = %q, want %q", got.Subject, tc.subject)
+			}
+		})
+	}
+}
+
+func TestStaticTokensInvalid(t *testing.T) {
+	for _, spec := range []string{"token", "=alice", "token="} {
+		if _, err := staticTokens(spec); err == nil {
+			t.Errorf("staticTokens(%q): no error", spec)
+		}
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	ts := newTestServer(t)
+	for token, status := range map[string]int{aliceToken: http.StatusForbidden, rootToken: http.StatusOK} {
+		if w := ts.do(http.MethodGet, "/admin/loglevel", token, nil); w.Code != status {
+			t.Errorf("token %s: status %d, want %d", token, w.Code, status)
+		}
+	}
+}
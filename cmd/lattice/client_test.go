@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	lattice "github.com/josestg/e2eefs/client"
+)
+
+// TestClient runs the client package against the real handlers.
+func TestClient(t *testing.T) {
+	ts := newTestServer(t)
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+	ctx := context.Background()
+	c := lattice.New(srv.URL, lattice.WithToken(aliceToken))
+
+	plain := make([]byte, 300<<10)
+	rand.Read(plain)
+	id, err := c.Put(ctx, bytes.NewReader(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := c.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("Get = %v, content equal %t", err, bytes.Equal(got, plain))
+	}
+
+	var apiErr *lattice.APIError
+	if _, err := c.Get(ctx, "0123456789abcdef"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Code != "not_found" {
+		t.Errorf("Get of a missing object = %v, want a not_found APIError", err)
+	}
+	if _, err := lattice.New(srv.URL, lattice.WithToken(bobToken)).Get(ctx, id); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Errorf("Get by another user = %v, want a 403 APIError", err)
+	}
+	if _, err := lattice.New(srv.URL).Put(ctx, bytes.NewReader(plain)); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Put without token = %v, want a 401 APIError", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressOptions configures the Compress middleware.
+type CompressOptions struct {
+	// Zstd offers zstd to clients that accept it, preferred over gzip.
+	Zstd bool
+
+	// MinSize is the smallest Content-Length worth compressing. Responses
+	// without a Content-Length are always compressed.
+	MinSize int64
+
+	// Incompressible lists the content types left alone because they are
+	// compressed already. An entry ending with "/" matches a whole type, such
+	// as "image/". When nil, defaultIncompressible is used.
+	Incompressible []string
+}
+
+var defaultIncompressible = []string{
+	"image/", "video/", "audio/",
+	"application/gzip", "application/zip", "application/zstd", sessionContentType,
+	"application/x-7z-compressed", "application/x-bzip2", "application/x-rar-compressed", "application/x-xz",
+}
+
+var (
+	gzipPool = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	zstdPool = sync.Pool{New: func() any {
+		// only fails on invalid options.
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		return enc
+	}}
+)
+
+// Compress compresses the responses of the handler with gzip, or zstd when
+// enabled, as negotiated by Accept-Encoding. Only complete 200 responses are
+// compressed: partial content, responses that already have a
+// Content-Encoding and incompressible content types are sent as is. The
+// compressors are pooled, so a response doesn't allocate a new one.
+func Compress(opts CompressOptions) Middleware {
+	if opts.Incompressible == nil {
+		opts.Incompressible = defaultIncompressible
+	}
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), opts.Zstd)
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, opts: &opts, encoding: encoding}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding picks zstd, when allowed, or gzip from an
+// Accept-Encoding header, ignoring codings with a zero quality.
+func negotiateEncoding(h string, allowZstd bool) string {
+	var gz, zs bool
+	for part := range strings.SplitSeq(h, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err != nil || v == 0 {
+				continue
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "*":
+			gz = true
+		case "zstd":
+			zs = true
+		}
+	}
+	switch {
+	case zs && allowZstd:
+		return "zstd"
+	case gz:
+		return "gzip"
+	}
+	return ""
+}
+
+// compressWriter decides whether to compress when the headers are written,
+// and then writes the body either through the compressor or as is.
+type compressWriter struct {
+	http.ResponseWriter
+	opts        *CompressOptions
+	encoding    string
+	wroteHeader bool
+	enc         io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.wroteHeader = true
+	if cw.compressible(code) {
+		h := cw.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		// the encoded bytes differ from the identity representation, so a
+		// strong validator of the latter only holds weakly.
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		switch cw.encoding {
+		case "zstd":
+			enc := zstdPool.Get().(*zstd.Encoder)
+			enc.Reset(cw.ResponseWriter)
+			cw.enc = enc
+		default:
+			enc := gzipPool.Get().(*gzip.Writer)
+			enc.Reset(cw.ResponseWriter)
+			cw.enc = enc
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) compressible(code int) bool {
+	h := cw.Header()
+	if code != http.StatusOK || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if v := h.Get("Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n < cw.opts.MinSize {
+			return false
+		}
+	}
+	typ, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	for _, t := range cw.opts.Incompressible {
+		if typ == t || strings.HasSuffix(t, "/") && strings.HasPrefix(typ, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc == nil {
+		return cw.ResponseWriter.Write(p)
+	}
+	return cw.enc.Write(p)
+}
+
+// close flushes the compressor and returns it to its pool.
+func (cw *compressWriter) close() {
+	if cw.enc == nil {
+		return
+	}
+	// a failure means the client went away, nothing is left to report it to.
+	_ = cw.enc.Close()
+	switch enc := cw.enc.(type) {
+	case *zstd.Encoder:
+		enc.Reset(nil)
+		zstdPool.Put(enc)
+	case *gzip.Writer:
+		enc.Reset(io.Discard)
+		gzipPool.Put(enc)
+	}
+	cw.enc = nil
+}
+
+// headerWritten reports whether the response headers were sent.
+func (cw *compressWriter) headerWritten() bool { return cw.wroteHeader }
+
+// Flush flushes the compressor, then the underlying writer when it can be
+// flushed, found through http.ResponseController.
+func (cw *compressWriter) Flush() {
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if http.NewResponseController(cw.ResponseWriter).Flush() == nil {
+		cw.wroteHeader = true
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressDownload(t *testing.T) {
+	ts := newTestServer(t)
+	text := strings.Repeat("a line of highly compressible text\n", 1000)
+	obj := ts.upload(aliceToken, text, "Content-Type", "text/plain")
+
+	plain := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil)
+	if plain.Header().Get("Content-Encoding") != "" || plain.Body.String() != text {
+		t.Fatalf("plain client: Content-Encoding %q, body of %d bytes", plain.Header().Get("Content-Encoding"), plain.Body.Len())
+	}
+	if !strings.Contains(plain.Header().Get("Vary"), "Accept-Encoding") {
+		t.Errorf("Vary = %q", plain.Header().Get("Vary"))
+	}
+
+	w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil, "Accept-Encoding", "gzip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("gzip client: %d, Content-Encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if w.Body.Len() >= len(text)/10 || w.Header().Get("Content-Length") != "" {
+		t.Errorf("gzip body of %d bytes, Content-Length %q", w.Body.Len(), w.Header().Get("Content-Length"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(zr); err != nil || string(got) != text {
+		t.Fatalf("gunzip: %v, body equal %t", err, string(got) == text)
+	}
+	if etag := w.Header().Get("ETag"); !strings.HasPrefix(etag, "W/") {
+		t.Errorf("ETag of the compressed body = %q, want a weak one", etag)
+	}
+
+	w = ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil, "Accept-Encoding", "gzip;q=0.5, zstd")
+	if w.Header().Get("Content-Encoding") != "zstd" {
+		t.Fatalf("zstd client: Content-Encoding %q", w.Header().Get("Content-Encoding"))
+	}
+	dec, err := zstd.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dec.Close()
+	if got, err := io.ReadAll(dec); err != nil || string(got) != text {
+		t.Fatalf("unzstd: %v, body equal %t", err, string(got) == text)
+	}
+}
+
+func TestCompressSkipped(t *testing.T) {
+	ts := newTestServer(t)
+	big := strings.Repeat("x", 4<<10)
+	image := ts.upload(aliceToken, big+"png", "Content-Type", "image/png")
+	small := ts.upload(aliceToken, "tiny", "Content-Type", "text/plain")
+	text := ts.upload(aliceToken, big, "Content-Type", "text/plain")
+
+	for name, tc := range map[string]struct {
+		id     string
+		header []string
+	}{
+		"incompressible type": {image.ID, nil},
+		"below min size":      {small.ID, nil},
+		"range":               {text.ID, []string{"Range", "bytes=0-99"}},
+	} {
+		w := ts.do(http.MethodGet, "/objects/"+tc.id, aliceToken, nil, append([]string{"Accept-Encoding", "gzip"}, tc.header...)...)
+		if w.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: compressed with %s", name, w.Header().Get("Content-Encoding"))
+		}
+	}
+	if w := ts.do(http.MethodGet, "/objects/"+text.ID, aliceToken, nil, "Accept-Encoding", "gzip;q=0"); w.Header().Get("Content-Encoding") != "" {
+		t.Error("compressed for a client refusing gzip")
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		zstd   bool
+		want   string
+	}{
+		{"", true, ""},
+		{"gzip", true, "gzip"},
+		{"zstd", false, ""},
+		{"gzip, zstd", true, "zstd"},
+		{"gzip, zstd", false, "gzip"},
+		{"zstd;q=0, gzip", true, "gzip"},
+		{"*", false, "gzip"},
+		{"br, deflate", true, ""},
+		{"GZIP;q=0.8", true, "gzip"},
+	} {
+		if got := negotiateEncoding(tc.header, tc.zstd); got != tc.want {
+			t.Errorf("negotiateEncoding(%q, %t) = %q, want %q", tc.header, tc.zstd, got, tc.want)
+		}
+	}
+}
+
+// BenchmarkCompress reports the allocations of a compressed response. The
+// compressor comes from a pool, a response only allocates its wrapper, not
+// the hundreds of KiB of a new gzip.Writer.
+func BenchmarkCompress(b *testing.B) {
+	body := bytes.Repeat([]byte("compressible "), 1<<10)
+	h := Compress(CompressOptions{})(HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	b.ReportAllocs()
+	for b.Loop() {
+		h.ServeHTTP(discardWriter{header: make(http.Header)}, r)
+	}
+}
+
+type discardWriter struct{ header http.Header }
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// objectETag returns the entity tag of the object stored under id. Object
+// IDs are content addressed, so the content of an ID never changes and the
+// ID itself is a strong validator.
+func objectETag(id string) string { return `"` + id + `"` }
+
+// checkPreconditions evaluates If-Match and If-None-Match against etag, the
+// current entity tag of the target, or "" when the target doesn't exist, and
+// replies when a condition fails: 412 for If-Match, and 304 for
+// If-None-Match on GET and HEAD, 412 otherwise. It reports whether the
+// request should proceed. The only weak tags served are those of compressed
+// downloads, whose content is still the one of the ID they name, so If-Match
+// accepts them in place of the strong tag.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, etag string) bool {
+	if etag == "" {
+		if r.Header.Get("If-Match") != "" {
+			WriteError(w, http.StatusPreconditionFailed, "precondition_failed", "If-Match on an object that doesn't exist")
+			return false
+		}
+		return true
+	}
+	if h := r.Header.Get("If-Match"); h != "" && !etagMatch(strings.ReplaceAll(h, "W/", ""), etag, false) {
+		WriteError(w, http.StatusPreconditionFailed, "precondition_failed", "If-Match doesn't match the current ETag")
+		return false
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" && etagMatch(h, etag, true) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return false
+		}
+		WriteError(w, http.StatusPreconditionFailed, "precondition_failed", "If-None-Match matches the current ETag")
+		return false
+	}
+	return true
+}
+
+// etagMatch reports whether the comma-separated entity tag list h, or "*",
+// matches etag. Weak comparison, used by If-None-Match, ignores the W/
+// prefix; strong comparison never matches a weak tag.
+func etagMatch(h, etag string, weak bool) bool {
+	if strings.TrimSpace(h) == "*" {
+		return true
+	}
+	for tag := range strings.SplitSeq(h, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		} else if strings.HasPrefix(tag, "W/") || strings.HasPrefix(etag, "W/") {
+			continue
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStoredPreconditions runs checkPreconditions against the object stored
+// under id in st, which may not exist yet. It replies 500 when the object
+// can't be looked up.
+func checkStoredPreconditions(w http.ResponseWriter, r *http.Request, st Store, id string, logger log.Logger) bool {
+	if r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" {
+		return true
+	}
+	etag := objectETag(id)
+	if _, err := st.Stat(r.Context(), id); err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			logger.Error("cannot stat object", "id", id, "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return false
+		}
+		etag = ""
+	}
+	return checkPreconditions(w, r, etag)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConditionalDownload(t *testing.T) {
+	ts := newTestServer(t)
+	obj := ts.upload(aliceToken, "cacheable")
+	path := "/objects/" + obj.ID
+
+	w := ts.do(http.MethodGet, path, aliceToken, nil)
+	etag := w.Header().Get("ETag")
+	if etag != `"`+obj.ID+`"` {
+		t.Fatalf("ETag = %q, want the quoted object ID", etag)
+	}
+
+	for _, inm := range []string{etag, `"other", ` + etag, "W/" + etag, "*"} {
+		w := ts.do(http.MethodGet, path, aliceToken, nil, "If-None-Match", inm)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+			t.Errorf("If-None-Match %s: %d, body %q, ETag %q, want an empty 304", inm, w.Code, w.Body, w.Header().Get("ETag"))
+		}
+	}
+	if w := ts.do(http.MethodGet, path, aliceToken, nil, "If-None-Match", `"other"`); w.Code != http.StatusOK || w.Body.String() != "cacheable" {
+		t.Errorf("stale If-None-Match: %d %q, want the content", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, path, aliceToken, nil, "If-Match", `"other"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-Match mismatch on GET: status %d, want 412", w.Code)
+	}
+}
+
+func TestConditionalDelete(t *testing.T) {
+	ts := newTestServer(t)
+	obj := ts.upload(aliceToken, "to delete")
+	path := "/objects/" + obj.ID
+	etag := `"` + obj.ID + `"`
+
+	for _, im := range []string{`"other"`, `W/"other"`} {
+		w := ts.do(http.MethodDelete, path, aliceToken, nil, "If-Match", im)
+		if w.Code != http.StatusPreconditionFailed || errorCode(t, w) != "precondition_failed" {
+			t.Errorf("If-Match %s: %d %s, want 412", im, w.Code, w.Body)
+		}
+	}
+	if w := ts.do(http.MethodGet, path, aliceToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("object gone after a failed precondition: status %d", w.Code)
+	}
+	if w := ts.do(http.MethodDelete, path, aliceToken, nil, "If-Match", etag); w.Code != http.StatusNoContent {
+		t.Fatalf("matching If-Match: status %d, want 204", w.Code)
+	}
+}
+
+// TestConditionalCompressed echoes the weak ETag of a compressed download in
+// If-Match, which still names the same content.
+func TestConditionalCompressed(t *testing.T) {
+	ts := newTestServer(t)
+	text := strings.Repeat("compressed and then deleted\n", 1000)
+	obj := ts.upload(aliceToken, text, "Content-Type", "text/plain")
+	path := "/objects/" + obj.ID
+
+	w := ts.do(http.MethodGet, path, aliceToken, nil, "Accept-Encoding", "gzip")
+	etag := w.Header().Get("ETag")
+	if w.Header().Get("Content-Encoding") != "gzip" || etag != `W/"`+obj.ID+`"` {
+		t.Fatalf("compressed download: Content-Encoding %q, ETag %q", w.Header().Get("Content-Encoding"), etag)
+	}
+	if w := ts.do(http.MethodGet, path, aliceToken, nil, "If-Match", etag); w.Code != http.StatusOK {
+		t.Errorf("GET with the weak If-Match: status %d, want 200", w.Code)
+	}
+	if w := ts.do(http.MethodDelete, path, aliceToken, nil, "If-Match", etag); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE with the weak If-Match: status %d, want 204: %s", w.Code, w.Body)
+	}
+}
+
+func TestConditionalUpload(t *testing.T) {
+	ts := newTestServer(t)
+	obj := ts.upload(aliceToken, "uploaded twice")
+	etag := `"` + obj.ID + `"`
+	upload := func(content string, header ...string) *httptest.ResponseRecorder {
+		return ts.do(http.MethodPost, "/objects", aliceToken, strings.NewReader(content), header...)
+	}
+
+	// overwriting the content already stored.
+	for _, header := range [][]string{
+		{"If-Match", `"other"`},
+		{"If-None-Match", "*"},
+		{"If-None-Match", etag},
+	} {
+		w := upload("uploaded twice", append(header, "Content-Type", "text/plain")...)
+		assertEnvelope(t, w, http.StatusPreconditionFailed, "precondition_failed")
+	}
+	w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil)
+	if ct := w.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Content-Type after failed overwrites = %q, want the metadata kept", ct)
+	}
+	for _, header := range [][]string{{"If-Match", etag}, {"If-Match", "*"}, {"If-None-Match", `"other"`}} {
+		if w := upload("uploaded twice", header...); w.Code != http.StatusCreated {
+			t.Errorf("overwrite with %v: status %d, want 201: %s", header, w.Code, w.Body)
+		}
+	}
+
+	// storing new content.
+	w = upload("new content", "If-Match", etag)
+	assertEnvelope(t, w, http.StatusPreconditionFailed, "precondition_failed")
+	if n := ts.storedObjects(); n != 1 {
+		t.Errorf("%d objects stored, want the new content refused", n)
+	}
+	if w := upload("new content", "If-None-Match", "*"); w.Code != http.StatusCreated {
+		t.Errorf("If-None-Match * on new content: status %d, want 201: %s", w.Code, w.Body)
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	for _, tc := range []struct {
+		h, etag string
+		weak    bool
+		want    bool
+	}{
+		{`"a"`, `"a"`, false, true},
+		{`"b", "a"`, `"a"`, false, true},
+		{`W/"a"`, `"a"`, false, false},
+		{`"a"`, `W/"a"`, false, false},
+		{`W/"a"`, `"a"`, true, true},
+		{`"a"`, `W/"a"`, true, true},
+		{`*`, `"a"`, false, true},
+		{`"b"`, `"a"`, true, false},
+	} {
+		if got := etagMatch(tc.h, tc.etag, tc.weak); got != tc.want {
+			t.Errorf("etagMatch(%s, %s, weak %t) = %t, want %t", tc.h, tc.etag, tc.weak, got, tc.want)
+		}
+	}
+}
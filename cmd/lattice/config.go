@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of the lattice server. See LoadConfig for the
+// environment variables and their defaults.
+type Config struct {
+	Addr              string
+	TLSCert           string
+	TLSKey            string
+	StorageDir        string
+	AuditLog          string
+	MaxUploadBytes    int64
+	SharedDownloadMax int64
+	ListMaxLimit      int64
+	RequestTimeout    time.Duration
+	ShutdownTimeout   time.Duration
+	MaxConns          int64
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	RequestIDHeader   string
+	LogLevel          slog.Level
+	AuthTokens        string
+	AdminSubjects     []string
+	ObjectKey         [32]byte
+	ContentIDKey      [32]byte
+	SigningKey        [32]byte
+	EphemeralKeys     bool
+	GeneratedKeys     []string
+	RateLimit         float64
+	RateBurst         int64
+	RateLimitTTL      time.Duration
+	IdempotencyTTL    time.Duration
+	SessionTTL        time.Duration
+	UploadTTL         time.Duration
+	UploadGCInterval  time.Duration
+	DeleteGrace       time.Duration
+	PurgeInterval     time.Duration
+	TrustedProxies    []netip.Prefix
+	CORSOrigins       []string
+	CORSCredentials   bool
+}
+
+// TLS reports whether the server should serve TLS.
+func (c Config) TLS() bool { return c.TLSCert != "" }
+
+// LoadConfig reads the Config from the environment:
+//
+//	LATTICE_ADDR                listen address, default "localhost:8080"
+//	LATTICE_TLS_CERT            TLS certificate file, set together with LATTICE_TLS_KEY
+//	LATTICE_TLS_KEY             TLS key file, set together with LATTICE_TLS_CERT
+//	LATTICE_STORAGE_DIR         absolute storage root, default "/var/lib/lattice"
+//	LATTICE_AUDIT_LOG           absolute path of the JSON-lines audit log, disabled if unset
+//	LATTICE_MAX_UPLOAD_BYTES    maximum upload size, default 1 GiB
+//	LATTICE_SHARED_DOWNLOAD_MAX maximum size of the objects decrypted once for concurrent downloads, default 8 MiB, 0 disables
+//	LATTICE_LIST_MAX_LIMIT      maximum page size of object listings, default 1000
+//	LATTICE_REQUEST_TIMEOUT     per-request timeout, default 5m
+//	LATTICE_SHUTDOWN_TIMEOUT    graceful shutdown timeout, default 15s
+//	LATTICE_MAX_CONNS           maximum concurrent connections, default 1024
+//	LATTICE_READ_HEADER_TIMEOUT time to read request headers, default 10s
+//	LATTICE_READ_TIMEOUT        time to read a whole request, default 5m, 0 for none
+//	LATTICE_WRITE_TIMEOUT       time to write a response, default 5m, 0 for none
+//	LATTICE_IDLE_TIMEOUT        keep-alive idle time, default 2m
+//	LATTICE_REQUEST_ID_HEADER   request ID header, default "X-Request-Id"
+//	LATTICE_LOG_LEVEL           minimum log level, default "info"
+//	LATTICE_AUTH_TOKENS         comma-separated token=subject pairs
+//	LATTICE_ADMIN_SUBJECTS      comma-separated subjects allowed on /admin routes
+//	LATTICE_OBJECT_KEY          hex-encoded 32-byte object encryption key, required
+//	LATTICE_CONTENT_ID_KEY      hex-encoded 32-byte content ID secret, required
+//	LATTICE_SIGNING_KEY         hex-encoded 32-byte signed URL key, required
+//	LATTICE_EPHEMERAL_KEYS      generate the keys left unset, for development only, default false
+//	LATTICE_RATE_LIMIT          requests per second per client, default 10
+//	LATTICE_RATE_BURST          burst of requests per client, default 20
+//	LATTICE_RATE_LIMIT_TTL      idle time before a client is forgotten, default 10m
+//	LATTICE_IDEMPOTENCY_TTL     how long Idempotency-Key responses are replayed, default 1h
+//	LATTICE_SESSION_TTL         lifetime of a session key agreed by POST /kex, default 1h
+//	LATTICE_UPLOAD_TTL          idle time before a partial upload is deleted, default 24h
+//	LATTICE_UPLOAD_GC_INTERVAL  how often stale partial uploads are looked for, default 1h
+//	LATTICE_DELETE_GRACE        time a deleted object can be restored, default 168h
+//	LATTICE_PURGE_INTERVAL      how often deleted objects past their grace are purged, default 1h
+//	LATTICE_TRUSTED_PROXIES     comma-separated CIDRs allowed to set X-Forwarded-For
+//	LATTICE_CORS_ORIGINS        comma-separated origins allowed by CORS, "*" for any
+//	LATTICE_CORS_CREDENTIALS    allow credentialed CORS requests, default false
+//
+// Every problem found is reported at once in the returned error.
+func LoadConfig() (Config, error) {
+	var errs []error
+	cfg := Config{
+		Addr:            envString("LATTICE_ADDR", "localhost:8080"),
+		TLSCert:         os.Getenv("LATTICE_TLS_CERT"),
+		TLSKey:          os.Getenv("LATTICE_TLS_KEY"),
+		StorageDir:      envString("LATTICE_STORAGE_DIR", "/var/lib/lattice"),
+		AuditLog:        os.Getenv("LATTICE_AUDIT_LOG"),
+		RequestIDHeader: envString("LATTICE_REQUEST_ID_HEADER", DefaultRequestIDHeader),
+		AuthTokens:      os.Getenv("LATTICE_AUTH_TOKENS"),
+		AdminSubjects:   envList("LATTICE_ADMIN_SUBJECTS"),
+		CORSOrigins:     envList("LATTICE_CORS_ORIGINS"),
+	}
+
+	var err error
+	if cfg.LogLevel, err = envLevel("LATTICE_LOG_LEVEL", slog.LevelInfo); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.EphemeralKeys, err = envBool("LATTICE_EPHEMERAL_KEYS", false); err != nil {
+		errs = append(errs, err)
+	}
+	for _, k := range []struct {
+		name string
+		key  *[32]byte
+	}{
+		{"LATTICE_OBJECT_KEY", &cfg.ObjectKey},
+		{"LATTICE_CONTENT_ID_KEY", &cfg.ContentIDKey},
+		{"LATTICE_SIGNING_KEY", &cfg.SigningKey},
+	} {
+		generated, err := envKey(k.name, k.key, cfg.EphemeralKeys)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if generated {
+			cfg.GeneratedKeys = append(cfg.GeneratedKeys, k.name)
+		}
+	}
+	if cfg.MaxUploadBytes, err = envInt64("LATTICE_MAX_UPLOAD_BYTES", 1<<30); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.SharedDownloadMax, err = envInt64("LATTICE_SHARED_DOWNLOAD_MAX", 8<<20); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ListMaxLimit, err = envInt64("LATTICE_LIST_MAX_LIMIT", 1000); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.RequestTimeout, err = envDuration("LATTICE_REQUEST_TIMEOUT", 5*time.Minute); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ShutdownTimeout, err = envDuration("LATTICE_SHUTDOWN_TIMEOUT", 15*time.Second); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.MaxConns, err = envInt64("LATTICE_MAX_CONNS", 1024); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ReadHeaderTimeout, err = envDuration("LATTICE_READ_HEADER_TIMEOUT", 10*time.Second); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.ReadTimeout, err = envDuration("LATTICE_READ_TIMEOUT", 5*time.Minute); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.WriteTimeout, err = envDuration("LATTICE_WRITE_TIMEOUT", 5*time.Minute); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.IdleTimeout, err = envDuration("LATTICE_IDLE_TIMEOUT", 2*time.Minute); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.RateLimit, err = envFloat64("LATTICE_RATE_LIMIT", 10); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.RateBurst, err = envInt64("LATTICE_RATE_BURST", 20); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.RateLimitTTL, err = envDuration("LATTICE_RATE_LIMIT_TTL", 10*time.Minute); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.IdempotencyTTL, err = envDuration("LATTICE_IDEMPOTENCY_TTL", time.Hour); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.SessionTTL, err = envDuration("LATTICE_SESSION_TTL", time.Hour); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.UploadTTL, err = envDuration("LATTICE_UPLOAD_TTL", 24*time.Hour); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.UploadGCInterval, err = envDuration("LATTICE_UPLOAD_GC_INTERVAL", time.Hour); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.DeleteGrace, err = envDuration("LATTICE_DELETE_GRACE", 7*24*time.Hour); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.PurgeInterval, err = envDuration("LATTICE_PURGE_INTERVAL", time.Hour); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.TrustedProxies, err = envPrefixes("LATTICE_TRUSTED_PROXIES"); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CORSCredentials, err = envBool("LATTICE_CORS_CREDENTIALS", false); err != nil {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, cfg.validate()...)
+	return cfg, errors.Join(errs...)
+}
+
+func (c Config) validate() []error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("LATTICE_ADDR: must not be empty"))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("LATTICE_TLS_CERT and LATTICE_TLS_KEY must be set together"))
+	}
+	if !filepath.IsAbs(c.StorageDir) {
+		errs = append(errs, fmt.Errorf("LATTICE_STORAGE_DIR: %q is not an absolute path", c.StorageDir))
+	}
+	if c.AuditLog != "" && !filepath.IsAbs(c.AuditLog) {
+		errs = append(errs, fmt.Errorf("LATTICE_AUDIT_LOG: %q is not an absolute path", c.AuditLog))
+	}
+	if c.MaxUploadBytes < 0 {
+		errs = append(errs, errors.New("LATTICE_MAX_UPLOAD_BYTES: must not be negative"))
+	}
+	if c.SharedDownloadMax < 0 {
+		errs = append(errs, errors.New("LATTICE_SHARED_DOWNLOAD_MAX: must not be negative"))
+	}
+	if c.ListMaxLimit < 1 {
+		errs = append(errs, errors.New("LATTICE_LIST_MAX_LIMIT: must be at least 1"))
+	}
+	if c.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("LATTICE_REQUEST_TIMEOUT: must be positive"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("LATTICE_SHUTDOWN_TIMEOUT: must be positive"))
+	}
+	if c.MaxConns < 1 {
+		errs = append(errs, errors.New("LATTICE_MAX_CONNS: must be at least 1"))
+	}
+	if c.ReadHeaderTimeout <= 0 {
+		errs = append(errs, errors.New("LATTICE_READ_HEADER_TIMEOUT: must be positive"))
+	}
+	if c.ReadTimeout < 0 {
+		errs = append(errs, errors.New("LATTICE_READ_TIMEOUT: must not be negative"))
+	}
+	if c.WriteTimeout < 0 {
+		errs = append(errs, errors.New("LATTICE_WRITE_TIMEOUT: must not be negative"))
+	}
+	if c.IdleTimeout <= 0 {
+		errs = append(errs, errors.New("LATTICE_IDLE_TIMEOUT: must be positive"))
+	}
+	if c.RateLimit <= 0 {
+		errs = append(errs, errors.New("LATTICE_RATE_LIMIT: must be positive"))
+	}
+	if c.RateBurst < 1 {
+		errs = append(errs, errors.New("LATTICE_RATE_BURST: must be at least 1"))
+	}
+	if c.RateLimitTTL <= 0 {
+		errs = append(errs, errors.New("LATTICE_RATE_LIMIT_TTL: must be positive"))
+	}
+	if c.IdempotencyTTL <= 0 {
+		errs = append(errs, errors.New("LATTICE_IDEMPOTENCY_TTL: must be positive"))
+	}
+	if c.SessionTTL <= 0 {
+		errs = append(errs, errors.New("LATTICE_SESSION_TTL: must be positive"))
+	}
+	if c.UploadTTL <= 0 {
+		errs = append(errs, errors.New("LATTICE_UPLOAD_TTL: must be positive"))
+	}
+	if c.UploadGCInterval <= 0 {
+		errs = append(errs, errors.New("LATTICE_UPLOAD_GC_INTERVAL: must be positive"))
+	}
+	if c.DeleteGrace < 0 {
+		errs = append(errs, errors.New("LATTICE_DELETE_GRACE: must not be negative"))
+	}
+	if c.PurgeInterval <= 0 {
+		errs = append(errs, errors.New("LATTICE_PURGE_INTERVAL: must be positive"))
+	}
+	for _, o := range c.CORSOrigins {
+		if o == "*" {
+			continue
+		}
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("LATTICE_CORS_ORIGINS: %q is not an origin, want scheme://host[:port]", o))
+		}
+	}
+	return errs
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList reads a comma-separated list from the environment variable key,
+// skipping empty entries.
+func envList(key string) []string {
+	var list []string
+	for v := range strings.SplitSeq(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envBool reads a bool from the environment variable key, returning def
+// when the variable is unset, empty or invalid.
+func envBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("%s: %w", key, err)
+	}
+	return b, nil
+}
+
+// envLevel reads a slog.Level such as "debug" or "warn" from the
+// environment variable key, returning def when the variable is unset, empty
+// or invalid.
+func envLevel(key string, def slog.Level) (slog.Level, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		return def, fmt.Errorf("%s: %w", key, err)
+	}
+	return level, nil
+}
+
+// envDuration reads a time.Duration from the environment variable key,
+// returning def when the variable is unset or empty. On error def is
+// returned as well, so validation doesn't report the variable twice.
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+// envInt64 reads an int64 from the environment variable key, returning def
+// when the variable is unset, empty or invalid.
+func envInt64(key string, def int64) (int64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return def, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
+// envFloat64 reads a float64 from the environment variable key, returning
+// def when the variable is unset, empty or invalid.
+func envFloat64(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def, fmt.Errorf("%s: %w", key, err)
+	}
+	return f, nil
+}
+
+// envPrefixes reads a comma-separated list of CIDRs from the environment
+// variable key. A bare IP is taken as a single-address prefix.
+func envPrefixes(key string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for v := range strings.SplitSeq(os.Getenv(key), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// envKey reads a hex-encoded 32-byte key from the environment variable key
+// into k. An unset variable is an error, unless ephemeral allows generating
+// a random key, which doesn't survive a restart: the objects stored and the
+// URLs signed under it become unreadable. It reports whether k was generated.
+func envKey(key string, k *[32]byte, ephemeral bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		if !ephemeral {
+			return false, fmt.Errorf("%s: must be set, or LATTICE_EPHEMERAL_KEYS=true to generate one", key)
+		}
+		_, err := rand.Read(k[:])
+		return true, err
+	}
+	b, err := hex.DecodeString(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	if len(b) != len(k) {
+		return false, fmt.Errorf("%s: must be %d bytes, got %d", key, len(k), len(b))
+	}
+	copy(k[:], b)
+	clear(b)
+	return false, nil
+}
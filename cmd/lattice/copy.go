@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+const (
+	// copyBufferSize is the size of the chunks moved by CopyWithProgress.
+	copyBufferSize = 32 << 10
+
+	// progressInterval is the minimum time between two progress reports of
+	// CopyWithProgress.
+	progressInterval = 250 * time.Millisecond
+)
+
+// CopyWithProgress copies src to dst like io.Copy, one chunk at a time, and
+// returns the number of bytes written. It stops with the context error as
+// soon as ctx is done, checked between chunks, so a copy to a client that
+// went away doesn't run to the end. onProgress, when not nil, is called with
+// the number of bytes written so far at most every progressInterval, and a
+// last time with the total once the copy ends, whatever the reason.
+func CopyWithProgress(ctx context.Context, dst io.Writer, src io.Reader, onProgress func(bytesCopied int64)) (int64, error) {
+	var written int64
+	report := func() {
+		if onProgress != nil {
+			onProgress(written)
+		}
+	}
+	defer report()
+
+	buf := make([]byte, copyBufferSize)
+	last := time.Now()
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			wn, werr := dst.Write(buf[:n])
+			written += int64(wn)
+			if werr != nil {
+				return written, werr
+			}
+			if wn != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+		if now := time.Now(); now.Sub(last) >= progressInterval {
+			last = now
+			report()
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCopyWithProgress(t *testing.T) {
+	src := make([]byte, 10*copyBufferSize+7)
+	rand.Read(src)
+	var (
+		dst     bytes.Buffer
+		reports []int64
+	)
+	n, err := CopyWithProgress(context.Background(), &dst, iotest.HalfReader(bytes.NewReader(src)), func(b int64) {
+		reports = append(reports, b)
+	})
+	if err != nil || n != int64(len(src)) {
+		t.Fatalf("CopyWithProgress = %d, %v, want %d, nil", n, err, len(src))
+	}
+	if !bytes.Equal(dst.Bytes(), src) {
+		t.Error("copied bytes differ from the source")
+	}
+	// the copy takes far less than an interval per chunk, so reports are
+	// throttled to a few, the last one with the total.
+	if len(reports) == 0 || len(reports) > 2 || reports[len(reports)-1] != n {
+		t.Errorf("reports = %v, want at most 2 ending with %d", reports, n)
+	}
+}
+
+// cancelingReader cancels its context once it returned after bytes.
+type cancelingReader struct {
+	r      io.Reader
+	after  int
+	cancel context.CancelFunc
+}
+
+func (r *cancelingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.after -= n; r.after <= 0 {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestCopyWithProgressCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	src := &cancelingReader{r: bytes.NewReader(make([]byte, 10*copyBufferSize)), after: 3 * copyBufferSize, cancel: cancel}
+	var (
+		dst  bytes.Buffer
+		last int64 = -1
+	)
+	n, err := CopyWithProgress(ctx, &dst, src, func(b int64) { last = b })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error = %v, want %v", err, context.Canceled)
+	}
+	if n != 3*copyBufferSize || int64(dst.Len()) != n {
+		t.Errorf("copied %d bytes, wrote %d, want %d", n, dst.Len(), 3*copyBufferSize)
+	}
+	if last != n {
+		t.Errorf("last report = %d, want the total of %d", last, n)
+	}
+}
+
+func TestCopyWithProgressErrors(t *testing.T) {
+	errRead := errors.New("read failed")
+	var last int64
+	n, err := CopyWithProgress(context.Background(), io.Discard, io.MultiReader(bytes.NewReader(make([]byte, 100)), iotest.ErrReader(errRead)), func(b int64) { last = b })
+	if !errors.Is(err, errRead) || n != 100 || last != 100 {
+		t.Errorf("read error: %d, %v, last report %d", n, err, last)
+	}
+
+	n, err = CopyWithProgress(context.Background(), shortWriter(5), bytes.NewReader(make([]byte, 100)), nil)
+	if !errors.Is(err, io.ErrShortWrite) || n != 5 {
+		t.Errorf("short write: %d, %v, want 5, io.ErrShortWrite", n, err)
+	}
+}
+
+// shortWriter accepts at most its value of bytes per write, without error.
+type shortWriter int
+
+func (w shortWriter) Write(p []byte) (int, error) { return min(len(p), int(w)), nil }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig configures the CORS middleware.
+type CORSConfig struct {
+	// AllowedOrigins lists the origins, e.g. "https://app.example.com",
+	// allowed to call the API from a browser. "*" allows any origin.
+	AllowedOrigins []string
+
+	// AllowedMethods and AllowedHeaders are sent in reply to preflight
+	// requests.
+	AllowedMethods []string
+	AllowedHeaders []string
+
+	// ExposedHeaders lists the response headers scripts may read.
+	ExposedHeaders []string
+
+	// AllowCredentials lets browsers send cookies and Authorization with
+	// cross-origin requests. The exact origin is reflected then, since "*"
+	// is not accepted for credentialed requests.
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache a preflight result.
+	MaxAge time.Duration
+}
+
+// CORS answers preflight requests from allowed origins with 204 without
+// calling the next handler, and adds the CORS headers to the actual requests
+// of those origins. Requests from other origins get no CORS headers, so
+// browsers keep them from reading the response.
+func CORS(cfg CORSConfig) Middleware {
+	origins := make([]string, len(cfg.AllowedOrigins))
+	for i, o := range cfg.AllowedOrigins {
+		origins[i] = strings.ToLower(o)
+	}
+	anyOrigin := slices.Contains(origins, "*")
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+	exposed := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	allowed := func(origin string) bool {
+		return anyOrigin || slices.Contains(origins, strings.ToLower(origin))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			// the reply depends on the origin unless every origin gets "*".
+			if !anyOrigin || cfg.AllowCredentials {
+				h.Add("Vary", "Origin")
+			}
+			if !allowed(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if anyOrigin && !cfg.AllowCredentials {
+				h.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				h.Set("Access-Control-Allow-Origin", origin)
+			}
+			if cfg.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if preflight {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+				h.Set("Access-Control-Allow-Methods", methods)
+				if headers != "" {
+					h.Set("Access-Control-Allow-Headers", headers)
+				}
+				if cfg.MaxAge > 0 {
+					h.Set("Access-Control-Max-Age", maxAge)
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if exposed != "" {
+				h.Set("Access-Control-Expose-Headers", exposed)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// The errors of the decrypt path of downloads, as classified by
+// decryptError. Each wraps the error it was classified from.
+var (
+	// ErrNotFound is returned when there is no object under the ID.
+	ErrNotFound = errors.New("object not found")
+
+	// ErrWrongKey is returned when the object was encrypted with another
+	// key than the server's.
+	ErrWrongKey = errors.New("object encrypted with another key")
+
+	// ErrTampered is returned when a chunk of the object fails its
+	// authentication, or chunks are missing from its end.
+	ErrTampered = errors.New("object failed authentication")
+
+	// ErrBadFormat is returned when the object is not an encrypted stream
+	// this server can read.
+	ErrBadFormat = errors.New("object is not a readable encrypted stream")
+)
+
+// decryptError classifies err, returned while opening or decrypting an
+// object, as one of ErrNotFound, ErrWrongKey, ErrTampered or ErrBadFormat.
+// Other errors are returned unchanged.
+func decryptError(err error) error {
+	var (
+		chunkErr *crypto.ChunkError
+		kind     error
+	)
+	switch {
+	case errors.Is(err, store.ErrNotFound), errors.Is(err, store.ErrInvalidID):
+		kind = ErrNotFound
+	case errors.Is(err, crypto.ErrWrongKey):
+		kind = ErrWrongKey
+	case errors.As(err, &chunkErr), errors.Is(err, crypto.ErrAuthFailed):
+		kind = ErrTampered
+	case errors.Is(err, crypto.ErrUnknownFormat), errors.Is(err, crypto.ErrTruncated):
+		// a truncated header or a size that can't hold the chunks.
+		kind = ErrBadFormat
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
+
+// writeDecryptError replies to err, classified by decryptError, with 404,
+// 403, 422 or 400, and with a 500 error when it is none of them.
+func writeDecryptError(w http.ResponseWriter, err error, id string, logger log.Logger) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		WriteError(w, http.StatusNotFound, "not_found", "object not found")
+	case errors.Is(err, ErrWrongKey):
+		logger.Error("cannot decrypt object", "id", id, "error", err)
+		WriteError(w, http.StatusForbidden, "wrong_key", ErrWrongKey.Error())
+	case errors.Is(err, ErrTampered):
+		logger.Error("cannot decrypt object", "id", id, "error", err)
+		WriteError(w, http.StatusUnprocessableEntity, "tampered", ErrTampered.Error())
+	case errors.Is(err, ErrBadFormat):
+		logger.Error("cannot decrypt object", "id", id, "error", err)
+		WriteError(w, http.StatusBadRequest, "bad_format", ErrBadFormat.Error())
+	default:
+		logger.Error("cannot decrypt object", "id", id, "error", err)
+		WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+	}
+}
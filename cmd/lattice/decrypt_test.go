@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+func TestDecryptError(t *testing.T) {
+	other := errors.New("disk gone")
+	for _, tt := range []struct {
+		err  error
+		want error
+	}{
+		{fmt.Errorf("%w: ab", store.ErrNotFound), ErrNotFound},
+		{store.ErrInvalidID, ErrNotFound},
+		{crypto.ErrWrongKey, ErrWrongKey},
+		{&crypto.ChunkError{Index: 3, Err: crypto.ErrAuthFailed}, ErrTampered},
+		{&crypto.ChunkError{Index: 3, Err: crypto.ErrTruncated}, ErrTampered},
+		{fmt.Errorf("%w: bad magic", crypto.ErrUnknownFormat), ErrBadFormat},
+		{crypto.ErrTruncated, ErrBadFormat},
+		{other, other},
+	} {
+		err := decryptError(tt.err)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("decryptError(%v) = %v, want %v", tt.err, err, tt.want)
+		}
+		// the classified error is still there for debugging.
+		if !errors.Is(err, tt.err) {
+			t.Errorf("decryptError(%v) = %v, doesn't wrap it", tt.err, err)
+		}
+	}
+}
+
+func TestDownloadDecryptErrors(t *testing.T) {
+	const tag = 16
+	for _, tt := range []struct {
+		name   string
+		mutate func(t *testing.T, ct []byte) []byte
+		status int
+		code   string
+	}{
+		{"wrong key", func(t *testing.T, ct []byte) []byte {
+			var key [32]byte
+			rand.Read(key[:])
+			var buf bytes.Buffer
+			w, err := crypto.NewEncryptWriter(&buf, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte("other key"))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			return buf.Bytes()
+		}, http.StatusForbidden, "wrong_key"},
+		{"tampered", func(t *testing.T, ct []byte) []byte {
+			ct[len(ct)-tag-1] ^= 1
+			return ct
+		}, http.StatusUnprocessableEntity, "tampered"},
+		{"bad format", func(t *testing.T, ct []byte) []byte {
+			ct[0] ^= 1
+			return ct
+		}, http.StatusBadRequest, "bad_format"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			obj := ts.upload(aliceToken, "will not decrypt")
+			ts.corrupt(obj.ID, func(ct []byte) []byte { return tt.mutate(t, ct) })
+			// whole downloads share decryption, ranges don't, both report
+			// the same errors.
+			for _, header := range [][]string{nil, {"Range", "bytes=0-3"}} {
+				w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil, header...)
+				assertEnvelope(t, w, tt.status, tt.code)
+			}
+		})
+	}
+
+	ts := newTestServer(t)
+	w := ts.do(http.MethodGet, "/objects/"+fmt.Sprintf("%064x", 1), aliceToken, nil)
+	assertEnvelope(t, w, http.StatusNotFound, "not_found")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// handleDelete soft deletes the object named by the id path value, hiding it
+// until it is restored or purged by purgeDeleted. With purge=true the object
+// is removed for good, which is reserved to admins. Only the owner of an
+// object, or an admin, may delete it. Deleting an object that is already soft
+// deleted replies 204 as well. If-Match is evaluated against the ETag of the
+// object.
+func handleDelete(objects *tombstoneStore, metas, index Store, key [32]byte, admins []string, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		id := r.PathValue("id")
+
+		purge := false
+		if v := r.URL.Query().Get("purge"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				WriteError(w, http.StatusBadRequest, "bad_request", "purge must be a boolean")
+				return
+			}
+			purge = b
+		}
+		admin := isAdmin(r.Context(), admins)
+		if purge && !admin {
+			WriteError(w, http.StatusForbidden, "forbidden", "purge is admin only")
+			return
+		}
+		if !ownsObject(w, r, metas, key, id, admin, logger) {
+			return
+		}
+		if !checkPreconditions(w, r, objectETag(id)) {
+			return
+		}
+
+		var err error
+		if purge {
+			err = purgeObject(r.Context(), objects, metas, index, key, id)
+		} else {
+			err = objects.SoftDelete(r.Context(), id)
+		}
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidID) {
+				WriteError(w, http.StatusNotFound, "not_found", "object not found")
+				return
+			}
+			logger.Error("cannot delete object", "id", id, "purge", purge, "error", err)
+			writeStoreError(w, err)
+			return
+		}
+		logger.Info("object deleted", "id", id, "purge", purge)
+		action := AuditDelete
+		if purge {
+			action = AuditPurge
+		}
+		recordAudit(r.Context(), AuditEvent{Action: action, ObjectID: id})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleRestore makes the soft deleted object named by the id path value
+// visible again. Only the owner of an object, or an admin, may restore it.
+func handleRestore(objects *tombstoneStore, metas Store, key [32]byte, admins []string, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		id := r.PathValue("id")
+
+		if !ownsObject(w, r, metas, key, id, isAdmin(r.Context(), admins), logger) {
+			return
+		}
+		if err := objects.Restore(r.Context(), id); err != nil {
+			if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidID) {
+				WriteError(w, http.StatusNotFound, "not_found", "object not found")
+				return
+			}
+			logger.Error("cannot restore object", "id", id, "error", err)
+			writeStoreError(w, err)
+			return
+		}
+		recordAudit(r.Context(), AuditEvent{Action: AuditRestore, ObjectID: id})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ownsObject checks that the authenticated identity owns the object stored
+// under id, according to its metadata, replying 403 when it doesn't. Admins
+// own every object, even one without metadata.
+func ownsObject(w http.ResponseWriter, r *http.Request, metas Store, key [32]byte, id string, admin bool, logger log.Logger) bool {
+	if admin {
+		return true
+	}
+	_, ok := ownedMetadata(w, r, metas, key, id, false, logger)
+	return ok
+}
+
+// ownedMetadata returns the metadata of the object stored under id when the
+// authenticated identity owns it, or is an admin. Otherwise it replies 403,
+// or 404 when the object has no metadata, and reports false.
+func ownedMetadata(w http.ResponseWriter, r *http.Request, metas Store, key [32]byte, id string, admin bool, logger log.Logger) (Metadata, bool) {
+	md, err := getMetadata(r.Context(), metas, key, id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidID) {
+			WriteError(w, http.StatusNotFound, "not_found", "object not found")
+			return Metadata{}, false
+		}
+		logger.Error("cannot read metadata", "id", id, "error", err)
+		WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+		return Metadata{}, false
+	}
+	if admin {
+		return md, true
+	}
+	if identity, _ := IdentityFromContext(r.Context()); md.Owner == "" || md.Owner != identity.Subject {
+		WriteError(w, http.StatusForbidden, "forbidden", "only the owner can access the object")
+		return Metadata{}, false
+	}
+	return md, true
+}
+
+// purgeObject removes the object stored under id for good, with its metadata
+// and its index entry. It returns store.ErrNotFound when there is no such
+// object.
+func purgeObject(ctx context.Context, objects *tombstoneStore, metas, index Store, key [32]byte, id string) error {
+	md, err := getMetadata(ctx, metas, key, id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	if err := objects.Delete(ctx, id); err != nil {
+		return err
+	}
+	if err := metas.Delete(ctx, id); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	if md.Owner != "" {
+		if err := index.Delete(ctx, ownerPrefix(md.Owner)+id); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeDeleted purges the objects soft deleted before cutoff and returns how
+// many were purged, recording each purge to auditor.
+func purgeDeleted(ctx context.Context, objects *tombstoneStore, metas, index Store, key [32]byte, cutoff time.Time, auditor Auditor) (int, error) {
+	ids, err := objects.DeletedBefore(ctx, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, id := range ids {
+		// it may have been restored since it was listed.
+		if del, err := objects.deleted(ctx, id); err != nil || !del {
+			continue
+		}
+		if err := purgeObject(ctx, objects, metas, index, key, id); err != nil && !errors.Is(err, store.ErrNotFound) {
+			return n, err
+		}
+		auditor.Record(ctx, AuditEvent{Time: time.Now().UTC(), Action: AuditPurge, ObjectID: id, Detail: "delete grace elapsed"})
+		n++
+	}
+	return n, nil
+}
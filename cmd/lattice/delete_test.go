@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// listed returns the IDs of the objects listed for token.
+func (ts *testServer) listed(token string) []string {
+	ts.t.Helper()
+	w := ts.do(http.MethodGet, "/objects", token, nil)
+	if w.Code != http.StatusOK {
+		ts.t.Fatalf("list: status %d: %s", w.Code, w.Body)
+	}
+	var page listResponse
+	decodeBody(ts.t, w, &page)
+	var ids []string
+	for _, obj := range page.Objects {
+		ids = append(ids, obj.ID)
+	}
+	return ids
+}
+
+func TestSoftDelete(t *testing.T) {
+	ts := newTestServer(t)
+	obj := ts.upload(aliceToken, "soft deleted")
+	target := "/objects/" + obj.ID
+
+	if w := ts.do(http.MethodDelete, target, bobToken, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("delete by another user: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	// deleting twice is idempotent.
+	for range 2 {
+		if w := ts.do(http.MethodDelete, target, aliceToken, nil); w.Code != http.StatusNoContent {
+			t.Fatalf("delete: status %d, want %d: %s", w.Code, http.StatusNoContent, w.Body)
+		}
+	}
+	if w := ts.do(http.MethodGet, target, aliceToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("get of a deleted object: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if ids := ts.listed(aliceToken); len(ids) != 0 {
+		t.Errorf("listed %v, want the deleted object hidden", ids)
+	}
+	if got := len(ts.audit.recorded(AuditDelete)); got != 2 {
+		t.Errorf("audited %d deletes, want 2", got)
+	}
+
+	if w := ts.do(http.MethodPost, target+"/restore", aliceToken, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("restore: status %d, want %d: %s", w.Code, http.StatusNoContent, w.Body)
+	}
+	if w := ts.do(http.MethodGet, target, aliceToken, nil); w.Code != http.StatusOK || w.Body.String() != "soft deleted" {
+		t.Errorf("get of a restored object: %d %q", w.Code, w.Body)
+	}
+	if ids := ts.listed(aliceToken); len(ids) != 1 || ids[0] != obj.ID {
+		t.Errorf("listed %v, want the restored object", ids)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ts := newTestServer(t)
+	obj := ts.upload(aliceToken, "purged")
+	target := "/objects/" + obj.ID
+
+	if w := ts.do(http.MethodDelete, target+"?purge=true", aliceToken, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("purge by the owner: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := ts.do(http.MethodDelete, target+"?purge=maybe", rootToken, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("purge=maybe: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := ts.do(http.MethodDelete, target+"?purge=true", rootToken, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("purge: status %d, want %d: %s", w.Code, http.StatusNoContent, w.Body)
+	}
+	if _, err := ts.store.Stat(context.Background(), obj.ID); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("stored object after purge: Stat = %v, want ErrNotFound", err)
+	}
+	if w := ts.do(http.MethodPost, target+"/restore", rootToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("restore after purge: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if got := len(ts.audit.recorded(AuditPurge)); got != 1 {
+		t.Errorf("audited %d purges, want 1", got)
+	}
+}
+
+// TestPurgeDeleted runs the purge of the GC with cutoffs before and after
+// the grace window of a deletion.
+func TestPurgeDeleted(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	deleted := ts.upload(aliceToken, "deleted")
+	kept := ts.upload(aliceToken, "kept")
+	if w := ts.do(http.MethodDelete, "/objects/"+deleted.ID, aliceToken, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+	purge := func(cutoff time.Time) int {
+		t.Helper()
+		n, err := purgeDeleted(ctx, ts.objects, ts.metas, ts.index, ts.cfg.ObjectKey, cutoff, ts.audit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// within the grace window, nothing is purged and the object can still
+	// be restored.
+	if n := purge(time.Now().Add(-time.Hour)); n != 0 {
+		t.Fatalf("purged %d objects within the grace window, want 0", n)
+	}
+	if _, err := ts.store.Stat(ctx, deleted.ID); err != nil {
+		t.Fatalf("deleted object within the grace window: Stat = %v", err)
+	}
+
+	if n := purge(time.Now().Add(time.Hour)); n != 1 {
+		t.Fatalf("purged %d objects after the grace window, want 1", n)
+	}
+	if _, err := ts.store.Stat(ctx, deleted.ID); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("deleted object after the grace window: Stat = %v, want ErrNotFound", err)
+	}
+	if _, err := ts.metas.Stat(ctx, deleted.ID); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("metadata after the grace window: Stat = %v, want ErrNotFound", err)
+	}
+	if _, err := ts.store.Stat(ctx, kept.ID); err != nil {
+		t.Errorf("live object: Stat = %v, want it kept", err)
+	}
+	if events := ts.audit.recorded(AuditPurge); len(events) != 1 || events[0].ObjectID != deleted.ID {
+		t.Errorf("purge events = %+v", events)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+var (
+	// errDigestMismatch is returned by a digestReader whose body doesn't
+	// hash to the digest sent by the client.
+	errDigestMismatch = errors.New("request body does not match its digest")
+
+	// errUnsupportedDigest is returned for a Digest header naming none of
+	// the supportedDigests.
+	errUnsupportedDigest = errors.New("unsupported digest algorithm")
+)
+
+// supportedDigests lists the Digest algorithms checked by digestReader, by
+// order of preference. It is sent in Want-Digest when none of them is used.
+const supportedDigests = "sha-256, md5"
+
+// digestReader hashes a request body as it is read and checks it against the
+// Content-MD5 or RFC 3230 Digest header of the request once the body ends:
+// instead of io.EOF, it then returns errDigestMismatch when they differ.
+type digestReader struct {
+	r      io.Reader
+	h      hash.Hash
+	want   []byte
+	header string
+
+	done bool
+	err  error
+}
+
+// newDigestReader returns a digestReader checking r against the digest in h,
+// preferring Digest over Content-MD5, or nil when h carries neither. A
+// Digest header with no supported algorithm fails with errUnsupportedDigest.
+func newDigestReader(r io.Reader, h http.Header) (*digestReader, error) {
+	if v := h.Get("Digest"); v != "" {
+		alg, want, err := parseDigest(v)
+		if err != nil {
+			return nil, err
+		}
+		return &digestReader{r: r, h: digestHash(alg), want: want, header: "Digest"}, nil
+	}
+	if v := h.Get("Content-MD5"); v != "" {
+		want, err := decodeDigest(v, md5.Size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Content-MD5: %w", err)
+		}
+		return &digestReader{r: r, h: md5.New(), want: want, header: "Content-MD5"}, nil
+	}
+	return nil, nil
+}
+
+// parseDigest returns the most preferred of the supportedDigests listed in
+// the Digest header v, along with its decoded value.
+func parseDigest(v string) (string, []byte, error) {
+	values := make(map[string]string)
+	for part := range strings.SplitSeq(v, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid Digest %q", part)
+		}
+		values[strings.ToLower(alg)] = value
+	}
+	for alg := range strings.SplitSeq(supportedDigests, ", ") {
+		value, ok := values[alg]
+		if !ok {
+			continue
+		}
+		want, err := decodeDigest(value, digestHash(alg).Size())
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid Digest %s: %w", alg, err)
+		}
+		return alg, want, nil
+	}
+	return "", nil, errUnsupportedDigest
+}
+
+func decodeDigest(v string, size int) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != size {
+		return nil, fmt.Errorf("want %d bytes, got %d", size, len(b))
+	}
+	return b, nil
+}
+
+func digestHash(alg string) hash.Hash {
+	if alg == "md5" {
+		return md5.New()
+	}
+	return sha256.New()
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	if d.done {
+		return 0, d.err
+	}
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF {
+		d.done, d.err = true, io.EOF
+		if !bytes.Equal(d.h.Sum(nil), d.want) {
+			d.err = fmt.Errorf("%w: %s", errDigestMismatch, d.header)
+		}
+		err = d.err
+	}
+	return n, err
+}
+
+// verify reads what is left of the body, which a multipart form may leave
+// unread, and checks it against the digest.
+func (d *digestReader) verify() error {
+	_, err := io.Copy(io.Discard, d)
+	return err
+}
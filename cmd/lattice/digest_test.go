@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUploadDigest(t *testing.T) {
+	const body = "checked in transit"
+	sha := sha256.Sum256([]byte(body))
+	sum := md5.Sum([]byte(body))
+	shaDigest := "sha-256=" + base64.StdEncoding.EncodeToString(sha[:])
+	md5Digest := base64.StdEncoding.EncodeToString(sum[:])
+	wrong := sha256.Sum256([]byte("something else"))
+	wrongDigest := "sha-256=" + base64.StdEncoding.EncodeToString(wrong[:])
+
+	t.Run("match", func(t *testing.T) {
+		ts := newTestServer(t)
+		for _, header := range [][]string{
+			{"Digest", shaDigest},
+			{"Digest", "SHA-256=" + base64.StdEncoding.EncodeToString(sha[:])},
+			{"Digest", "md5=" + md5Digest},
+			{"Content-MD5", md5Digest},
+			// sha-256 is preferred, the wrong md5 is not checked.
+			{"Digest", "md5=" + base64.StdEncoding.EncodeToString(make([]byte, md5.Size)) + ", " + shaDigest},
+			// Digest is preferred over Content-MD5.
+			{"Digest", shaDigest, "Content-MD5", base64.StdEncoding.EncodeToString(make([]byte, md5.Size))},
+		} {
+			w := ts.do(http.MethodPost, "/objects", bobToken, strings.NewReader(body), header...)
+			if w.Code != http.StatusCreated {
+				t.Errorf("%v: status %d, want %d: %s", header, w.Code, http.StatusCreated, w.Body)
+			}
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		ts := newTestServer(t)
+		for _, header := range [][]string{
+			{"Digest", wrongDigest},
+			{"Content-MD5", base64.StdEncoding.EncodeToString(make([]byte, md5.Size))},
+		} {
+			w := ts.do(http.MethodPost, "/objects", aliceToken, strings.NewReader(body), header...)
+			assertEnvelope(t, w, http.StatusBadRequest, "digest_mismatch")
+		}
+		// a body cut short of what was hashed doesn't match either.
+		w := ts.do(http.MethodPost, "/objects", aliceToken, strings.NewReader(body[1:]), "Digest", shaDigest)
+		assertEnvelope(t, w, http.StatusBadRequest, "digest_mismatch")
+		if n := ts.storedObjects(); n != 0 {
+			t.Errorf("%d objects stored, want none", n)
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		ts := newTestServer(t)
+		w := ts.do(http.MethodPost, "/objects", aliceToken, strings.NewReader(body), "Digest", "sha-512=AAAA")
+		assertEnvelope(t, w, http.StatusBadRequest, "bad_request")
+		if got := w.Header().Get("Want-Digest"); got != supportedDigests {
+			t.Errorf("Want-Digest = %q, want %q", got, supportedDigests)
+		}
+		for _, header := range [][]string{
+			{"Digest", "sha-256"},
+			{"Digest", "sha-256=not base64"},
+			{"Digest", "sha-256=" + md5Digest},
+			{"Content-MD5", "AAAA"},
+		} {
+			w := ts.do(http.MethodPost, "/objects", aliceToken, strings.NewReader(body), header...)
+			assertEnvelope(t, w, http.StatusBadRequest, "bad_request")
+		}
+		if n := ts.storedObjects(); n != 0 {
+			t.Errorf("%d objects stored, want none", n)
+		}
+	})
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// RecipientsHeader lists the recipients of an envelope upload, as
+// comma-separated base64 X25519 public keys.
+const RecipientsHeader = "Lattice-Recipients"
+
+// rotatePage is how many manifests a rotation reads at a time.
+const rotatePage = 100
+
+// envelopeManifest is what is stored about an envelope next to its content:
+// its data key wrapped for every recipient, see crypto.Envelope, and who
+// uploaded it. It holds no secret.
+type envelopeManifest struct {
+	ID         string              `json:"id"`
+	Owner      string              `json:"owner,omitempty"`
+	Size       int64               `json:"size"`
+	CreatedAt  time.Time           `json:"created_at"`
+	RotatedAt  time.Time           `json:"rotated_at,omitzero"`
+	Recipients []crypto.WrappedKey `json:"recipients"`
+}
+
+// putManifest stores m in manifests under its ID. Rotating the keys of an
+// envelope only rewrites its manifest, and the Put of a FSStore writes a
+// temporary file that is synced and renamed over the old manifest, so a
+// crash mid-rotation leaves either the old or the new manifest, never a
+// partial one.
+func putManifest(ctx context.Context, manifests Store, m envelopeManifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return manifests.Put(ctx, m.ID, bytes.NewReader(b))
+}
+
+// getManifest reads the manifest stored under id.
+func getManifest(ctx context.Context, manifests Store, id string) (envelopeManifest, error) {
+	rc, err := manifests.Get(ctx, id)
+	if err != nil {
+		return envelopeManifest{}, err
+	}
+	defer rc.Close()
+	var m envelopeManifest
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return envelopeManifest{}, fmt.Errorf("manifest %s: %w", id, err)
+	}
+	return m, nil
+}
+
+// parsePublicKeys parses comma-separated base64 X25519 public keys.
+func parsePublicKeys(v string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		var pub crypto.PublicKey
+		if err := pub.UnmarshalText([]byte(s)); err != nil {
+			return nil, err
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no recipient")
+	}
+	return keys, nil
+}
+
+// handleSealEnvelope encrypts the request body under a new data key wrapped
+// for the recipients of the RecipientsHeader, see crypto.SealFor, and puts
+// the ciphertext in envelopes and the manifest in manifests, under a random
+// ID. The server keeps no means to decrypt it: recipients download the
+// ciphertext and the manifest and open them with their private key. Bodies
+// larger than maxBytes are rejected with 413.
+func handleSealEnvelope(envelopes, manifests Store, maxBytes int64, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		recipients, err := parsePublicKeys(r.Header.Get(RecipientsHeader))
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, "bad_request", RecipientsHeader+": "+err.Error())
+			return
+		}
+		var raw [16]byte
+		if _, err := rand.Read(raw[:]); err != nil {
+			logger.Error("cannot generate envelope id", "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		id := hex.EncodeToString(raw[:])
+
+		body := &countingReader{r: bodyReader{http.MaxBytesReader(w, r.Body, maxBytes)}}
+		env, err := crypto.SealFor(body, recipients)
+		if err == nil {
+			err = envelopes.Put(r.Context(), id, env.Content)
+		}
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxErr):
+				WriteError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "upload exceeds the maximum size")
+			case errors.Is(err, context.Canceled):
+				logger.Warn("upload canceled", "error", err)
+			case errors.Is(err, errReadBody):
+				logger.Warn("cannot read upload", "error", err)
+				WriteError(w, http.StatusBadRequest, "bad_request", "cannot read request body")
+			default:
+				logger.Error("cannot store envelope", "error", err)
+				writeStoreError(w, err)
+			}
+			return
+		}
+
+		identity, _ := IdentityFromContext(r.Context())
+		m := envelopeManifest{ID: id, Owner: identity.Subject, Size: body.n, CreatedAt: time.Now().UTC(), Recipients: env.Recipients}
+		if err := putManifest(r.Context(), manifests, m); err != nil {
+			logger.Error("cannot store manifest", "id", id, "error", err)
+			// the content is of no use without its manifest.
+			if err := envelopes.Delete(r.Context(), id); err != nil {
+				logger.Warn("cannot delete envelope", "id", id, "error", err)
+			}
+			writeStoreError(w, err)
+			return
+		}
+		recordAudit(r.Context(), AuditEvent{Action: AuditWrite, ObjectID: id, Detail: "envelope"})
+		WriteJSON(w, http.StatusCreated, objectResponse{ID: id, Size: m.Size})
+	}
+}
+
+// ownedManifest returns the manifest of the envelope stored under id when
+// the authenticated identity uploaded it, or is an admin, like
+// ownedMetadata. Otherwise it replies 403, or 404, and reports false.
+func ownedManifest(w http.ResponseWriter, r *http.Request, manifests Store, id string, admin bool, logger log.Logger) (envelopeManifest, bool) {
+	m, err := getManifest(r.Context(), manifests, id)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidID) {
+			WriteError(w, http.StatusNotFound, "not_found", "envelope not found")
+			return envelopeManifest{}, false
+		}
+		logger.Error("cannot read manifest", "id", id, "error", err)
+		WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+		return envelopeManifest{}, false
+	}
+	if identity, _ := IdentityFromContext(r.Context()); !admin && m.Owner != identity.Subject {
+		WriteError(w, http.StatusForbidden, "forbidden", "only the owner can access the envelope")
+		return envelopeManifest{}, false
+	}
+	return m, true
+}
+
+// handleGetManifest replies with the manifest of the envelope named by the
+// id path value.
+func handleGetManifest(manifests Store, admins []string, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		m, ok := ownedManifest(w, r, manifests, r.PathValue("id"), isAdmin(r.Context(), admins), logger)
+		if !ok {
+			return
+		}
+		m.Owner = ""
+		WriteJSON(w, http.StatusOK, m)
+	}
+}
+
+// handleGetEnvelope streams the ciphertext of the envelope named by the id
+// path value, as stored: it is opened by the client, see crypto.Open.
+func handleGetEnvelope(envelopes, manifests Store, admins []string, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		id := r.PathValue("id")
+		if _, ok := ownedManifest(w, r, manifests, id, isAdmin(r.Context(), admins), logger); !ok {
+			return
+		}
+		info, err := envelopes.Stat(r.Context(), id)
+		var rc io.ReadCloser
+		if err == nil {
+			rc, err = envelopes.Get(r.Context(), id)
+		}
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				WriteError(w, http.StatusNotFound, "not_found", "envelope not found")
+				return
+			}
+			logger.Error("cannot open envelope", "id", id, "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		defer rc.Close()
+
+		recordAudit(r.Context(), AuditEvent{Action: AuditRead, ObjectID: id, Detail: "envelope"})
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		if _, err := io.Copy(w, rc); err != nil {
+			logger.Warn("cannot send envelope", "id", id, "error", err)
+		}
+	}
+}
+
+// rotateRequest is the body of POST /admin/rotate: the private key of the
+// recipient to rotate away from, and the recipients to wrap the data keys
+// for instead, as base64 X25519 keys.
+type rotateRequest struct {
+	PrivateKey string   `json:"private_key"`
+	Recipients []string `json:"recipients"`
+}
+
+type rotateResponse struct {
+	Rotated int      `json:"rotated"`
+	Skipped int      `json:"skipped"`
+	Failed  []string `json:"failed,omitempty"`
+}
+
+// handleRotateKeys rewraps the data key of every envelope the private key of
+// the request is a recipient of for the recipients of the request instead,
+// see crypto.Rotate. Only the manifests are rewritten, each one atomically,
+// see putManifest; the content is never re-encrypted. Envelopes the key
+// can't open are skipped. Failures don't stop the rotation, the IDs of the
+// envelopes left unrotated are reported, and the request can be repeated.
+// Concurrent rotations of an envelope are serialized by locks, so none of
+// them overwrites the manifest rewritten by another.
+func handleRotateKeys(manifests Store, locks *KeyedMutex, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		var req rotateRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			WriteError(w, http.StatusBadRequest, "bad_request", "invalid JSON body")
+			return
+		}
+		var priv crypto.PrivateKey
+		b, err := base64.StdEncoding.DecodeString(req.PrivateKey)
+		if err != nil || len(b) != len(priv) {
+			WriteError(w, http.StatusBadRequest, "bad_request", "private_key must be a base64 32-byte key")
+			return
+		}
+		copy(priv[:], b)
+		clear(b)
+		defer clear(priv[:])
+		recipients, err := parsePublicKeys(strings.Join(req.Recipients, ","))
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, "bad_request", "recipients: "+err.Error())
+			return
+		}
+
+		var resp rotateResponse
+		for cursor := ""; ; {
+			ids, next, err := manifests.List(r.Context(), "", cursor, rotatePage)
+			if err != nil {
+				logger.Error("cannot list manifests", "error", err)
+				WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+				return
+			}
+			for _, id := range ids {
+				switch err := rotateEnvelope(r.Context(), manifests, locks, id, priv, recipients); {
+				case err == nil:
+					resp.Rotated++
+					recordAudit(r.Context(), AuditEvent{Action: AuditKeyRotation, ObjectID: id, Detail: strconv.Itoa(len(recipients)) + " recipients"})
+				case errors.Is(err, crypto.ErrNotRecipient), errors.Is(err, store.ErrNotFound):
+					resp.Skipped++
+				default:
+					logger.Error("cannot rotate envelope", "id", id, "error", err)
+					resp.Failed = append(resp.Failed, id)
+				}
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		logger.Info("keys rotated", "rotated", resp.Rotated, "skipped", resp.Skipped, "failed", len(resp.Failed))
+		WriteJSON(w, http.StatusOK, resp)
+	}
+}
+
+// rotateEnvelope rewraps the data key of the envelope stored under id for
+// recipients, given the private key of a current recipient. The manifest is
+// read and rewritten under the lock of id in locks.
+func rotateEnvelope(ctx context.Context, manifests Store, locks *KeyedMutex, id string, priv crypto.PrivateKey, recipients []crypto.PublicKey) error {
+	defer locks.Lock(id)()
+	m, err := getManifest(ctx, manifests, id)
+	if err != nil {
+		return err
+	}
+	rotated, err := crypto.Rotate(&crypto.Envelope{Recipients: m.Recipients}, priv, recipients)
+	if err != nil {
+		return err
+	}
+	m.Recipients, m.RotatedAt = rotated.Recipients, time.Now().UTC()
+	return putManifest(ctx, manifests, m)
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
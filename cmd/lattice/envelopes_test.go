@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+func newKeyPair(t *testing.T) (crypto.PrivateKey, string) {
+	t.Helper()
+	priv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := priv.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := pub.MarshalText()
+	return priv, string(text)
+}
+
+func TestRotateKeys(t *testing.T) {
+	ts := newTestServer(t)
+	oldPriv, oldPub := newKeyPair(t)
+	newPriv, newPub := newKeyPair(t)
+	plain := make([]byte, 200<<10)
+	rand.Read(plain)
+
+	w := ts.do(http.MethodPost, "/envelopes", aliceToken, bytes.NewReader(plain), RecipientsHeader, oldPub)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("seal: status %d: %s", w.Code, w.Body)
+	}
+	var obj objectResponse
+	decodeBody(t, w, &obj)
+	before := ts.do(http.MethodGet, "/envelopes/"+obj.ID, aliceToken, nil).Body.Bytes()
+
+	body, _ := json.Marshal(rotateRequest{
+		PrivateKey: base64.StdEncoding.EncodeToString(oldPriv[:]),
+		Recipients: []string{newPub},
+	})
+	if w := ts.do(http.MethodPost, "/admin/rotate", aliceToken, bytes.NewReader(body)); w.Code != http.StatusForbidden {
+		t.Fatalf("rotate by a user: status %d, want 403", w.Code)
+	}
+	w = ts.do(http.MethodPost, "/admin/rotate", rootToken, bytes.NewReader(body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("rotate: status %d: %s", w.Code, w.Body)
+	}
+	var resp rotateResponse
+	decodeBody(t, w, &resp)
+	if resp.Rotated != 1 || resp.Skipped != 0 || len(resp.Failed) != 0 {
+		t.Fatalf("rotate = %+v, want 1 rotated", resp)
+	}
+
+	after := ts.do(http.MethodGet, "/envelopes/"+obj.ID, aliceToken, nil).Body.Bytes()
+	if !bytes.Equal(before, after) {
+		t.Fatal("content changed by the rotation")
+	}
+	var m envelopeManifest
+	decodeBody(t, ts.do(http.MethodGet, "/envelopes/"+obj.ID+"/manifest", aliceToken, nil), &m)
+	if m.RotatedAt.IsZero() {
+		t.Error("manifest has no rotated_at")
+	}
+	env := &crypto.Envelope{Recipients: m.Recipients, Content: bytes.NewReader(after)}
+	r, err := crypto.Open(env, newPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("open with the new key: %v, plaintext equal %t", err, bytes.Equal(got, plain))
+	}
+	if _, err := crypto.Open(env, oldPriv); !errors.Is(err, crypto.ErrNotRecipient) {
+		t.Fatalf("open with the old key = %v, want ErrNotRecipient", err)
+	}
+
+	events := ts.audit.recorded(AuditKeyRotation)
+	if len(events) != 1 || events[0].ObjectID != obj.ID || events[0].Subject != "root" {
+		t.Fatalf("key rotation audit events = %+v", events)
+	}
+
+	// the old key is no recipient anymore, a second rotation skips it.
+	w = ts.do(http.MethodPost, "/admin/rotate", rootToken, bytes.NewReader(body))
+	decodeBody(t, w, &resp)
+	if resp.Rotated != 0 || resp.Skipped != 1 {
+		t.Fatalf("second rotate = %+v, want 1 skipped", resp)
+	}
+}
+
+// slowGetStore holds every Get for a while, so that concurrent
+// read-modify-writes overlap unless they are serialized.
+type slowGetStore struct{ *store.MemStore }
+
+func (s slowGetStore) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	rc, err := s.MemStore.Get(ctx, id)
+	time.Sleep(20 * time.Millisecond)
+	return rc, err
+}
+
+// TestRotateConcurrent rotates an envelope away from the same key at once:
+// the first rotation wins, and the others find the key no recipient anymore
+// instead of overwriting its manifest.
+func TestRotateConcurrent(t *testing.T) {
+	ctx := context.Background()
+	manifests := slowGetStore{store.NewMemStore()}
+	priv, pub := newKeyPair(t)
+	var oldPub crypto.PublicKey
+	if err := oldPub.UnmarshalText([]byte(pub)); err != nil {
+		t.Fatal(err)
+	}
+	env, err := crypto.SealFor(strings.NewReader("rotated"), []crypto.PublicKey{oldPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const id = "0123456789abcdef"
+	if err := putManifest(ctx, manifests, envelopeManifest{ID: id, Recipients: env.Recipients}); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 4
+	locks := NewKeyedMutex()
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		newPriv, _ := newKeyPair(t)
+		newPub, err := newPriv.Public()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Go(func() { errs[i] = rotateEnvelope(ctx, manifests, locks, id, priv, []crypto.PublicKey{newPub}) })
+	}
+	wg.Wait()
+
+	var rotated int
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			rotated++
+		case !errors.Is(err, crypto.ErrNotRecipient):
+			t.Errorf("rotation %d: %v", i, err)
+		}
+	}
+	if rotated != 1 {
+		t.Errorf("%d rotations succeeded, want 1", rotated)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left after the rotations", len(locks.locks))
+	}
+}
+
+func TestManifestSwapIsAtomic(t *testing.T) {
+	ts := newTestServer(t)
+	_, pub := newKeyPair(t)
+	w := ts.do(http.MethodPost, "/envelopes", aliceToken, strings.NewReader("hi"), RecipientsHeader, pub)
+	var obj objectResponse
+	decodeBody(t, w, &obj)
+
+	// a Put that fails midway leaves the old manifest in place.
+	m, err := getManifest(context.Background(), ts.manifests, obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.manifests.Put(context.Background(), obj.ID, io.MultiReader(strings.NewReader(`{"id":`), errReader{})); err == nil {
+		t.Fatal("Put of a failing reader succeeded")
+	}
+	got, err := getManifest(context.Background(), ts.manifests, obj.ID)
+	if err != nil {
+		t.Fatalf("manifest after a failed swap: %v", err)
+	}
+	if got.ID != m.ID || len(got.Recipients) != len(m.Recipients) {
+		t.Fatalf("manifest after a failed swap = %+v, want %+v", got, m)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// flightChunk is the size of the reads filling the buffer of a flight.
+const flightChunk = 32 << 10
+
+// FlightGroup shares the decryption of an object between the requests that
+// download it at the same time. The first request for an ID starts a flight,
+// which decrypts the object once into a buffer; the requests joining it
+// while it runs read that buffer from its start as it fills. A flight is
+// forgotten once its object is fully read or all of its readers are gone,
+// so nothing outlives the requests sharing it, and the buffer grows up to
+// the plaintext size: callers only share objects small enough to hold.
+type FlightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// NewFlightGroup returns a FlightGroup with no flights.
+func NewFlightGroup() *FlightGroup {
+	return &FlightGroup{flights: make(map[string]*flight)}
+}
+
+type flight struct {
+	g      *FlightGroup
+	id     string
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	ready   chan struct{}
+	changed chan struct{}
+	size    int64
+	buf     []byte
+	err     error
+	readers int
+}
+
+// Join returns a reader of the plaintext of the object id. When no flight is
+// running for id, it starts one calling open, which returns the plaintext
+// reader and its size; the flight does not inherit the
+// cancellation of ctx, as other requests may join it. Join waits for open to
+// return, and returns its error to every request of the flight. The reader
+// must be closed.
+func (g *FlightGroup) Join(ctx context.Context, id string, open func(ctx context.Context) (io.ReadCloser, int64, error)) (*FlightReader, error) {
+	g.mu.Lock()
+	f, ok := g.flights[id]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{g: g, id: id, cancel: cancel, ready: make(chan struct{}), changed: make(chan struct{})}
+		g.flights[id] = f
+		go f.run(fctx, open)
+	}
+	f.mu.Lock()
+	f.readers++
+	f.mu.Unlock()
+	g.mu.Unlock()
+
+	fr := &FlightReader{f: f, ctx: ctx}
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		fr.Close()
+		return nil, ctx.Err()
+	}
+	f.mu.Lock()
+	size, err := f.size, f.err
+	f.mu.Unlock()
+	if size < 0 {
+		fr.Close()
+		return nil, err
+	}
+	return fr, nil
+}
+
+// run opens the plaintext and reads it into the buffer of f until it ends,
+// fails or ctx is canceled by the last reader leaving.
+func (f *flight) run(ctx context.Context, open func(ctx context.Context) (io.ReadCloser, int64, error)) {
+	defer f.g.forget(f)
+	rc, size, err := open(ctx)
+	f.mu.Lock()
+	if err != nil {
+		f.size, f.err = -1, err
+	} else {
+		f.size, f.buf = size, make([]byte, 0, size)
+	}
+	close(f.ready)
+	f.mu.Unlock()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+
+	chunk := make([]byte, flightChunk)
+	for {
+		if err := ctx.Err(); err != nil {
+			f.publish(nil, err)
+			return
+		}
+		n, err := rc.Read(chunk)
+		f.publish(chunk[:n], err)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// publish appends p to the buffer of f, along with err when its reader
+// failed or ended, and wakes up the readers waiting for more.
+func (f *flight) publish(p []byte, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf = append(f.buf, p...)
+	if err != nil {
+		f.err = err
+	}
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// forget removes f from its group, so the next request for its ID starts a
+// new flight.
+func (g *FlightGroup) forget(f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.flights[f.id] == f {
+		delete(g.flights, f.id)
+	}
+}
+
+// FlightReader reads the plaintext of a flight from its start.
+type FlightReader struct {
+	f      *flight
+	ctx    context.Context
+	off    int
+	closed bool
+}
+
+// Size returns the size of the plaintext.
+func (r *FlightReader) Size() int64 {
+	r.f.mu.Lock()
+	defer r.f.mu.Unlock()
+	return r.f.size
+}
+
+// Read reads from the buffer of the flight, waiting for it to fill until
+// the context of the request is done.
+func (r *FlightReader) Read(p []byte) (int, error) {
+	f := r.f
+	for {
+		f.mu.Lock()
+		if r.off < len(f.buf) {
+			n := copy(p, f.buf[r.off:])
+			r.off += n
+			f.mu.Unlock()
+			return n, nil
+		}
+		err, changed := f.err, f.changed
+		f.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// Close leaves the flight, stopping it when no other reader is left.
+func (r *FlightReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	f := r.f
+	// under the lock of the group, so no request joins a flight about to
+	// be canceled.
+	f.g.mu.Lock()
+	f.mu.Lock()
+	f.readers--
+	last := f.readers == 0
+	f.mu.Unlock()
+	if last && f.g.flights[f.id] == f {
+		delete(f.g.flights, f.id)
+	}
+	f.g.mu.Unlock()
+	if last {
+		f.cancel()
+	}
+	return nil
+}
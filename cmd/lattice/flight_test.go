@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// readers returns the number of readers of the flight running for id.
+func (g *FlightGroup) readers(id string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.flights[id]
+	if !ok {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.readers
+}
+
+// waitReaders waits until n readers joined the flight of id.
+func waitReaders(t *testing.T, g *FlightGroup, id string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for g.readers(id) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d readers joined the flight, want %d", g.readers(id), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlightGroupShares(t *testing.T) {
+	const n = 20
+	content := strings.Repeat("shared ", 3*flightChunk/7)
+	var (
+		g       = NewFlightGroup()
+		opens   atomic.Int32
+		release = make(chan struct{})
+	)
+	open := func(context.Context) (io.ReadCloser, int64, error) {
+		opens.Add(1)
+		<-release
+		return io.NopCloser(strings.NewReader(content)), int64(len(content)), nil
+	}
+
+	var wg sync.WaitGroup
+	for range n {
+		wg.Go(func() {
+			fr, err := g.Join(context.Background(), "ab", open)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer fr.Close()
+			got, err := io.ReadAll(fr)
+			if err != nil || string(got) != content || fr.Size() != int64(len(content)) {
+				t.Errorf("read %d bytes of %d, %v", len(got), fr.Size(), err)
+			}
+		})
+	}
+	waitReaders(t, g, "ab", n)
+	close(release)
+	wg.Wait()
+	if got := opens.Load(); got != 1 {
+		t.Errorf("opened %d times, want 1", got)
+	}
+	if got := g.readers("ab"); got != 0 {
+		t.Errorf("flight still running with %d readers", got)
+	}
+}
+
+func TestFlightGroupError(t *testing.T) {
+	errOpen := errors.New("cannot open")
+	g := NewFlightGroup()
+	release := make(chan struct{})
+	open := func(context.Context) (io.ReadCloser, int64, error) {
+		<-release
+		return nil, 0, errOpen
+	}
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Go(func() {
+			if _, err := g.Join(context.Background(), "ab", open); !errors.Is(err, errOpen) {
+				t.Errorf("Join = %v, want %v", err, errOpen)
+			}
+		})
+	}
+	waitReaders(t, g, "ab", 5)
+	close(release)
+	wg.Wait()
+}
+
+// TestFlightGroupLeave checks that the flight is canceled once its last
+// reader leaves, and that a request giving up doesn't cancel the others.
+func TestFlightGroupLeave(t *testing.T) {
+	g := NewFlightGroup()
+	canceled := make(chan struct{})
+	open := func(ctx context.Context) (io.ReadCloser, int64, error) {
+		return io.NopCloser(blockingReader{ctx: ctx, done: canceled}), 100, nil
+	}
+
+	gone, cancel := context.WithCancel(context.Background())
+	first, err := g.Join(gone, "ab", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := g.Join(context.Background(), "ab", open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := first.Read(make([]byte, 10)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Read of a canceled request = %v, want %v", err, context.Canceled)
+	}
+	first.Close()
+	select {
+	case <-canceled:
+		t.Fatal("flight canceled while a reader is left")
+	case <-time.After(10 * time.Millisecond):
+	}
+	second.Close()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flight not canceled once its last reader left")
+	}
+}
+
+// blockingReader blocks until ctx is done, then closes done.
+type blockingReader struct {
+	ctx  context.Context
+	done chan struct{}
+}
+
+func (r blockingReader) Read([]byte) (int, error) {
+	<-r.ctx.Done()
+	close(r.done)
+	return 0, r.ctx.Err()
+}
+
+// gatedStore is a MemStore counting the objects opened by Get, which waits
+// for release once armed.
+type gatedStore struct {
+	*store.MemStore
+	gets    atomic.Int32
+	armed   atomic.Bool
+	release chan struct{}
+}
+
+func (s *gatedStore) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	s.gets.Add(1)
+	if s.armed.Load() {
+		<-s.release
+	}
+	return s.MemStore.Get(ctx, id)
+}
+
+// TestSharedDownloads checks that simultaneous whole downloads of an object
+// decrypt it once, while ranges are decrypted per request.
+func TestSharedDownloads(t *testing.T) {
+	const n = 20
+	st := &gatedStore{release: make(chan struct{})}
+	ts := newWrappedTestServer(t, func(m *store.MemStore) Store {
+		st.MemStore = m
+		return st
+	})
+	content := strings.Repeat("downloaded at once ", 1000)
+	obj := ts.upload(aliceToken, content)
+
+	st.armed.Store(true)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Go(func() {
+			w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil)
+			if w.Code != http.StatusOK || w.Body.String() != content {
+				t.Errorf("download: status %d, %d bytes", w.Code, w.Body.Len())
+			}
+		})
+	}
+	waitReaders(t, ts.flights, obj.ID, n)
+	close(st.release)
+	wg.Wait()
+	if got := st.gets.Load(); got != 1 {
+		t.Errorf("object opened %d times by %d downloads, want 1", got, n)
+	}
+
+	st.gets.Store(0)
+	for range 2 {
+		w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil, "Range", "bytes=0-9")
+		if w.Code != http.StatusPartialContent || w.Body.String() != content[:10] {
+			t.Errorf("range download: %d %q", w.Code, w.Body)
+		}
+	}
+	if got := st.gets.Load(); got != 2 {
+		t.Errorf("object opened %d times by 2 range downloads, want 2", got)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// collector removes the entries idle, or deleted, since before a cutoff and
+// reports how many it removed.
+type collector interface {
+	Collect(cutoff time.Time) (int, error)
+}
+
+// collectorFunc adapts a function to a collector.
+type collectorFunc func(cutoff time.Time) (int, error)
+
+func (f collectorFunc) Collect(cutoff time.Time) (int, error) {
+	return f(cutoff)
+}
+
+// collectEvery runs c with a cutoff of ttl ago every time tick fires, until
+// ctx is done. The tick time is taken as the current time, so a test can
+// drive it with a channel of its own. what names the entries in the logs.
+func collectEvery(ctx context.Context, c collector, tick <-chan time.Time, ttl time.Duration, what string, logger log.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick:
+			n, err := c.Collect(now.Add(-ttl))
+			if err != nil {
+				logger.Error("cannot collect "+what, "error", err)
+			}
+			if n > 0 {
+				logger.Info("collected "+what, "count", n)
+			}
+		}
+	}
+}
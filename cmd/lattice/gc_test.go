@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/upload"
+)
+
+// TestCollectUploads drives collectEvery with a fake clock: the times sent
+// on tick stand for the current time.
+func TestCollectUploads(t *testing.T) {
+	dir := t.TempDir()
+	uploads, err := upload.NewStore(dir, [32]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	newUpload := func() upload.Info {
+		info, err := uploads.Create("alice", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := uploads.Append(ctx, info.ID, 0, strings.NewReader("part")); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	stale, fresh := newUpload(), newUpload()
+	// the last append to stale happened three hours ago.
+	segs, _ := filepath.Glob(filepath.Join(dir, stale.ID, "*.seg"))
+	old := time.Now().Add(-3 * time.Hour)
+	for _, seg := range segs {
+		if err := os.Chtimes(seg, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	tick := make(chan time.Time)
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		collectEvery(ctx, uploads, tick, time.Hour, "partial uploads", log.New(&buf, slog.LevelInfo))
+		close(done)
+	}()
+
+	tick <- time.Now().Add(30 * time.Minute)
+	// a second tick is only received once the first collection is over.
+	tick <- time.Now().Add(30 * time.Minute)
+	if _, err := uploads.Stat(stale.ID); !errors.Is(err, upload.ErrNotFound) {
+		t.Errorf("stale upload: Stat = %v, want ErrNotFound", err)
+	}
+	if _, err := uploads.Stat(fresh.ID); err != nil {
+		t.Errorf("fresh upload: Stat = %v, want it kept", err)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("collectEvery didn't stop with its context")
+	}
+	entries := logEntries(t, &buf)
+	if len(entries) != 1 || entries[0]["msg"] != "collected partial uploads" || entries[0]["count"] != 1.0 {
+		t.Errorf("log entries = %v, want one collection of 1", entries)
+	}
+}
+
+func TestCollectEveryError(t *testing.T) {
+	var buf bytes.Buffer
+	var cutoffs []time.Time
+	c := collectorFunc(func(cutoff time.Time) (int, error) {
+		cutoffs = append(cutoffs, cutoff)
+		return 0, errors.New("disk gone")
+	})
+	tick := make(chan time.Time)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		collectEvery(ctx, c, tick, time.Hour, "things", log.New(&buf, slog.LevelInfo))
+		close(done)
+	}()
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tick <- now
+	cancel()
+	<-done
+	if len(cutoffs) != 1 || !cutoffs[0].Equal(now.Add(-time.Hour)) {
+		t.Errorf("cutoffs = %v, want the tick time minus the ttl", cutoffs)
+	}
+	if entries := logEntries(t, &buf); len(entries) != 1 || entries[0]["msg"] != "cannot collect things" {
+		t.Errorf("log entries = %v", entries)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// readinessCheckTimeout bounds every readiness check.
+const readinessCheckTimeout = 2 * time.Second
+
+// ErrDegraded is wrapped by the errors of checks whose failure leaves the
+// server able to serve part of its API, see Degraded.
+var ErrDegraded = errors.New("degraded")
+
+// Checker reports whether a subsystem is ready to serve.
+type Checker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckerFunc adapts a function to a Checker.
+type CheckerFunc func(ctx context.Context) error
+
+func (f CheckerFunc) Check(ctx context.Context) error {
+	return f(ctx)
+}
+
+// Degraded wraps c so that its failures are reported as ErrDegraded: readyz
+// then replies 200 with a degraded status, keeping the server in rotation
+// for what it can still serve.
+func Degraded(c Checker) Checker {
+	return CheckerFunc(func(ctx context.Context) error {
+		if err := c.Check(ctx); err != nil {
+			return fmt.Errorf("%w: %w", ErrDegraded, err)
+		}
+		return nil
+	})
+}
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// handleHealthz reports that the process is up.
+func handleHealthz() HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+	}
+}
+
+// handleReadyz runs every checker concurrently and reports 503 along with the
+// failed checks when any of them fails. When only Degraded checks fail, it
+// reports 200 with a degraded status instead.
+func handleReadyz(checks map[string]Checker, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			mu     sync.Mutex
+			wg     sync.WaitGroup
+			failed = make(map[string]string)
+			down   bool
+		)
+		for name, c := range checks {
+			wg.Go(func() {
+				ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+				defer cancel()
+				if err := c.Check(ctx); err != nil {
+					mu.Lock()
+					failed[name] = err.Error()
+					down = down || !errors.Is(err, ErrDegraded)
+					mu.Unlock()
+				}
+			})
+		}
+		wg.Wait()
+
+		switch {
+		case down:
+			logger.WithContext(r.Context()).Warn("not ready", "failed", failed)
+			writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Failed: failed})
+			return
+		case len(failed) > 0:
+			logger.WithContext(r.Context()).Warn("degraded", "failed", failed)
+			writeHealth(w, http.StatusOK, healthResponse{Status: "degraded", Failed: failed})
+			return
+		}
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+	}
+}
+
+func writeHealth(w http.ResponseWriter, status int, resp healthResponse) {
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, status, resp)
+}
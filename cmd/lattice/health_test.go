@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// refusingStore is a MemStore whose writes are refused, like those of a
+// read-only volume, while refuse is set.
+type refusingStore struct {
+	*store.MemStore
+	refuse atomic.Bool
+}
+
+func (s *refusingStore) Put(ctx context.Context, id string, r io.Reader) error {
+	if s.refuse.Load() {
+		return fmt.Errorf("%w: %w", store.ErrStorageUnavailable, syscall.EROFS)
+	}
+	return s.MemStore.Put(ctx, id, r)
+}
+
+func (s *refusingStore) Writable(context.Context) error {
+	if s.refuse.Load() {
+		return fmt.Errorf("%w: %w", store.ErrStorageUnavailable, syscall.EROFS)
+	}
+	return nil
+}
+
+func TestStorageUnavailable(t *testing.T) {
+	var st *refusingStore
+	ts := newWrappedTestServer(t, func(m *store.MemStore) Store {
+		st = &refusingStore{MemStore: m}
+		return st
+	})
+	obj := ts.upload(aliceToken, "stored before")
+	st.refuse.Store(true)
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		w := ts.do(http.MethodPost, "/objects", aliceToken, strings.NewReader("refused"))
+		assertEnvelope(t, w, http.StatusServiceUnavailable, "storage_unavailable")
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("refused upload: no Retry-After")
+		}
+	})
+	wg.Go(func() {
+		w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil)
+		if w.Code != http.StatusOK || w.Body.String() != "stored before" {
+			t.Errorf("download while refusing writes: %d %q", w.Code, w.Body)
+		}
+	})
+	wg.Wait()
+
+	w := ts.do(http.MethodGet, "/readyz", "", nil)
+	var resp healthResponse
+	decodeBody(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Status != "degraded" || resp.Failed["storage_writes"] == "" {
+		t.Errorf("readyz while refusing writes: %d %+v", w.Code, resp)
+	}
+
+	st.refuse.Store(false)
+	ts.upload(aliceToken, "stored after")
+	w = ts.do(http.MethodGet, "/readyz", "", nil)
+	resp = healthResponse{}
+	decodeBody(t, w, &resp)
+	if w.Code != http.StatusOK || resp.Status != "ok" {
+		t.Errorf("readyz once writes are accepted: %d %+v", w.Code, resp)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdempotencyKey bounds the length of an Idempotency-Key header.
+const maxIdempotencyKey = 255
+
+// maxReplayBody bounds the response body kept for replays. Responses with a
+// larger body are not cached.
+const maxReplayBody = 64 << 10
+
+// IdempotencyCache remembers the responses of requests carrying an
+// Idempotency-Key for its TTL, so a retried request gets the response of the
+// first one. Expired responses are evicted by Sweep.
+type IdempotencyCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotentEntry
+}
+
+// idempotentEntry is the outcome of the first request with a key. done is
+// closed once the request finished; ok reports whether it left a response
+// to replay, otherwise the entry is already removed from the cache.
+type idempotentEntry struct {
+	done    chan struct{}
+	ok      bool
+	sum     [sha256.Size]byte
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// NewIdempotencyCache returns an empty IdempotencyCache keeping responses for
+// ttl.
+func NewIdempotencyCache(ttl time.Duration) *IdempotencyCache {
+	return &IdempotencyCache{ttl: ttl, entries: make(map[string]*idempotentEntry)}
+}
+
+// Sweep evicts expired responses every interval until ctx is done.
+func (c *IdempotencyCache) Sweep(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			c.evict(now)
+		}
+	}
+}
+
+func (c *IdempotencyCache) evict(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		select {
+		case <-e.done:
+			if now.After(e.expires) {
+				delete(c.entries, key)
+			}
+		default:
+			// still in progress.
+		}
+	}
+}
+
+// acquire returns the entry of key. leader reports whether the caller
+// created it, and so must run the request and then call finish.
+func (c *IdempotencyCache) acquire(key string, now time.Time) (e *idempotentEntry, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		select {
+		case <-e.done:
+			if now.Before(e.expires) {
+				return e, false
+			}
+		default:
+			return e, false
+		}
+	}
+	e = &idempotentEntry{done: make(chan struct{})}
+	c.entries[key] = e
+	return e, true
+}
+
+// finish publishes the outcome of the leader of e. When ok is false the
+// entry is dropped, so the next request with the key runs again.
+func (c *IdempotencyCache) finish(key string, e *idempotentEntry, ok bool, now time.Time) {
+	c.mu.Lock()
+	e.ok = ok
+	e.expires = now.Add(c.ttl)
+	if !ok {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(e.done)
+}
+
+// Idempotent replays the response of the first request carrying the same
+// Idempotency-Key from the same identity, as long as it was successful and
+// is not expired. Concurrent requests with a key wait for the first one to
+// finish. Reusing a key with a different body is rejected with 409. Bodies
+// are hashed up to maxBytes, larger ones are rejected with 413.
+func Idempotent(c *IdempotencyCache, maxBytes int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKey {
+				WriteError(w, http.StatusBadRequest, "bad_request", "Idempotency-Key is too long")
+				return
+			}
+			identity, _ := IdentityFromContext(r.Context())
+			key = identity.Subject + "\x00" + key
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+			for {
+				e, leader := c.acquire(key, time.Now())
+				if leader {
+					runIdempotent(c, key, e, next, w, r)
+					return
+				}
+				select {
+				case <-e.done:
+				case <-r.Context().Done():
+					WriteError(w, http.StatusServiceUnavailable, "timeout", "request timed out")
+					return
+				}
+				if e.ok {
+					replayIdempotent(e, w, r)
+					return
+				}
+				// the first request failed, the next one in line runs it.
+			}
+		})
+	}
+}
+
+// runIdempotent serves r and records its response in e, hashing the body as
+// next reads it.
+func runIdempotent(c *IdempotencyCache, key string, e *idempotentEntry, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	ok := false
+	defer func() { c.finish(key, e, ok, time.Now()) }()
+
+	h := sha256.New()
+	r.Body = hashedBody{ReadCloser: r.Body, r: io.TeeReader(r.Body, h)}
+	cw := &captureWriter{ResponseWriter: w}
+	next.ServeHTTP(cw, r)
+
+	if cw.status < 200 || cw.status > 299 || cw.overflow {
+		return
+	}
+	// count the bytes the handler didn't read, so replays hash the same.
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		return
+	}
+	h.Sum(e.sum[:0])
+	e.status, e.header, e.body = cw.status, cw.header, cw.body.Bytes()
+	ok = true
+}
+
+// replayIdempotent replies with the response recorded in e, after checking
+// that the body of r matches the one of the first request.
+func replayIdempotent(e *idempotentEntry, w http.ResponseWriter, r *http.Request) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r.Body); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			WriteError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "upload exceeds the maximum size")
+			return
+		}
+		WriteError(w, http.StatusBadRequest, "bad_request", "cannot read request body")
+		return
+	}
+	if !bytes.Equal(h.Sum(nil), e.sum[:]) {
+		WriteError(w, http.StatusConflict, "idempotency_key_reused", "Idempotency-Key was already used with a different body")
+		return
+	}
+	// headers set by outer middleware, such as the request ID, are kept.
+	for k, v := range e.header {
+		if _, ok := w.Header()[k]; !ok {
+			w.Header()[k] = v
+		}
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(e.status)
+	if _, err := w.Write(e.body); err != nil {
+		replyLogger(w).Warn("cannot reply", "error", err)
+	}
+}
+
+// hashedBody reads the request body through a hash.
+type hashedBody struct {
+	io.ReadCloser
+	r io.Reader
+}
+
+func (b hashedBody) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+// captureWriter keeps a copy of the response written through it.
+type captureWriter struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+		cw.header = cw.Header().Clone()
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.body.Len()+len(p) > maxReplayBody {
+		cw.overflow = true
+	} else {
+		cw.body.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *captureWriter) headerWritten() bool { return cw.status != 0 }
+
+func (cw *captureWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
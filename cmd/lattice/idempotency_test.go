@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingUpload is an upload handler that counts how often it runs and
+// replies with the number of its run.
+type countingUpload struct {
+	runs   atomic.Int32
+	status int
+	gate   chan struct{}
+}
+
+func (h *countingUpload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := h.runs.Add(1)
+	if h.gate != nil {
+		<-h.gate
+	}
+	io.Copy(io.Discard, r.Body)
+	WriteJSON(w, h.status, map[string]int32{"run": n})
+}
+
+func idempotentRequest(h http.Handler, subject, key, body string) *httptest.ResponseRecorder {
+	r := asSubject(httptest.NewRequest(http.MethodPost, "/objects", strings.NewReader(body)), subject)
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	up := &countingUpload{status: http.StatusCreated}
+	h := Idempotent(NewIdempotencyCache(time.Minute), 1<<20)(up)
+
+	first := idempotentRequest(h, "alice", "k1", "content")
+	replay := idempotentRequest(h, "alice", "k1", "content")
+	if up.runs.Load() != 1 {
+		t.Fatalf("handler ran %d times, want once", up.runs.Load())
+	}
+	if replay.Code != first.Code || replay.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %q, want %d %q", replay.Code, replay.Body, first.Code, first.Body)
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("Idempotent-Replayed not set on the replay only")
+	}
+
+	// keys are scoped per identity, and requests without one always run.
+	idempotentRequest(h, "bob", "k1", "content")
+	idempotentRequest(h, "alice", "", "content")
+	idempotentRequest(h, "alice", "", "content")
+	if up.runs.Load() != 4 {
+		t.Errorf("handler ran %d times, want 4", up.runs.Load())
+	}
+}
+
+func TestIdempotentConflict(t *testing.T) {
+	up := &countingUpload{status: http.StatusCreated}
+	h := Idempotent(NewIdempotencyCache(time.Minute), 1<<20)(up)
+	idempotentRequest(h, "alice", "k1", "content")
+	w := idempotentRequest(h, "alice", "k1", "other content")
+	if w.Code != http.StatusConflict || errorCode(t, w) != "idempotency_key_reused" {
+		t.Fatalf("reused key: %d %s, want 409", w.Code, w.Body)
+	}
+	if up.runs.Load() != 1 {
+		t.Errorf("handler ran %d times, want once", up.runs.Load())
+	}
+	if w := idempotentRequest(h, "alice", strings.Repeat("k", maxIdempotencyKey+1), "content"); w.Code != http.StatusBadRequest {
+		t.Errorf("long key: status %d, want 400", w.Code)
+	}
+}
+
+// TestIdempotentReplayTooLarge replays a key with a body over the limit,
+// which is rejected before it is read whole.
+func TestIdempotentReplayTooLarge(t *testing.T) {
+	up := &countingUpload{status: http.StatusCreated}
+	h := Idempotent(NewIdempotencyCache(time.Minute), 16)(up)
+	idempotentRequest(h, "alice", "k1", "content")
+	w := idempotentRequest(h, "alice", "k1", strings.Repeat("x", 17))
+	if w.Code != http.StatusRequestEntityTooLarge || errorCode(t, w) != "payload_too_large" {
+		t.Fatalf("oversized replay: %d %s, want 413", w.Code, w.Body)
+	}
+	if up.runs.Load() != 1 {
+		t.Errorf("handler ran %d times, want once", up.runs.Load())
+	}
+}
+
+func TestIdempotentFailureNotCached(t *testing.T) {
+	up := &countingUpload{status: http.StatusInternalServerError}
+	h := Idempotent(NewIdempotencyCache(time.Minute), 1<<20)(up)
+	idempotentRequest(h, "alice", "k1", "content")
+	up.status = http.StatusCreated
+	if w := idempotentRequest(h, "alice", "k1", "content"); w.Code != http.StatusCreated || up.runs.Load() != 2 {
+		t.Fatalf("retry after a failure: status %d after %d runs, want a new run", w.Code, up.runs.Load())
+	}
+}
+
+func TestIdempotentConcurrent(t *testing.T) {
+	up := &countingUpload{status: http.StatusCreated, gate: make(chan struct{})}
+	h := Idempotent(NewIdempotencyCache(time.Minute), 1<<20)(up)
+
+	const n = 5
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	for i := range n {
+		wg.Go(func() { codes[i] = idempotentRequest(h, "alice", "k1", "content").Code })
+	}
+	// let the requests pile up behind the first one.
+	for up.runs.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(up.gate)
+	wg.Wait()
+	if up.runs.Load() != 1 {
+		t.Fatalf("handler ran %d times, want once", up.runs.Load())
+	}
+	for i, code := range codes {
+		if code != http.StatusCreated {
+			t.Errorf("request %d: status %d, want 201", i, code)
+		}
+	}
+}
+
+func TestIdempotencyCacheExpiry(t *testing.T) {
+	c := NewIdempotencyCache(time.Minute)
+	now := time.Now()
+	e, leader := c.acquire("k", now)
+	if !leader {
+		t.Fatal("first acquire is not the leader")
+	}
+	c.finish("k", e, true, now)
+	if _, leader := c.acquire("k", now.Add(30*time.Second)); leader {
+		t.Error("acquire before the TTL ran the request again")
+	}
+	if _, leader := c.acquire("k", now.Add(2*time.Minute)); !leader {
+		t.Error("acquire after the TTL replayed an expired response")
+	}
+
+	e, _ = c.acquire("old", now)
+	c.finish("old", e, true, now)
+	c.evict(now.Add(2 * time.Minute))
+	if _, ok := c.entries["old"]; ok {
+		t.Error("expired entry not evicted")
+	}
+}
+
+func TestIdempotentUpload(t *testing.T) {
+	ts := newTestServer(t)
+	first := ts.upload(aliceToken, "once", "Idempotency-Key", "retry-me")
+	w := ts.do(http.MethodPost, "/objects", aliceToken, strings.NewReader("once"), "Idempotency-Key", "retry-me")
+	if w.Code != http.StatusCreated || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("replayed upload: %d %v", w.Code, w.Header())
+	}
+	var obj objectResponse
+	decodeBody(t, w, &obj)
+	if obj != first {
+		t.Errorf("replay = %+v, want %+v", obj, first)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "sync"
+
+// KeyedMutex serializes the critical sections of the same key, while those
+// of different keys run concurrently. The lock of a key is forgotten once
+// nobody holds or waits for it, so idle keys cost nothing.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+// NewKeyedMutex returns a KeyedMutex with no key locked.
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Lock waits until key is free, locks it and returns the function unlocking
+// it, which must be called once.
+func (k *KeyedMutex) Lock(key string) (unlock func()) {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = new(keyedLock)
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		k.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
 )
 
 // Adapter Pattern
@@ -14,32 +20,58 @@ func (f HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
-		_, err := w.Write([]byte("PONG!"))
-		if err != nil {
-			log.Printf("cannot reply: %s", err.Error())
-		}
-	})
+	// the logger starts at the default level, so problems with the config,
+	// including LATTICE_LOG_LEVEL, are logged too.
+	var level slog.LevelVar
+	logger := log.New(os.Stderr, &level)
 
-	f := func(w http.ResponseWriter, r *http.Request) {
-		_, err := w.Write([]byte("PONG!"))
-		if err != nil {
-			log.Printf("cannot reply: %s", err.Error())
-		}
+	cfg, err := LoadConfig()
+	if err != nil {
+		logger.Error("invalid config", "error", err)
+		os.Exit(1)
+	}
+	level.Set(cfg.LogLevel)
+	for _, key := range cfg.GeneratedKeys {
+		logger.Warn("using an ephemeral key, objects and signed URLs won't survive a restart", "key", key)
 	}
 
-	mux.Handle("/echo", HandlerFunc(f))
+	fsStore, err := store.NewFSStore(cfg.StorageDir)
+	if err != nil {
+		logger.Error("cannot open storage", "dir", cfg.StorageDir, "error", err)
+		os.Exit(1)
+	}
 
-	srv := http.Server{
-		Addr:    "localhost:8080", // host:port
-		Handler: mux,
+	var auditor Auditor = discardAuditor{}
+	closeAudit := func() {}
+	if cfg.AuditLog != "" {
+		fa, err := OpenFileAuditor(cfg.AuditLog, logger)
+		if err != nil {
+			logger.Error("cannot open audit log", "error", err)
+			os.Exit(1)
+		}
+		// os.Exit skips deferred calls, the audit log is closed explicitly so
+		// the queued events are written.
+		auditor, closeAudit = fa, func() {
+			if err := fa.Close(); err != nil {
+				logger.Error("cannot close audit log", "error", err)
+			}
+		}
 	}
+	srv, err := NewServer(cfg, fsStore, logger, &level, auditor, nil)
+	if err != nil {
+		logger.Error("cannot create server", "error", err)
+		closeAudit()
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	log.Printf("server is listening: %s", srv.Addr)
-	err := srv.ListenAndServe()
+	err = srv.Run(ctx)
+	closeAudit()
 	if err != nil {
-		log.Println("error:", err.Error())
+		logger.Error("server failed", "error", err)
 		os.Exit(1)
 	}
+	logger.Info("server stopped")
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// defaultListLimit is the page size of GET /objects when limit is not set.
+const defaultListLimit = 100
+
+// listResponse is a page of the objects of an identity. Next is the cursor
+// of the following page, empty on the last one.
+type listResponse struct {
+	Objects []objectResponse `json:"objects"`
+	Next    string           `json:"next"`
+}
+
+// ownerPrefix returns the prefix of the index entries of subject. Index
+// entries are named by the prefix followed by the object ID, so the objects
+// of an identity are listed with a single prefix scan.
+func ownerPrefix(subject string) string {
+	sum := sha256.Sum256([]byte(subject))
+	return hex.EncodeToString(sum[:])
+}
+
+// indexObject records that subject owns the object stored under id.
+func indexObject(ctx context.Context, index Store, subject, id string) error {
+	return index.Put(ctx, ownerPrefix(subject)+id, strings.NewReader(""))
+}
+
+// objectSize returns the plaintext size of the object stored under id, whose
+// ciphertext is size bytes long.
+func objectSize(ctx context.Context, st Store, id string, size int64) (int64, error) {
+	rc, err := st.Get(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return crypto.PlaintextSize(rc, size)
+}
+
+// handleListObjects replies with a page of the objects owned by the
+// authenticated identity, in ID order. The page size is given by the limit
+// query parameter, capped at maxLimit, and the page starts after the object
+// ID given by cursor.
+func handleListObjects(st, index Store, maxLimit int, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		q := r.URL.Query()
+
+		limit := defaultListLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				WriteError(w, http.StatusBadRequest, "bad_request", "limit must be a positive integer")
+				return
+			}
+			limit = n
+		}
+		limit = min(limit, maxLimit)
+
+		cursor := q.Get("cursor")
+		if strings.Trim(cursor, "0123456789abcdef") != "" {
+			WriteError(w, http.StatusBadRequest, "bad_request", "invalid cursor")
+			return
+		}
+
+		identity, _ := IdentityFromContext(r.Context())
+		prefix := ownerPrefix(identity.Subject)
+		after := ""
+		if cursor != "" {
+			after = prefix + cursor
+		}
+		entries, next, err := index.List(r.Context(), prefix, after, limit)
+		if err != nil {
+			logger.Error("cannot list objects", "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+
+		resp := listResponse{Objects: make([]objectResponse, 0, len(entries)), Next: strings.TrimPrefix(next, prefix)}
+		for _, entry := range entries {
+			id := strings.TrimPrefix(entry, prefix)
+			info, err := st.Stat(r.Context(), id)
+			if errors.Is(err, store.ErrNotFound) {
+				// the object went away after it was indexed.
+				continue
+			}
+			if err != nil {
+				logger.Error("cannot stat object", "id", id, "error", err)
+				WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+				return
+			}
+			size, err := objectSize(r.Context(), st, id, info.Size)
+			if err != nil {
+				logger.Error("cannot read object size", "id", id, "error", err)
+				WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+				return
+			}
+			resp.Objects = append(resp.Objects, objectResponse{ID: id, Size: size})
+		}
+		WriteJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestListObjects(t *testing.T) {
+	ts := newTestServer(t, "LATTICE_LIST_MAX_LIMIT=3")
+	var want []string
+	for i := range 5 {
+		obj := ts.upload(aliceToken, "object "+strconv.Itoa(i))
+		want = append(want, obj.ID)
+	}
+	slices.Sort(want)
+	ts.upload(bobToken, "bob's object")
+
+	list := func(query string) listResponse {
+		t.Helper()
+		w := ts.do(http.MethodGet, "/objects"+query, aliceToken, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list %q: status %d: %s", query, w.Code, w.Body)
+		}
+		var page listResponse
+		decodeBody(t, w, &page)
+		return page
+	}
+	ids := func(page listResponse) []string {
+		var ids []string
+		for _, o := range page.Objects {
+			ids = append(ids, o.ID)
+		}
+		return ids
+	}
+
+	first := list("?limit=2")
+	if !slices.Equal(ids(first), want[:2]) || first.Next != want[1] {
+		t.Fatalf("first page = %v next %q, want %v next %q", ids(first), first.Next, want[:2], want[1])
+	}
+	if first.Objects[0].Size != int64(len("object 0")) {
+		t.Errorf("size = %d, want the plaintext size", first.Objects[0].Size)
+	}
+	middle := list("?limit=2&cursor=" + first.Next)
+	if !slices.Equal(ids(middle), want[2:4]) || middle.Next != want[3] {
+		t.Fatalf("middle page = %v next %q, want %v", ids(middle), middle.Next, want[2:4])
+	}
+	last := list("?limit=2&cursor=" + middle.Next)
+	if !slices.Equal(ids(last), want[4:]) || last.Next != "" {
+		t.Fatalf("last page = %v next %q, want %v and no next", ids(last), last.Next, want[4:])
+	}
+
+	// the limit is capped by LATTICE_LIST_MAX_LIMIT.
+	if capped := list("?limit=50"); len(capped.Objects) != 3 || capped.Next == "" {
+		t.Errorf("capped page has %d objects, next %q", len(capped.Objects), capped.Next)
+	}
+	if all := list(""); len(all.Objects) != 3 {
+		t.Errorf("default page has %d objects, want the cap of 3", len(all.Objects))
+	}
+}
+
+func TestListObjectsEmptyAndInvalid(t *testing.T) {
+	ts := newTestServer(t)
+	w := ts.do(http.MethodGet, "/objects", aliceToken, nil)
+	if w.Code != http.StatusOK || w.Body.String() != `{"objects":[],"next":""}`+"\n" {
+		t.Fatalf("empty listing: %d %s", w.Code, w.Body)
+	}
+	for _, q := range []string{"?limit=0", "?limit=-1", "?limit=x", "?cursor=../x", "?cursor=ABC"} {
+		if w := ts.do(http.MethodGet, "/objects"+q, aliceToken, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", q, w.Code)
+		}
+	}
+}
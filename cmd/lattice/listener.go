@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// LimitListener returns a listener that accepts at most n simultaneous
+// connections from l. Accept blocks once n connections are open, until one
+// of them is closed, so excess clients wait in the kernel backlog instead of
+// holding a goroutine and buffers each.
+func LimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// acquire takes a connection slot, it reports false when the listener was
+// closed while waiting for one.
+func (l *limitListener) acquire() bool {
+	select {
+	case <-l.done:
+		return false
+	case l.sem <- struct{}{}:
+		return true
+	}
+}
+
+func (l *limitListener) release() { <-l.sem }
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	if !l.acquire() {
+		// the listener is closed, let the underlying listener produce the
+		// error the caller expects.
+		c, err := l.Listener.Accept()
+		if err == nil {
+			c.Close()
+			err = net.ErrClosed
+		}
+		return nil, err
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: l.release}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// limitConn gives its slot back to the listener on the first Close.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := LimitListener(inner, 2)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	acceptErr := make(chan error, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+			accepted <- c
+		}
+	}()
+	for range 3 {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	var conns []net.Conn
+	for range 2 {
+		select {
+		case c := <-accepted:
+			conns = append(conns, c)
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection under the limit not accepted")
+		}
+	}
+	select {
+	case <-accepted:
+		t.Fatal("connection over the limit accepted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// closing twice frees a single slot.
+	conns[0].Close()
+	conns[0].Close()
+	select {
+	case c := <-accepted:
+		conns = append(conns, c)
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting connection not accepted once a slot was freed")
+	}
+	if c, err := net.Dial("tcp", inner.Addr().String()); err == nil {
+		defer c.Close()
+	}
+	select {
+	case <-accepted:
+		t.Fatal("a double Close freed two slots")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a closed listener stops waiting for a slot.
+	l.Close()
+	select {
+	case err := <-acceptErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Accept after Close = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept still blocked after Close")
+	}
+	for _, c := range conns[1:] {
+		c.Close()
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// maxTags bounds the number of tags of an object.
+const maxTags = 64
+
+// Metadata describes a stored object. It is encrypted at rest with the same
+// key as the content, filenames and tags are often as sensitive as the
+// content itself.
+type Metadata struct {
+	Filename    string            `json:"filename,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Size        int64             `json:"size"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Tags        map[string]string `json:"tags,omitempty"`
+
+	// Owner is the subject that uploaded the object, whose ContentID key
+	// the ID was computed with. It is kept at rest only, never replied.
+	Owner string `json:"owner,omitempty"`
+}
+
+// metadataFromRequest reads the metadata of an upload from its headers: the
+// filename parameter of Content-Disposition, Content-Type and Lattice-Tags, a
+// comma-separated list of key=value pairs that may be repeated.
+func metadataFromRequest(r *http.Request) (Metadata, error) {
+	var md Metadata
+	if h := r.Header.Get("Content-Type"); h != "" {
+		typ, params, err := mime.ParseMediaType(h)
+		if err != nil {
+			return md, fmt.Errorf("invalid Content-Type: %w", err)
+		}
+		md.ContentType = mime.FormatMediaType(typ, params)
+	}
+	if h := r.Header.Get("Content-Disposition"); h != "" {
+		_, params, err := mime.ParseMediaType(h)
+		if err != nil {
+			return md, fmt.Errorf("invalid Content-Disposition: %w", err)
+		}
+		md.Filename = params["filename"]
+	}
+	for _, h := range r.Header.Values("Lattice-Tags") {
+		if err := md.addTags(h); err != nil {
+			return md, err
+		}
+	}
+	return md, nil
+}
+
+// addTags adds the tags of spec, a comma-separated list of key=value pairs.
+func (md *Metadata) addTags(spec string) error {
+	for pair := range strings.SplitSeq(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return fmt.Errorf("invalid tag %q, want key=value", pair)
+		}
+		if err := md.setTag(k, strings.TrimSpace(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTag sets the tag k to v, enforcing maxTags.
+func (md *Metadata) setTag(k, v string) error {
+	if md.Tags == nil {
+		md.Tags = make(map[string]string)
+	}
+	if _, ok := md.Tags[k]; !ok && len(md.Tags) == maxTags {
+		return fmt.Errorf("too many tags, at most %d are allowed", maxTags)
+	}
+	md.Tags[k] = v
+	return nil
+}
+
+// putMetadata encrypts md and puts it in st under the ID of its object.
+// Metadata is small, so it is encrypted in memory. The ID is bound to the
+// record with metadataAD, so a record copied under another ID doesn't open.
+func putMetadata(ctx context.Context, st Store, key [32]byte, id string, md Metadata) error {
+	plain, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc, err := crypto.NewEncryptWriter(&buf, key, metadataAD(id))
+	if err != nil {
+		return err
+	}
+	if _, err := enc.Write(plain); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return st.Put(ctx, id, &buf)
+}
+
+// getMetadata reads and decrypts the metadata of the object stored under id.
+func getMetadata(ctx context.Context, st Store, key [32]byte, id string) (Metadata, error) {
+	rc, err := st.Get(ctx, id)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer rc.Close()
+	dec, err := crypto.NewDecryptReader(rc, key, metadataAD(id))
+	if err != nil {
+		return Metadata{}, err
+	}
+	plain, err := io.ReadAll(dec)
+	if err != nil {
+		return Metadata{}, err
+	}
+	var md Metadata
+	if err := json.Unmarshal(plain, &md); err != nil {
+		return Metadata{}, err
+	}
+	return md, nil
+}
+
+// metadataAD returns the option binding a metadata record to the ID of its
+// object.
+func metadataAD(id string) crypto.Option {
+	return crypto.WithAssociatedData([]byte("lattice metadata\x00" + id))
+}
+
+// handleMetadata replies with the decrypted metadata of the object named by
+// the id path value, as long as the object is in st. Only the owner of an
+// object, or an admin, may read it.
+func handleMetadata(st, metas Store, key [32]byte, admins []string, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		id := r.PathValue("id")
+
+		if _, err := st.Stat(r.Context(), id); err != nil {
+			if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidID) {
+				WriteError(w, http.StatusNotFound, "not_found", "object not found")
+				return
+			}
+			logger.Error("cannot stat object", "id", id, "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		md, ok := ownedMetadata(w, r, metas, key, id, isAdmin(r.Context(), admins), logger)
+		if !ok {
+			return
+		}
+		md.Owner = ""
+		WriteJSON(w, http.StatusOK, md)
+	}
+}
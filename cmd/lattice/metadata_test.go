@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	ts := newTestServer(t)
+	before := time.Now().UTC().Add(-time.Second)
+	obj := ts.upload(aliceToken, "report body",
+		"Content-Type", "text/plain; charset=utf-8",
+		"Content-Disposition", `attachment; filename="q3 report.txt"`,
+		"Lattice-Tags", "project=apollo, year=2026")
+
+	w := ts.do(http.MethodGet, "/objects/"+obj.ID+"/meta", aliceToken, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("meta: status %d: %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "owner") {
+		t.Errorf("metadata reply names the owner: %s", w.Body)
+	}
+	var md Metadata
+	decodeBody(t, w, &md)
+	if md.Filename != "q3 report.txt" || md.ContentType != "text/plain; charset=utf-8" || md.Size != int64(len("report body")) {
+		t.Errorf("metadata = %+v", md)
+	}
+	if md.Tags["project"] != "apollo" || md.Tags["year"] != "2026" || len(md.Tags) != 2 {
+		t.Errorf("tags = %v", md.Tags)
+	}
+	if md.CreatedAt.Before(before) || md.CreatedAt.After(time.Now().UTC()) {
+		t.Errorf("created_at = %v", md.CreatedAt)
+	}
+
+	// metadata is encrypted at rest, filenames are sensitive.
+	rc, err := ts.metas.Get(context.Background(), obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(rc)
+	rc.Close()
+	if bytes.Contains(raw, []byte("q3 report")) || bytes.Contains(raw, []byte("apollo")) {
+		t.Error("metadata stored in the clear")
+	}
+}
+
+// TestMetadataOwner checks that only the owner of an object, or an admin,
+// reaches it through the routes scoped by its metadata.
+func TestMetadataOwner(t *testing.T) {
+	ts := newTestServer(t)
+	obj := ts.upload(aliceToken, "private")
+	for _, route := range []struct{ method, path string }{
+		{http.MethodGet, "/objects/" + obj.ID + "/meta"},
+		{http.MethodGet, "/objects/" + obj.ID},
+		{http.MethodPost, "/objects/" + obj.ID + "/verify"},
+	} {
+		for token, status := range map[string]int{aliceToken: http.StatusOK, bobToken: http.StatusForbidden, rootToken: http.StatusOK} {
+			if w := ts.do(route.method, route.path, token, nil); w.Code != status {
+				t.Errorf("%s %s with %s: status %d, want %d", route.method, route.path, token, w.Code, status)
+			}
+		}
+	}
+	if w := ts.do(http.MethodGet, "/objects/0123456789abcdef/meta", aliceToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing object: status %d, want 404", w.Code)
+	}
+}
+
+func TestMetadataFromRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header map[string]string
+		ok     bool
+	}{
+		{"none", nil, true},
+		{"bad content type", map[string]string{"Content-Type": "text/"}, false},
+		{"bad disposition", map[string]string{"Content-Disposition": `attachment; filename="`}, false},
+		{"tag without value", map[string]string{"Lattice-Tags": "key"}, false},
+		{"tag without key", map[string]string{"Lattice-Tags": "=value"}, false},
+		{"empty tags", map[string]string{"Lattice-Tags": " , ,"}, true},
+		{"too many tags", map[string]string{"Lattice-Tags": manyTags(maxTags + 1)}, false},
+		{"max tags", map[string]string{"Lattice-Tags": manyTags(maxTags)}, true},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/objects", nil)
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		if _, err := metadataFromRequest(r); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v, want ok %t", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func manyTags(n int) string {
+	tags := make([]string, n)
+	for i := range tags {
+		tags[i] = "k" + strings.Repeat("x", i) + "=v"
+	}
+	return strings.Join(tags, ",")
+}
+
+func TestGetMetadataWrongKey(t *testing.T) {
+	st := store.NewMemStore()
+	ctx := context.Background()
+	if err := putMetadata(ctx, st, [32]byte{1}, "0123456789abcdef", Metadata{Filename: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	md, err := getMetadata(ctx, st, [32]byte{1}, "0123456789abcdef")
+	if err != nil || md.Filename != "a" {
+		t.Fatalf("getMetadata = %+v, %v", md, err)
+	}
+	if _, err := getMetadata(ctx, st, [32]byte{2}, "0123456789abcdef"); err == nil {
+		t.Error("metadata decrypted with the wrong key")
+	}
+}
+
+// TestGetMetadataSwapped copies the record of an object under the ID of
+// another one, which must not open as the metadata of the other object.
+func TestGetMetadataSwapped(t *testing.T) {
+	st := store.NewMemStore()
+	ctx := context.Background()
+	const id, other = "0123456789abcdef", "fedcba9876543210"
+	if err := putMetadata(ctx, st, [32]byte{1}, id, Metadata{Filename: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := st.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if err := st.Put(ctx, other, rc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getMetadata(ctx, st, [32]byte{1}, other); !errors.Is(err, crypto.ErrAuthFailed) {
+		t.Errorf("getMetadata of a swapped record = %v, want %v", err, crypto.ErrAuthFailed)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/store"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricSet holds the Prometheus collectors of the lattice server.
+type MetricSet struct {
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	uploadedBytes     prometheus.Counter
+	downloadedBytes   prometheus.Counter
+	cryptoDuration    *prometheus.HistogramVec
+	storageDuration   *prometheus.HistogramVec
+	storageErrors     *prometheus.CounterVec
+	integrityFailures prometheus.Counter
+}
+
+// NewMetricSet creates the collectors and registers them with reg.
+func NewMetricSet(reg prometheus.Registerer) *MetricSet {
+	m := &MetricSet{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lattice_http_requests_total",
+			Help: "Number of HTTP requests served, by route and status.",
+		}, []string{"route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lattice_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests, by route and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "status"}),
+		uploadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lattice_uploaded_bytes_total",
+			Help: "Plaintext bytes received in uploads.",
+		}),
+		downloadedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lattice_downloaded_bytes_total",
+			Help: "Plaintext bytes sent in downloads.",
+		}),
+		cryptoDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lattice_crypto_duration_seconds",
+			Help:    "Time spent in the encryptor or decryptor of an object, by operation.",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 4, 10),
+		}, []string{"op"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lattice_storage_operation_duration_seconds",
+			Help:    "Latency of storage operations, by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"op"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lattice_storage_errors_total",
+			Help: "Number of failed storage operations, by operation.",
+		}, []string{"op"}),
+		integrityFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lattice_integrity_failures_total",
+			Help: "Downloads whose content didn't hash back to the object ID.",
+		}),
+	}
+	reg.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.uploadedBytes,
+		m.downloadedBytes,
+		m.cryptoDuration,
+		m.storageDuration,
+		m.storageErrors,
+		m.integrityFailures,
+	)
+	return m
+}
+
+// Metrics records the request count and latency of every request. It must
+// wrap the http.ServeMux directly: the route is read from the pattern the
+// mux stores in the request, which it does in place.
+func Metrics(m *MetricSet) Middleware {
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := newResponseRecorder(w)
+			next.ServeHTTP(rw, r)
+
+			route := r.Pattern
+			if route == "" {
+				route = "unmatched"
+			}
+			status := strconv.Itoa(rw.status)
+			m.requests.WithLabelValues(route, status).Inc()
+			m.requestDuration.WithLabelValues(route, status).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// addProgress returns a CopyWithProgress callback adding the bytes copied
+// since its previous call to c.
+func addProgress(c prometheus.Counter) func(int64) {
+	var last int64
+	return func(n int64) {
+		c.Add(float64(n - last))
+		last = n
+	}
+}
+
+// timer accumulates the time spent in the calls it measures.
+type timer struct {
+	total time.Duration
+}
+
+func (t *timer) writer(w io.Writer) io.Writer {
+	return timedWriter{w: w, t: t}
+}
+
+func (t *timer) reader(r io.Reader) io.Reader {
+	return timedReader{r: r, t: t}
+}
+
+type timedWriter struct {
+	w io.Writer
+	t *timer
+}
+
+func (tw timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tw.w.Write(p)
+	tw.t.total += time.Since(start)
+	return n, err
+}
+
+type timedReader struct {
+	r io.Reader
+	t *timer
+}
+
+func (tr timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := tr.r.Read(p)
+	tr.t.total += time.Since(start)
+	return n, err
+}
+
+// instrumentedStore records the latency and errors of a Store.
+type instrumentedStore struct {
+	Store
+	m *MetricSet
+}
+
+func instrumentStore(st Store, m *MetricSet) Store {
+	return instrumentedStore{Store: st, m: m}
+}
+
+func (s instrumentedStore) observe(op string, start time.Time, err error) {
+	s.m.storageDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		s.m.storageErrors.WithLabelValues(op).Inc()
+	}
+}
+
+func (s instrumentedStore) Put(ctx context.Context, id string, r io.Reader) error {
+	start := time.Now()
+	err := s.Store.Put(ctx, id, r)
+	s.observe("put", start, err)
+	return err
+}
+
+func (s instrumentedStore) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := s.Store.Get(ctx, id)
+	s.observe("get", start, err)
+	return rc, err
+}
+
+func (s instrumentedStore) Delete(ctx context.Context, id string) error {
+	start := time.Now()
+	err := s.Store.Delete(ctx, id)
+	s.observe("delete", start, err)
+	return err
+}
+
+func (s instrumentedStore) Stat(ctx context.Context, id string) (store.ObjectInfo, error) {
+	start := time.Now()
+	info, err := s.Store.Stat(ctx, id)
+	s.observe("stat", start, err)
+	return info, err
+}
+
+func (s instrumentedStore) List(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	start := time.Now()
+	ids, next, err := s.Store.List(ctx, prefix, cursor, limit)
+	s.observe("list", start, err)
+	return ids, next, err
+}
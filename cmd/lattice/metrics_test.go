@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/josestg/e2eefs/internal/store"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// histogramCount returns the number of observations of the histogram name
+// with the label op, gathered from ts.reg.
+func (ts *testServer) histogramCount(name, op string) uint64 {
+	ts.t.Helper()
+	families, err := ts.reg.Gather()
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "op" && l.GetValue() == op {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t)
+	const content = "counted"
+	obj := ts.upload(aliceToken, content)
+	if w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("download: status %d", w.Code)
+	}
+
+	m := ts.metrics
+	for _, c := range []struct {
+		route, status string
+	}{
+		{"POST /objects", "201"},
+		{"GET /objects/{id}", "200"},
+	} {
+		if got := testutil.ToFloat64(m.requests.WithLabelValues(c.route, c.status)); got != 1 {
+			t.Errorf("requests of %s with %s = %v, want 1", c.route, c.status, got)
+		}
+	}
+	if got := testutil.ToFloat64(m.uploadedBytes); got != float64(len(content)) {
+		t.Errorf("uploaded bytes = %v, want %d", got, len(content))
+	}
+	if got := testutil.ToFloat64(m.downloadedBytes); got != float64(len(content)) {
+		t.Errorf("downloaded bytes = %v, want %d", got, len(content))
+	}
+	for _, op := range []string{"put", "get"} {
+		if n := ts.histogramCount("lattice_storage_operation_duration_seconds", op); n == 0 {
+			t.Errorf("no storage %s observed", op)
+		}
+	}
+	if n := testutil.CollectAndCount(m.storageErrors); n != 0 {
+		t.Errorf("%d storage error series after successful operations, want 0", n)
+	}
+}
+
+func TestMetricsStorageErrors(t *testing.T) {
+	var st *refusingStore
+	ts := newWrappedTestServer(t, func(m *store.MemStore) Store {
+		st = &refusingStore{MemStore: m}
+		return st
+	})
+	st.refuse.Store(true)
+	if w := ts.do(http.MethodPost, "/objects", aliceToken, strings.NewReader("refused")); w.Code == http.StatusCreated {
+		t.Fatal("upload to a refusing store succeeded")
+	}
+	if got := testutil.ToFloat64(ts.metrics.storageErrors.WithLabelValues("put")); got != 1 {
+		t.Errorf("storage put errors = %v, want 1", got)
+	}
+	// a missing object is no storage error.
+	ts.do(http.MethodGet, "/objects/0123456789abcdef", aliceToken, nil)
+	if got := testutil.ToFloat64(ts.metrics.storageErrors.WithLabelValues("get")); got != 0 {
+		t.Errorf("storage get errors = %v, want 0", got)
+	}
+}
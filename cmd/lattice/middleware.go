@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// Middleware decorates a http.Handler with extra behavior.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h with mw in registration order, so mw[0] is the outermost
+// middleware and sees the request first. When mw is empty, h is returned
+// unchanged.
+func Chain(h http.Handler, mw ...Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Recover turns a panic in the next handler into a 500 response and logs the
+// panic value with its stack trace. http.ErrAbortHandler is re-panicked so
+// the server can abort the connection as usual. A panic carried over from
+// the goroutine of Timeout is logged with the stack of that goroutine.
+func Recover(logger log.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+				stack := debug.Stack()
+				if p, ok := v.(*handlerPanic); ok {
+					v, stack = p.value, p.stack
+				}
+				logger.WithContext(r.Context()).Error("handler panicked",
+					"method", r.Method,
+					"path", r.URL.Path,
+					"panic", v,
+					"stack", string(stack),
+				)
+				WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// LogRequests writes an access log entry for every request, recording the
+// method, path, status code, response size and latency.
+func LogRequests(logger log.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			logger := logger.WithContext(r.Context())
+			rw := newResponseRecorder(w)
+			rw.logger = logger
+			next.ServeHTTP(rw, r)
+			logger.Info("request served",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rw.status,
+				"bytes", rw.bytes,
+				"latency", time.Since(start),
+			)
+		})
+	}
+}
+
+// Timeout bounds the time the next handler has to serve a request. The
+// request context is replaced by one that is canceled after d, and if the
+// handler hasn't finished by then a 503 is sent, unless it already started
+// writing its response. Writes made by the handler after the timeout fail
+// with http.ErrHandlerTimeout.
+func Timeout(d time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			tw := &timeoutWriter{w: w, h: make(http.Header)}
+			done := make(chan struct{})
+			panicked := make(chan any, 1)
+			go func() {
+				defer func() {
+					v := recover()
+					if v == nil {
+						return
+					}
+					if v != http.ErrAbortHandler {
+						// the stack of this goroutine is the one with the
+						// panicking frame, the serving goroutine only has
+						// Timeout waiting.
+						v = &handlerPanic{value: v, stack: debug.Stack()}
+					}
+					panicked <- v
+				}()
+				next.ServeHTTP(tw, r.WithContext(ctx))
+				close(done)
+			}()
+
+			select {
+			case v := <-panicked:
+				// re-panic on the serving goroutine, so Recover can see it.
+				panic(v)
+			case <-done:
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				if !tw.wroteHeader && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					WriteError(w, http.StatusServiceUnavailable, "timeout", "request timed out")
+				}
+			}
+		})
+	}
+}
+
+// handlerPanic carries a panic recovered in the handler goroutine of Timeout,
+// along with the stack of that goroutine, to the serving goroutine.
+type handlerPanic struct {
+	value any
+	stack []byte
+}
+
+// timeoutWriter guards the underlying writer so that the handler goroutine
+// can't use it once Timeout has given up on the request. The handler gets
+// its own header map, copied to the underlying writer on WriteHeader, so
+// that Timeout can write the 503 without racing the handler.
+type timeoutWriter struct {
+	w http.ResponseWriter
+	h http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.h }
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	maps.Copy(tw.w.Header(), tw.h)
+	tw.w.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return tw.w.Write(p)
+}
+
+// Unwrap lets http.ResponseController and replyLogger reach the underlying
+// writer. Flushes still go through Flush, which checks the timeout.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return tw.w
+}
+
+// headerWritten reports whether the response headers were sent.
+func (tw *timeoutWriter) headerWritten() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return tw.wroteHeader
+}
+
+// Flush implements http.Flusher, flushing the underlying writer when it can
+// be flushed, found through http.ResponseController.
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	_ = http.NewResponseController(tw.w).Flush()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// logEntries decodes the JSON lines written by a log.New logger.
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var entries []map[string]any
+	for line := range strings.SplitSeq(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]any
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestRecover(t *testing.T) {
+	var buf bytes.Buffer
+	h := Recover(log.New(&buf, slog.LevelInfo))(HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/boom", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", w.Code)
+	}
+	if code := errorCode(t, w); code != "internal" {
+		t.Errorf("error code = %q, want internal", code)
+	}
+	entries := logEntries(t, &buf)
+	if len(entries) != 1 {
+		t.Fatalf("got %d log entries, want 1", len(entries))
+	}
+	e := entries[0]
+	if e["msg"] != "handler panicked" || e["panic"] != "boom" || e["path"] != "/boom" {
+		t.Errorf("log entry = %v", e)
+	}
+	if stack, _ := e["stack"].(string); !strings.Contains(stack, "TestRecover") {
+		t.Errorf("stack does not name the panicking handler:\n%s", stack)
+	}
+}
+
+func TestRecoverAbortHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := Recover(log.New(&buf, slog.LevelInfo))(HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Fatalf("recovered %v, want http.ErrAbortHandler", v)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("aborted handler was logged: %s", buf.String())
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestTimeout(t *testing.T) {
+	canceled := make(chan error, 1)
+	var lateWrite error
+	wrote := make(chan struct{})
+	h := Timeout(20 * time.Millisecond)(HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		canceled <- r.Context().Err()
+		time.Sleep(10 * time.Millisecond)
+		_, lateWrite = w.Write([]byte("too late"))
+		close(wrote)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", w.Code)
+	}
+	if code := errorCode(t, w); code != "timeout" {
+		t.Errorf("error code = %q, want timeout", code)
+	}
+	if err := <-canceled; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("handler context err = %v, want DeadlineExceeded", err)
+	}
+	<-wrote
+	if !errors.Is(lateWrite, http.ErrHandlerTimeout) {
+		t.Errorf("write after the timeout = %v, want http.ErrHandlerTimeout", lateWrite)
+	}
+	if strings.Contains(w.Body.String(), "too late") {
+		t.Error("write after the timeout reached the client")
+	}
+}
+
+func TestTimeoutFastHandler(t *testing.T) {
+	before := runtime.NumGoroutine()
+	h := Timeout(time.Minute)(HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "1")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("ok"))
+	}))
+	for range 10 {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusTeapot || w.Body.String() != "ok" || w.Header().Get("X-Test") != "1" {
+			t.Fatalf("got %d %q %v", w.Code, w.Body, w.Header())
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestTimeoutUnwrap reaches the underlying writer of Timeout through
+// http.ResponseController.
+func TestTimeoutUnwrap(t *testing.T) {
+	var deadlineErr error
+	h := Timeout(time.Minute)(HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadlineErr = http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Minute))
+		w.Write([]byte("ok"))
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if deadlineErr != nil {
+		t.Errorf("SetWriteDeadline through Timeout = %v, want nil", deadlineErr)
+	}
+}
+
+func panickingHandler(http.ResponseWriter, *http.Request) { panic("boom") }
+
+func TestTimeoutPanicStack(t *testing.T) {
+	var buf bytes.Buffer
+	h := Recover(log.New(&buf, slog.LevelInfo))(Timeout(time.Minute)(HandlerFunc(panickingHandler)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", w.Code)
+	}
+	entries := logEntries(t, &buf)
+	if len(entries) != 1 || entries[0]["panic"] != "boom" {
+		t.Fatalf("log entries = %v", entries)
+	}
+	if stack, _ := entries[0]["stack"].(string); !strings.Contains(stack, "panickingHandler") {
+		t.Errorf("stack does not name the panicking handler:\n%s", stack)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// maxFormField bounds the size of a non-file part of a multipart upload.
+const maxFormField = 64 << 10
+
+// errBadForm marks multipart uploads that are well-formed but not usable,
+// such as one without a file part.
+var errBadForm = errors.New("bad form")
+
+// multipartBoundary returns the boundary of a multipart/form-data request.
+func multipartBoundary(r *http.Request) (string, bool) {
+	typ, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || typ != "multipart/form-data" || params["boundary"] == "" {
+		return "", false
+	}
+	return params["boundary"], true
+}
+
+// spoolMultipartObject spools the single file part of a multipart/form-data
+// body with spoolObject, streaming it part by part instead of buffering the
+// form like ParseMultipartForm. The filename and content type of the file
+// part go to md, along with the other fields: "tags" holds key=value pairs
+// like Lattice-Tags, and any other field becomes a tag named after it.
+// Errors about the shape of the form are wrapped with errBadForm. The file
+// is only returned once the whole form is read, so a form rejected by a
+// later part leaves nothing to store.
+func spoolMultipartObject(ctx context.Context, key [32]byte, idKey []byte, body io.Reader, boundary string, md *Metadata, m *MetricSet) (sp *spooledObject, err error) {
+	md.Filename, md.ContentType = "", ""
+	defer func() {
+		if err != nil && sp != nil {
+			sp.Close()
+			sp = nil
+		}
+	}()
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sp, fmt.Errorf("%w: %w", errReadBody, err)
+		}
+
+		if part.FileName() != "" {
+			if sp != nil {
+				return sp, fmt.Errorf("%w: more than one file part", errBadForm)
+			}
+			md.Filename = part.FileName()
+			if ct := part.Header.Get("Content-Type"); ct != "" {
+				typ, params, err := mime.ParseMediaType(ct)
+				if err != nil {
+					return sp, fmt.Errorf("%w: invalid Content-Type of %q: %w", errBadForm, md.Filename, err)
+				}
+				md.ContentType = mime.FormatMediaType(typ, params)
+			}
+			if sp, err = spoolObject(ctx, key, idKey, part, m); err != nil {
+				return sp, err
+			}
+			continue
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(bodyReader{part}, maxFormField+1))
+		if err != nil {
+			return sp, err
+		}
+		if len(value) > maxFormField {
+			return sp, fmt.Errorf("%w: field %q is too large", errBadForm, name)
+		}
+		if name == "tags" {
+			err = md.addTags(string(value))
+		} else {
+			err = md.setTag(name, strings.TrimSpace(string(value)))
+		}
+		if err != nil {
+			return sp, fmt.Errorf("%w: %w", errBadForm, err)
+		}
+	}
+	if sp == nil {
+		return nil, fmt.Errorf("%w: no file part", errBadForm)
+	}
+	return sp, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"testing"
+)
+
+// multipartBody builds a multipart/form-data body of fields and files, each
+// file a filename and its content, and returns it with its Content-Type.
+func multipartBody(t *testing.T, fields map[string]string, files ...[2]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range files {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", `form-data; name="file"; filename="`+f[0]+`"`)
+		h.Set("Content-Type", "text/csv")
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pw.Write([]byte(f[1]))
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf, mw.FormDataContentType()
+}
+
+// storedObjects returns how many objects are in the store of ts.
+func (ts *testServer) storedObjects() int {
+	ts.t.Helper()
+	ids, _, err := ts.store.List(context.Background(), "", "", 100)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return len(ids)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	ts := newTestServer(t)
+	body, ct := multipartBody(t, map[string]string{"tags": "team=ops, year=2026", "project": " apollo "}, [2]string{"data.csv", "a,b\n1,2\n"})
+	obj := ts.upload(aliceToken, body.String(), "Content-Type", ct)
+	if obj.Size != int64(len("a,b\n1,2\n")) {
+		t.Errorf("size = %d, want the size of the file part", obj.Size)
+	}
+
+	if w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil); w.Body.String() != "a,b\n1,2\n" {
+		t.Fatalf("stored content = %q, want the file part", w.Body)
+	}
+	var md Metadata
+	decodeBody(t, ts.do(http.MethodGet, "/objects/"+obj.ID+"/meta", aliceToken, nil), &md)
+	if md.Filename != "data.csv" || md.ContentType != "text/csv" {
+		t.Errorf("metadata = %+v", md)
+	}
+	if md.Tags["team"] != "ops" || md.Tags["year"] != "2026" || md.Tags["project"] != "apollo" || len(md.Tags) != 3 {
+		t.Errorf("tags = %v", md.Tags)
+	}
+}
+
+func TestMultipartUploadRejected(t *testing.T) {
+	twoFiles, twoFilesCT := multipartBody(t, nil, [2]string{"a.csv", "a"}, [2]string{"b.csv", "b"})
+	noFile, noFileCT := multipartBody(t, map[string]string{"tags": "a=b"})
+	badTags, badTagsCT := multipartBody(t, map[string]string{"tags": "novalue"}, [2]string{"a.csv", "a"})
+	digested, digestedCT := multipartBody(t, nil, [2]string{"a.csv", "a"})
+	sum := md5.Sum([]byte("something else"))
+
+	for name, tc := range map[string]struct {
+		body   *bytes.Buffer
+		header []string
+	}{
+		"two file parts":  {twoFiles, []string{"Content-Type", twoFilesCT}},
+		"no file part":    {noFile, []string{"Content-Type", noFileCT}},
+		"bad tags":        {badTags, []string{"Content-Type", badTagsCT}},
+		"digest mismatch": {digested, []string{"Content-Type", digestedCT, "Content-MD5", base64.StdEncoding.EncodeToString(sum[:])}},
+		"truncated form":  {bytes.NewBufferString(digested.String()[:digested.Len()-10]), []string{"Content-Type", digestedCT}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestServer(t)
+			w := ts.do(http.MethodPost, "/objects", aliceToken, tc.body, tc.header...)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status %d: %s, want 400", w.Code, w.Body)
+			}
+			if n := ts.storedObjects(); n != 0 {
+				t.Errorf("%d objects stored, want none", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// Store is the storage backend holding the encrypted objects.
+type Store interface {
+	Put(ctx context.Context, id string, r io.Reader) error
+	Get(ctx context.Context, id string) (io.ReadCloser, error)
+	Delete(ctx context.Context, id string) error
+	Stat(ctx context.Context, id string) (store.ObjectInfo, error)
+	List(ctx context.Context, prefix, cursor string, limit int) (ids []string, next string, err error)
+}
+
+// objectResponse describes a stored object.
+type objectResponse struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// handleUpload encrypts the request body and puts the ciphertext in st,
+// named after the ContentID of the plaintext under a key scoped to the
+// authenticated identity, and its metadata in metas under the same ID. The
+// object is added to the identity's entries in index. A multipart/form-data
+// body is read with spoolMultipartObject. Uploading the same
+// content again replaces its metadata. Bodies larger than maxBytes are
+// rejected with 413. With a SessionHeader, the body is decrypted with the
+// session key first, the other headers describe the plaintext. A body sent
+// with a Content-MD5 or Digest header is checked against it as it streams,
+// see digestReader, and rejected with 400 when it doesn't match. Once the ID
+// of the content is known, If-Match and If-None-Match are evaluated against
+// the object already stored under it, if any, so If-None-Match: * only
+// stores new content. Nothing is stored before the whole body, multipart
+// form included, is checked.
+func handleUpload(st, metas, index Store, key [32]byte, idSecret []byte, maxBytes int64, sessions *SessionStore, m *MetricSet, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		md, err := metadataFromRequest(r)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		sess, ok := requestSession(w, r, sessions)
+		if !ok {
+			return
+		}
+		var body io.Reader = http.MaxBytesReader(w, r.Body, maxBytes)
+		digest, err := newDigestReader(body, r.Header)
+		if err != nil {
+			if errors.Is(err, errUnsupportedDigest) {
+				w.Header().Set("Want-Digest", supportedDigests)
+			}
+			WriteError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		if digest != nil {
+			body = digest
+		}
+		if sess != nil {
+			err := sess.withKey(func(k [32]byte) (err error) {
+				body, err = crypto.NewDecryptReader(body, k)
+				return err
+			})
+			if err != nil {
+				var maxErr *http.MaxBytesError
+				if errors.As(err, &maxErr) {
+					WriteError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "upload exceeds the maximum size")
+					return
+				}
+				WriteError(w, http.StatusBadRequest, "bad_request", "body is not encrypted with the session key")
+				return
+			}
+		}
+
+		identity, _ := IdentityFromContext(r.Context())
+		idKey := crypto.ContentIDKey(idSecret, identity.Subject)
+		// the body is spooled and checked whole before anything is stored.
+		var sp *spooledObject
+		if boundary, ok := multipartBoundary(r); ok {
+			sp, err = spoolMultipartObject(r.Context(), key, idKey, body, boundary, &md, m)
+		} else {
+			sp, err = spoolObject(r.Context(), key, idKey, body, m)
+		}
+		if sp != nil {
+			defer sp.Close()
+		}
+		if err == nil && digest != nil {
+			err = digest.verify()
+		}
+		if err == nil && !checkStoredPreconditions(w, r, st, sp.id, logger) {
+			return
+		}
+		var obj objectResponse
+		if err == nil {
+			obj, err = sp.put(r.Context(), st)
+		}
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxErr):
+				WriteError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "upload exceeds the maximum size")
+			case errors.Is(err, errBadForm):
+				WriteError(w, http.StatusBadRequest, "bad_request", err.Error())
+			case errors.Is(err, errDigestMismatch):
+				logger.Warn("upload digest mismatch", "error", err)
+				WriteError(w, http.StatusBadRequest, "digest_mismatch", errDigestMismatch.Error())
+			case errors.Is(err, context.Canceled):
+				// the client went away, there is nobody to reply to.
+				logger.Warn("upload canceled", "error", err)
+			case errors.Is(err, errReadBody):
+				logger.Warn("cannot read upload", "error", err)
+				WriteError(w, http.StatusBadRequest, "bad_request", "cannot read request body")
+			default:
+				logger.Error("cannot store object", "error", err)
+				writeStoreError(w, err)
+			}
+			return
+		}
+
+		md.Size, md.CreatedAt, md.Owner = obj.Size, time.Now().UTC(), identity.Subject
+		if err := putMetadata(r.Context(), metas, key, obj.ID, md); err != nil {
+			logger.Error("cannot store metadata", "id", obj.ID, "error", err)
+			writeStoreError(w, err)
+			return
+		}
+		if err := indexObject(r.Context(), index, identity.Subject, obj.ID); err != nil {
+			logger.Error("cannot index object", "id", obj.ID, "error", err)
+			writeStoreError(w, err)
+			return
+		}
+
+		recordAudit(r.Context(), AuditEvent{Action: AuditWrite, ObjectID: obj.ID})
+		WriteJSON(w, http.StatusCreated, obj)
+	}
+}
+
+// errReadBody marks errors coming from the plaintext reader of putObject.
+var errReadBody = errors.New("cannot read body")
+
+// putObject encrypts the plaintext read from r and puts the ciphertext in
+// st, named after the ContentID of the plaintext under idKey, see
+// spoolObject. Errors returned by r are wrapped with errReadBody.
+func putObject(ctx context.Context, st Store, key [32]byte, idKey []byte, r io.Reader, m *MetricSet) (objectResponse, error) {
+	sp, err := spoolObject(ctx, key, idKey, r, m)
+	if err != nil {
+		return objectResponse{}, err
+	}
+	defer sp.Close()
+	return sp.put(ctx, st)
+}
+
+// spooledObject is an encrypted object waiting in a temporary file to be put
+// in a store, once the request it comes with is known to be valid.
+type spooledObject struct {
+	tmp  *os.File
+	id   string
+	size int64
+}
+
+// spoolObject encrypts the plaintext read from r into a temporary file,
+// computing the ContentID of the plaintext under idKey as it goes, so memory
+// usage doesn't grow with the object size. Errors returned by r are wrapped
+// with errReadBody. The spooled object must be closed.
+func spoolObject(ctx context.Context, key [32]byte, idKey []byte, r io.Reader, m *MetricSet) (*spooledObject, error) {
+	tmp, err := os.CreateTemp("", "lattice-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	sp := &spooledObject{tmp: tmp}
+
+	// chunks are sealed on every core, which keeps large uploads from being
+	// bound by a single one.
+	enc, err := crypto.NewEncryptWriter(tmp, key, crypto.WithParallelism(runtime.GOMAXPROCS(0)))
+	if err != nil {
+		sp.Close()
+		return nil, err
+	}
+	var t timer
+	mac := crypto.NewContentIDHash(idKey)
+	n, err := CopyWithProgress(ctx, io.MultiWriter(mac, t.writer(enc)), bodyReader{r}, addProgress(m.uploadedBytes))
+	if err != nil {
+		sp.Close()
+		return nil, err
+	}
+	start := time.Now()
+	if err := enc.Close(); err != nil {
+		sp.Close()
+		return nil, err
+	}
+	m.cryptoDuration.WithLabelValues("encrypt").Observe((t.total + time.Since(start)).Seconds())
+	sp.id, sp.size = hex.EncodeToString(mac.Sum(nil)), n
+	return sp, nil
+}
+
+// put puts the ciphertext of sp in st under its ID.
+func (sp *spooledObject) put(ctx context.Context, st Store) (objectResponse, error) {
+	if _, err := sp.tmp.Seek(0, io.SeekStart); err != nil {
+		return objectResponse{}, err
+	}
+	if err := st.Put(ctx, sp.id, sp.tmp); err != nil {
+		return objectResponse{}, err
+	}
+	return objectResponse{ID: sp.id, Size: sp.size}, nil
+}
+
+// Close removes the temporary file of sp.
+func (sp *spooledObject) Close() error {
+	err := sp.tmp.Close()
+	if rmErr := os.Remove(sp.tmp.Name()); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// bodyReader wraps the read errors of r with errReadBody.
+type bodyReader struct {
+	r io.Reader
+}
+
+func (br bodyReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %w", errReadBody, err)
+	}
+	return n, err
+}
+
+// handleDownload decrypts the object named by the id path value and streams
+// it back with the content type of its metadata. A single "bytes" range is
+// honored by decrypting only the chunks overlapping it. The ID is sent as the
+// ETag, and If-Match and If-None-Match are evaluated against it. A whole
+// object whose owner is known is hashed as it is sent and checked against its
+// ID, see NewVerifyReader. With a SessionHeader, the plaintext sent is
+// encrypted again with the session key, as a sessionContentType stream of
+// unknown length. Objects that can't be decrypted are replied as classified
+// by decryptError; the first chunk is decrypted before the status is sent, a
+// failure in a later one aborts the response. Whole downloads of objects of
+// at most shareMax bytes are decrypted once for all the requests downloading
+// them at the same time through flights, ranges are decrypted per request.
+func handleDownload(st, metas Store, key [32]byte, idSecret []byte, admins []string, sessions *SessionStore, flights *FlightGroup, shareMax int64, m *MetricSet, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		id := r.PathValue("id")
+		sess, ok := requestSession(w, r, sessions)
+		if !ok {
+			return
+		}
+
+		info, err := st.Stat(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidID) {
+				WriteError(w, http.StatusNotFound, "not_found", "object not found")
+				return
+			}
+			logger.Error("cannot stat object", "id", id, "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		// a signed URL grants access on its own, and admins may read the
+		// objects without metadata.
+		var md Metadata
+		if signedRequest(r.Context()) || isAdmin(r.Context(), admins) {
+			if md, err = getMetadata(r.Context(), metas, key, id); err != nil && !errors.Is(err, store.ErrNotFound) {
+				logger.Warn("cannot read metadata", "id", id, "error", err)
+			}
+		} else if md, ok = ownedMetadata(w, r, metas, key, id, false, logger); !ok {
+			return
+		}
+		etag := objectETag(id)
+		if !checkPreconditions(w, r, etag) {
+			return
+		}
+		contentType := "application/octet-stream"
+		if md.ContentType != "" {
+			contentType = md.ContentType
+		}
+		var idKey []byte
+		if md.Owner != "" {
+			idKey = crypto.ContentIDKey(idSecret, md.Owner)
+		}
+
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", etag)
+
+		var (
+			dec    io.Reader
+			status = http.StatusOK
+			length int64
+			t      timer
+		)
+		if r.Header.Get("Range") == "" && shareMax > 0 && info.Size <= shareMax {
+			fr, err := flights.Join(r.Context(), id, func(ctx context.Context) (io.ReadCloser, int64, error) {
+				return openPlaintext(ctx, st, key, id, info.Size, idKey, m)
+			})
+			if err != nil {
+				writeDecryptError(w, decryptError(err), id, logger)
+				return
+			}
+			defer fr.Close()
+			dec, length = fr, fr.Size()
+		} else {
+			rc, size, err := openObject(r.Context(), st, id, info.Size)
+			if err != nil {
+				writeDecryptError(w, decryptError(err), id, logger)
+				return
+			}
+			defer rc.Close()
+
+			start := int64(0)
+			length = size
+			if h := r.Header.Get("Range"); h != "" {
+				var ok bool
+				start, length, ok = parseRange(h, size)
+				if !ok {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+					WriteError(w, http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable", "requested range not satisfiable")
+					return
+				}
+				status = http.StatusPartialContent
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+				// ranges can't be checked, the ID covers the whole content.
+				idKey = nil
+			}
+			if dec, err = decryptObject(rc, info.Size, key, start, length, id, idKey); err != nil {
+				writeDecryptError(w, decryptError(err), id, logger)
+				return
+			}
+			dec = t.reader(dec)
+		}
+
+		if sess != nil {
+			w.Header().Set("Content-Type", sessionContentType)
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		}
+		recordAudit(r.Context(), AuditEvent{Action: AuditRead, ObjectID: id, Detail: w.Header().Get("Content-Range")})
+		w.WriteHeader(status)
+		var out io.Writer = w
+		var enc io.WriteCloser
+		if sess != nil {
+			// the stream header is written right away, so only once the
+			// status is sent.
+			err := sess.withKey(func(k [32]byte) (err error) {
+				enc, err = crypto.NewEncryptWriter(w, k)
+				return err
+			})
+			if err != nil {
+				logger.Error("cannot encrypt for session", "id", id, "error", err)
+				panic(http.ErrAbortHandler)
+			}
+			out = enc
+		}
+		n, err := CopyWithProgress(r.Context(), out, dec, addProgress(m.downloadedBytes))
+		if err == nil && enc != nil {
+			err = enc.Close()
+		}
+		if t.total > 0 {
+			m.cryptoDuration.WithLabelValues("decrypt").Observe(t.total.Seconds())
+		}
+		if errors.Is(err, crypto.ErrContentMismatch) {
+			m.integrityFailures.Inc()
+			logger.Error("object failed its integrity check, the client received corrupted content", "id", id, "bytes", n)
+			panic(http.ErrAbortHandler)
+		}
+		if err != nil {
+			// the status is already sent, abort so the client sees a broken
+			// response instead of a silently truncated one.
+			logger.Error("cannot stream object", "id", id, "error", decryptError(err))
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// openObject opens the object stored under id, whose ciphertext is size
+// bytes long, and returns it positioned at its start along with the size of
+// its plaintext. The size is read from the header, so the object is rewound
+// with Seek or reopened when it is not an io.Seeker.
+func openObject(ctx context.Context, st Store, id string, size int64) (io.ReadCloser, int64, error) {
+	rc, err := st.Get(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	plainSize, err := crypto.PlaintextSize(rc, size)
+	if err != nil {
+		_ = rc.Close()
+		return nil, 0, err
+	}
+	if s, ok := rc.(io.Seeker); ok {
+		if _, err := s.Seek(0, io.SeekStart); err != nil {
+			_ = rc.Close()
+			return nil, 0, err
+		}
+		return rc, plainSize, nil
+	}
+	_ = rc.Close()
+	rc, err = st.Get(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, plainSize, nil
+}
+
+// decryptObject returns a reader of length bytes of the plaintext of the
+// object in rc, of size bytes of ciphertext, from start. The first chunk is
+// decrypted right away, so its errors are returned here rather than by the
+// reader. With an idKey, the plaintext is checked against id once read, see
+// NewVerifyReader.
+func decryptObject(rc io.Reader, size int64, key [32]byte, start, length int64, id string, idKey []byte) (io.Reader, error) {
+	dec, err := crypto.NewDecryptRangeReader(rc, size, key, start, length)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(dec)
+	if _, err := br.Peek(1); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if idKey != nil {
+		return crypto.NewVerifyReader(br, idKey, id), nil
+	}
+	return br, nil
+}
+
+// openPlaintext opens the whole plaintext of the object stored under id, of
+// size bytes of ciphertext, for a FlightGroup, and returns it with its size.
+// The time spent decrypting is observed when it is closed.
+func openPlaintext(ctx context.Context, st Store, key [32]byte, id string, size int64, idKey []byte, m *MetricSet) (io.ReadCloser, int64, error) {
+	rc, plainSize, err := openObject(ctx, st, id, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	dec, err := decryptObject(rc, size, key, 0, plainSize, id, idKey)
+	if err != nil {
+		_ = rc.Close()
+		return nil, 0, err
+	}
+	pr := &plaintextReader{rc: rc, m: m}
+	pr.r = pr.t.reader(dec)
+	return pr, plainSize, nil
+}
+
+type plaintextReader struct {
+	r  io.Reader
+	rc io.Closer
+	t  timer
+	m  *MetricSet
+}
+
+func (pr *plaintextReader) Read(p []byte) (int, error) { return pr.r.Read(p) }
+
+func (pr *plaintextReader) Close() error {
+	pr.m.cryptoDuration.WithLabelValues("decrypt").Observe(pr.t.total.Seconds())
+	return pr.rc.Close()
+}
+
+// parseRange parses a Range header holding a single byte range against a
+// representation of size bytes, returning the start and length of the
+// range. It supports the "N-M", "N-" and "-N" forms.
+func parseRange(h string, size int64) (start, length int64, ok bool) {
+	spec, found := strings.CutPrefix(h, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		// suffix range: the last N bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		n = min(n, size)
+		return size - n, n, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// asSubject returns r authenticated as subject, like Auth does.
+func asSubject(r *http.Request, subject string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, Identity{Subject: subject}))
+}
+
+// TestObjectHandlersMemStore drives the object handlers over MemStores, no
+// disk involved.
+func TestObjectHandlersMemStore(t *testing.T) {
+	objects, metas, index := store.NewMemStore(), store.NewMemStore(), store.NewMemStore()
+	var key [32]byte
+	rand.Read(key[:])
+	idSecret := []byte("content id secret")
+	m := NewMetricSet(prometheus.NewRegistry())
+	upload := handleUpload(objects, metas, index, key, idSecret, 1<<20, nil, m, log.Nop())
+	download := handleDownload(objects, metas, key, idSecret, nil, nil, NewFlightGroup(), 0, m, log.Nop())
+
+	plain := make([]byte, 100<<10)
+	rand.Read(plain)
+	w := httptest.NewRecorder()
+	upload.ServeHTTP(w, asSubject(httptest.NewRequest(http.MethodPost, "/objects", bytes.NewReader(plain)), "alice"))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("upload: status %d: %s", w.Code, w.Body)
+	}
+	var obj objectResponse
+	decodeBody(t, w, &obj)
+	if obj.Size != int64(len(plain)) {
+		t.Errorf("size = %d, want %d", obj.Size, len(plain))
+	}
+
+	rc, err := objects.Get(context.Background(), obj.ID)
+	if err != nil {
+		t.Fatalf("object not in the store: %v", err)
+	}
+	stored, _ := io.ReadAll(rc)
+	rc.Close()
+	if bytes.Contains(stored, plain[:64]) {
+		t.Error("the store holds plaintext")
+	}
+	if _, err := metas.Stat(context.Background(), obj.ID); err != nil {
+		t.Errorf("metadata not in the store: %v", err)
+	}
+
+	r := asSubject(httptest.NewRequest(http.MethodGet, "/objects/"+obj.ID, nil), "alice")
+	r.SetPathValue("id", obj.ID)
+	w = httptest.NewRecorder()
+	download.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: status %d: %s", w.Code, w.Body)
+	}
+	if !bytes.Equal(w.Body.Bytes(), plain) {
+		t.Fatal("downloaded content differs")
+	}
+
+	r = asSubject(httptest.NewRequest(http.MethodGet, "/objects/missing", nil), "alice")
+	r.SetPathValue("id", "0123456789abcdef")
+	w = httptest.NewRecorder()
+	download.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("download of a missing object: status %d, want 404", w.Code)
+	}
+}
+
+func TestContentIDScopedPerUser(t *testing.T) {
+	ts := newTestServer(t)
+	a1 := ts.upload(aliceToken, "identical content")
+	a2 := ts.upload(aliceToken, "identical content")
+	b := ts.upload(bobToken, "identical content")
+	if a1.ID != a2.ID {
+		t.Errorf("the same user got IDs %s and %s for the same content", a1.ID, a2.ID)
+	}
+	if a1.ID == b.ID {
+		t.Error("two users got the same ID for the same content")
+	}
+}
+
+// TestDownloadMisfiled serves the ciphertext of one object under the ID of
+// another and checks the download is aborted once the content fails to hash
+// back to the ID.
+func TestDownloadMisfiled(t *testing.T) {
+	ts := newTestServer(t)
+	a := ts.upload(aliceToken, "content of a")
+	b := ts.upload(aliceToken, "content of b")
+	rc, err := ts.store.Get(context.Background(), b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.corrupt(a.ID, func([]byte) []byte { return ct })
+
+	var w *httptest.ResponseRecorder
+	func() {
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Fatalf("recovered %v, want http.ErrAbortHandler", v)
+			}
+		}()
+		w = ts.do(http.MethodGet, "/objects/"+a.ID, aliceToken, nil)
+	}()
+	if w != nil {
+		t.Fatalf("misfiled download completed: %d %q", w.Code, w.Body)
+	}
+	if got := testutil.ToFloat64(ts.metrics.integrityFailures); got != 1 {
+		t.Errorf("integrity failures = %v, want 1", got)
+	}
+
+	// the intact object still downloads.
+	w = ts.do(http.MethodGet, "/objects/"+b.ID, aliceToken, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "content of b" {
+		t.Errorf("intact download: %d %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter keeps a token bucket per client. Buckets idle for longer than
+// its TTL are evicted by Sweep.
+type RateLimiter struct {
+	limit   rate.Limit
+	burst   int
+	ttl     time.Duration
+	trusted []netip.Prefix
+
+	mu      sync.Mutex
+	clients map[string]*client
+}
+
+type client struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing limit requests per second
+// per client, with bursts of up to burst requests. trusted lists the proxies
+// whose X-Forwarded-For header is believed when looking up the client IP.
+func NewRateLimiter(limit rate.Limit, burst int, ttl time.Duration, trusted []netip.Prefix) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		burst:   burst,
+		ttl:     ttl,
+		trusted: trusted,
+		clients: make(map[string]*client),
+	}
+}
+
+// Sweep evicts idle buckets every interval until ctx is done.
+func (l *RateLimiter) Sweep(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			l.evict(now)
+		}
+	}
+}
+
+func (l *RateLimiter) evict(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, c := range l.clients {
+		if now.Sub(c.lastSeen) > l.ttl {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// reserve takes a token from the bucket of key, returning how long the
+// client has to wait when there is none left.
+func (l *RateLimiter) reserve(key string, now time.Time) time.Duration {
+	l.mu.Lock()
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{lim: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	l.mu.Unlock()
+
+	res := c.lim.ReserveN(now, 1)
+	if !res.OK() {
+		return time.Duration(math.MaxInt64)
+	}
+	if d := res.DelayFrom(now); d > 0 {
+		res.CancelAt(now)
+		return d
+	}
+	return 0
+}
+
+// clientIP returns the IP of the client, looking past trusted proxies in the
+// X-Forwarded-For header.
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	return clientIP(r, l.trusted)
+}
+
+// clientIP returns the IP of the client of r, looking past the proxies in
+// trusted in the X-Forwarded-For header.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	ip = ip.Unmap()
+	if !isTrusted(trusted, ip) {
+		return ip.String()
+	}
+
+	// walk from the closest hop, the first untrusted one is the client.
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = hop.Unmap()
+		if !isTrusted(trusted, ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func isTrusted(trusted []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimit rejects requests over the limit of l with 429. Clients are
+// keyed by their authenticated Identity when there is one, by IP otherwise.
+func RateLimit(l *RateLimiter) Middleware {
+	return rateLimit(l, func(r *http.Request) string {
+		if id, ok := IdentityFromContext(r.Context()); ok {
+			return "sub:" + id.Subject
+		}
+		return "ip:" + l.clientIP(r)
+	})
+}
+
+// RateLimitIP rejects requests over the limit of l with 429, keying clients
+// by IP whatever their identity. It goes before Auth, so the requests that
+// fail authentication are counted too, and RateLimit after it then limits
+// each identity on its own.
+func RateLimitIP(l *RateLimiter) Middleware {
+	return rateLimit(l, func(r *http.Request) string {
+		return "ip:" + l.clientIP(r)
+	})
+}
+
+func rateLimit(l *RateLimiter, key func(r *http.Request) string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if d := l.reserve(key(r), time.Now()); d > 0 {
+				secs := int64(math.Ceil(d.Seconds()))
+				w.Header().Set("Retry-After", strconv.FormatInt(max(secs, 1), 10))
+				WriteError(w, http.StatusTooManyRequests, "rate_limited", "too many requests")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
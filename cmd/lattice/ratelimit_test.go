@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	const n = 5
+	l := NewRateLimiter(0.001, n, time.Minute, nil)
+	h := RateLimit(l)(HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	serve := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/objects", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := range n {
+		if w := serve("192.0.2.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i+1, w.Code)
+		}
+	}
+	w := serve("192.0.2.1:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request %d: status %d, want 429", n+1, w.Code)
+	}
+	if secs, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || secs < 1 {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", w.Header().Get("Retry-After"))
+	}
+	if w := serve("192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("another client: status %d, want 200", w.Code)
+	}
+}
+
+func TestRateLimitIdentity(t *testing.T) {
+	l := NewRateLimiter(0.001, 1, time.Minute, nil)
+	h := RateLimit(l)(HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	serve := func(subject string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, asSubject(httptest.NewRequest(http.MethodPost, "/objects", nil), subject))
+		return w.Code
+	}
+	// both share the IP of httptest, they are keyed by subject.
+	if serve("alice") != http.StatusOK || serve("bob") != http.StatusOK {
+		t.Fatal("first request of each identity was limited")
+	}
+	if code := serve("alice"); code != http.StatusTooManyRequests {
+		t.Fatalf("second request of alice: status %d, want 429", code)
+	}
+}
+
+// TestRateLimitUnauthenticated checks that requests failing authentication
+// count against the limit of their IP.
+func TestRateLimitUnauthenticated(t *testing.T) {
+	const n = 3
+	ts := newTestServer(t, "LATTICE_RATE_LIMIT=0.001", "LATTICE_RATE_BURST="+strconv.Itoa(n))
+	for i := range n {
+		if w := ts.do(http.MethodPost, "/objects", "wrong-token", nil); w.Code != http.StatusForbidden {
+			t.Fatalf("request %d: status %d, want 403", i+1, w.Code)
+		}
+	}
+	if w := ts.do(http.MethodPost, "/objects", "wrong-token", nil); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request %d: status %d, want 429", n+1, w.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	for _, tc := range []struct {
+		remote, xff, want string
+	}{
+		{"192.0.2.1:1", "", "192.0.2.1"},
+		{"192.0.2.1:1", "203.0.113.7", "192.0.2.1"},
+		{"10.0.0.1:1", "203.0.113.7", "203.0.113.7"},
+		{"10.0.0.1:1", "198.51.100.1, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"10.0.0.1:1", "", "10.0.0.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if got := clientIP(r, trusted); got != tc.want {
+			t.Errorf("remote %s, X-Forwarded-For %q: got %s, want %s", tc.remote, tc.xff, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	l := NewRateLimiter(1, 1, time.Minute, nil)
+	now := time.Now()
+	l.reserve("a", now)
+	l.reserve("b", now.Add(50*time.Second))
+	l.evict(now.Add(90 * time.Second))
+	if _, ok := l.clients["a"]; ok {
+		t.Error("idle bucket was kept")
+	}
+	if _, ok := l.clients["b"]; !ok {
+		t.Error("active bucket was evicted")
+	}
+}
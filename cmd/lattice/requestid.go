@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// DefaultRequestIDHeader is the header used by RequestID when none is given.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen bounds incoming request IDs so a client can't stuff
+// arbitrary payloads into our logs.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the request ID stored by RequestID.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// RequestID propagates the request ID found in header, or generates a new
+// one when absent, and echoes it back in the response. The ID is stored in
+// the request context and attached to every log entry of the request. An
+// empty header means DefaultRequestIDHeader.
+func RequestID(logger log.Logger, header string) Middleware {
+	if header == "" {
+		header = DefaultRequestIDHeader
+	}
+	return func(next http.Handler) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if !validRequestID(id) {
+				var err error
+				id, err = newRequestID(rand.Reader)
+				if err != nil {
+					logger.Error("cannot generate request id", "error", err, "fallback", id)
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+			ctx = log.ContextWith(ctx, "request_id", id)
+			w.Header().Set(header, id)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+var fallbackSeq atomic.Uint64
+
+// newRequestID returns 128 random bits read from rnd, hex-encoded. When rnd
+// fails, it returns a time and sequence based ID together with the error.
+func newRequestID(rnd io.Reader) (string, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rnd, b[:]); err != nil {
+		id := fmt.Sprintf("%016x%016x", uint64(time.Now().UnixNano()), fallbackSeq.Add(1))
+		return id, err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if c := id[i]; c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// maxJSONBody bounds the JSON bodies read by decodeJSON.
+const maxJSONBody = 1 << 10
+
+// storageRetryAfter is how long clients are told to wait before retrying a
+// write refused by the storage.
+const storageRetryAfter = 30 * time.Second
+
+// errorResponse is the envelope of every error reply.
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// WriteError replies with status and an error envelope holding a machine
+// readable code and a human readable message.
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	WriteJSON(w, status, errorResponse{Error: errorBody{Code: code, Message: message}})
+}
+
+// writeStoreError replies to a failed write of a store: 503 with a
+// Retry-After when the storage refuses writes, a 500 error otherwise.
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, store.ErrStorageUnavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(storageRetryAfter.Seconds())))
+		WriteError(w, http.StatusServiceUnavailable, "storage_unavailable", "storage is not accepting writes, retry later")
+		return
+	}
+	WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+}
+
+// decodeJSON decodes the JSON body of r, of at most maxJSONBody bytes, into v.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	return json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody)).Decode(v)
+}
+
+// WriteJSON replies with status and v encoded as JSON. v is encoded before
+// anything is written, so an encoding failure turns into a 500 error reply.
+// Nothing is written if the handler already sent its headers. Failures are
+// logged to the logger of the request, see replyLogger.
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	if hw, ok := w.(interface{ headerWritten() bool }); ok && hw.headerWritten() {
+		replyLogger(w).Error("cannot reply, headers already written", "status", status)
+		return
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		replyLogger(w).Error("cannot encode reply", "status", status, "error", err)
+		WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		replyLogger(w).Warn("cannot reply", "error", err)
+	}
+}
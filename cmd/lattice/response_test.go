@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// assertEnvelope checks that w holds exactly an error envelope with status
+// and code.
+func assertEnvelope(t *testing.T, w *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if w.Code != status {
+		t.Errorf("status = %d, want %d", w.Code, status)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var env map[string]map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("body %q is not an envelope: %v", w.Body, err)
+	}
+	if len(env) != 1 || len(env["error"]) != 2 || env["error"]["code"] != code || env["error"]["message"] == "" {
+		t.Errorf("envelope = %v, want error with code %q and a message", env, code)
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	ts := newTestServer(t)
+	assertEnvelope(t, ts.do(http.MethodGet, "/objects/0123456789abcdef", aliceToken, nil), http.StatusNotFound, "not_found")
+	assertEnvelope(t, ts.do(http.MethodPost, "/uploads", aliceToken, nil), http.StatusBadRequest, "bad_request")
+	assertEnvelope(t, ts.do(http.MethodGet, "/nowhere", aliceToken, nil), http.StatusNotFound, "not_found")
+	assertEnvelope(t, ts.do(http.MethodGet, "/objects", "", nil), http.StatusUnauthorized, "unauthorized")
+}
+
+func TestWriteJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteJSON(w, http.StatusCreated, objectResponse{ID: "abc", Size: 3})
+	if w.Code != http.StatusCreated || w.Body.String() != `{"id":"abc","size":3}`+"\n" {
+		t.Fatalf("got %d %q", w.Code, w.Body)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("X-Content-Type-Options not set")
+	}
+
+	w = httptest.NewRecorder()
+	WriteJSON(w, http.StatusOK, func() {})
+	assertEnvelope(t, w, http.StatusInternalServerError, "internal")
+}
+
+func TestWriteErrorAfterHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	var buf bytes.Buffer
+	rw := newResponseRecorder(w)
+	rw.logger = log.New(&buf, slog.LevelInfo)
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write([]byte("partial"))
+	WriteError(rw, http.StatusInternalServerError, "internal", "internal server error")
+	if w.Code != http.StatusAccepted || w.Body.String() != "partial" {
+		t.Fatalf("got %d %q, want the first reply untouched", w.Code, w.Body)
+	}
+	if entries := logEntries(t, &buf); len(entries) != 1 || entries[0]["msg"] != "cannot reply, headers already written" {
+		t.Errorf("log entries = %v, want the late reply logged", entries)
+	}
+}
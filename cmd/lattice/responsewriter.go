@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// responseRecorder wraps a http.ResponseWriter to capture the status code and
+// the number of body bytes written by the handler.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+	logger      log.Logger
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rw *responseRecorder) WriteHeader(code int) {
+	if !rw.wroteHeader {
+		rw.status = code
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseRecorder) Write(p []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// headerWritten reports whether the response headers were sent.
+func (rw *responseRecorder) headerWritten() bool { return rw.wroteHeader }
+
+// FlushError flushes the underlying writer through http.ResponseController,
+// which calls it instead of unwrapping the recorder, so the headers sent by
+// the flush are recorded. The recorder is no http.Flusher, so it doesn't
+// claim to flush a writer that can't; the same goes for hijacking, which is
+// reached through Unwrap.
+func (rw *responseRecorder) FlushError() error {
+	if err := http.NewResponseController(rw.ResponseWriter).Flush(); err != nil {
+		return err
+	}
+	rw.wroteHeader = true
+	return nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// requestLogger returns the logger of the request set by LogRequests, nil
+// for the recorders of other middleware.
+func (rw *responseRecorder) requestLogger() log.Logger { return rw.logger }
+
+// replyLogger returns the logger of the request served through w, found by
+// unwrapping w up to the recorder of LogRequests, so the helpers writing
+// replies log with the level and the fields of the request. It returns a
+// Nop logger when w is not served through LogRequests.
+func replyLogger(w http.ResponseWriter) log.Logger {
+	for {
+		if rl, ok := w.(interface{ requestLogger() log.Logger }); ok {
+			if l := rl.requestLogger(); l != nil {
+				return l
+			}
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return log.Nop()
+		}
+		w = u.Unwrap()
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestResponseRecorderOptional checks that the recorder flushes and hijacks
+// only when the writer it wraps does.
+func TestResponseRecorderOptional(t *testing.T) {
+	w := httptest.NewRecorder()
+	rw := newResponseRecorder(w)
+	if err := http.NewResponseController(rw).Flush(); err != nil || !w.Flushed {
+		t.Fatalf("Flush = %v, flushed %t, want the recorder flushed", err, w.Flushed)
+	}
+	if !rw.headerWritten() {
+		t.Error("headers sent by a flush not recorded")
+	}
+
+	// a writer hiding the optional interfaces of the httptest recorder.
+	rw = newResponseRecorder(struct{ http.ResponseWriter }{httptest.NewRecorder()})
+	if _, ok := any(rw).(http.Flusher); ok {
+		t.Error("recorder is a http.Flusher")
+	}
+	if _, ok := any(rw).(http.Hijacker); ok {
+		t.Error("recorder is a http.Hijacker")
+	}
+	rc := http.NewResponseController(rw)
+	if err := rc.Flush(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Flush = %v, want %v", err, http.ErrNotSupported)
+	}
+	if _, _, err := rc.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("Hijack = %v, want %v", err, http.ErrNotSupported)
+	}
+	if rw.headerWritten() {
+		t.Error("failed flush recorded the headers as sent")
+	}
+}
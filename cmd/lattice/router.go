@@ -0,0 +1,86 @@
+package main
+
+import "net/http"
+
+// Router registers routes on a ServeMux, each with its own middleware, behind
+// a set of global middleware shared by every request. A request goes through
+// the global middleware first, in registration order, then through the
+// middleware of its route and reaches the route handler last. Requests
+// matching no route go through the global middleware too, to the NotFound
+// handler.
+type Router struct {
+	mux      *http.ServeMux
+	handler  http.Handler
+	notFound http.Handler
+}
+
+// NewRouter returns a Router with no routes wrapping every request with
+// global. Unmatched requests get a JSON 404 until NotFound is called.
+func NewRouter(global ...Middleware) *Router {
+	rt := &Router{mux: http.NewServeMux(), notFound: HandlerFunc(notFound)}
+	rt.handler = Chain(HandlerFunc(rt.dispatch), global...)
+	return rt
+}
+
+// Handle registers h for pattern, a ServeMux pattern, wrapped with mw in the
+// same order as Chain. Like ServeMux.Handle, it panics when pattern is
+// invalid or conflicts with another one.
+func (rt *Router) Handle(pattern string, h http.Handler, mw ...Middleware) {
+	rt.mux.Handle(pattern, Chain(h, mw...))
+}
+
+// NotFound sets the handler of requests matching no route. A path that only
+// matches under other methods is still replied 405 by the ServeMux.
+func (rt *Router) NotFound(h http.Handler) {
+	rt.notFound = h
+}
+
+// ServeHTTP serves r through the global middleware and its route.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.handler.ServeHTTP(w, r)
+}
+
+func (rt *Router) dispatch(w http.ResponseWriter, r *http.Request) {
+	if _, pattern := rt.mux.Handler(r); pattern == "" {
+		// the ServeMux replies either 404 or 405, only the former is
+		// handed over to notFound.
+		w = &notFoundWriter{ResponseWriter: w, r: r, notFound: rt.notFound}
+	}
+	rt.mux.ServeHTTP(w, r)
+}
+
+func notFound(w http.ResponseWriter, r *http.Request) {
+	WriteError(w, http.StatusNotFound, "not_found", "no route matches "+r.Method+" "+r.URL.Path)
+}
+
+// notFoundWriter serves notFound in place of the 404 reply of a ServeMux,
+// and drops the body of that reply.
+type notFoundWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	notFound http.Handler
+	replaced bool
+}
+
+func (w *notFoundWriter) WriteHeader(status int) {
+	if status != http.StatusNotFound {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.replaced = true
+	h := w.ResponseWriter.Header()
+	h.Del("Content-Type")
+	h.Del("X-Content-Type-Options")
+	w.notFound.ServeHTTP(w.ResponseWriter, w.r)
+}
+
+func (w *notFoundWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *notFoundWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// tracing returns a Middleware appending name to trace before calling the
+// next handler.
+func tracing(trace *[]string, name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*trace = append(*trace, name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestRouterOrder(t *testing.T) {
+	var trace []string
+	rt := NewRouter(tracing(&trace, "global 1"), tracing(&trace, "global 2"))
+	handler := func(name string) http.Handler {
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			trace = append(trace, name)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	rt.Handle("GET /a", handler("a"), tracing(&trace, "route 1"), tracing(&trace, "route 2"))
+	rt.Handle("GET /b", handler("b"))
+
+	for _, tt := range []struct {
+		target string
+		want   []string
+	}{
+		{"/a", []string{"global 1", "global 2", "route 1", "route 2", "a"}},
+		{"/b", []string{"global 1", "global 2", "b"}},
+	} {
+		trace = nil
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != http.StatusNoContent {
+			t.Errorf("%s: status %d, want %d", tt.target, w.Code, http.StatusNoContent)
+		}
+		if !slices.Equal(trace, tt.want) {
+			t.Errorf("%s: trace %v, want %v", tt.target, trace, tt.want)
+		}
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	var trace []string
+	rt := NewRouter(tracing(&trace, "global"))
+	rt.Handle("GET /a", HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), tracing(&trace, "route"))
+
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	assertEnvelope(t, w, http.StatusNotFound, "not_found")
+	if !slices.Equal(trace, []string{"global"}) {
+		t.Errorf("trace %v, want the global middleware only", trace)
+	}
+
+	rt.NotFound(HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("custom"))
+	}))
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if w.Code != http.StatusTeapot || w.Body.String() != "custom" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("custom not found: %d %q %q", w.Code, w.Header().Get("Content-Type"), w.Body)
+	}
+
+	// a path matching under another method is still a 405.
+	w = httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/a", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") == "" {
+		t.Errorf("POST /a: status %d, Allow %q, want 405 with Allow", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+// TestRoutesMiddleware checks the per-route middleware of the server routes:
+// health checks need no credentials, objects do.
+func TestRoutesMiddleware(t *testing.T) {
+	ts := newTestServer(t)
+	for _, target := range []string{"/healthz", "/readyz", "/version"} {
+		if w := ts.do(http.MethodGet, target, "", nil); w.Code != http.StatusOK {
+			t.Errorf("%s without credentials: status %d, want %d", target, w.Code, http.StatusOK)
+		}
+	}
+	if w := ts.do(http.MethodGet, "/objects", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("/objects without credentials: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := ts.do(http.MethodGet, "/admin/loglevel", aliceToken, nil); w.Code != http.StatusForbidden {
+		t.Errorf("/admin/loglevel as a user: status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
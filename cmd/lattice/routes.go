@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// routes registers every route of s on rt along with its per-route
+// middleware. It is the only place routes are registered.
+func (s *Server) routes(rt *Router) {
+	cfg, logger := s.cfg, s.logger
+	auth, limit, limitIP := s.auth, RateLimit(s.limiter), RateLimitIP(s.limiter)
+	admin := Admin(cfg.AdminSubjects)
+	compress := Compress(CompressOptions{Zstd: true, MinSize: 1 << 10})
+	objectKey, idSecret, signingKey := s.cfg.ObjectKey, s.cfg.ContentIDKey[:], s.cfg.SigningKey[:]
+
+	pong := func(w http.ResponseWriter, r *http.Request) {
+		_, err := w.Write([]byte("PONG!"))
+		if err != nil {
+			logger.WithContext(r.Context()).Warn("cannot reply", "error", err)
+		}
+	}
+
+	rt.Handle("/ping", HandlerFunc(pong))
+	rt.Handle("/echo", HandlerFunc(pong))
+	rt.Handle("GET /healthz", handleHealthz())
+	rt.Handle("GET /version", handleVersion())
+	rt.Handle("GET /metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	rt.Handle("GET /readyz", handleReadyz(s.ready, logger))
+	rt.Handle("GET /admin/loglevel", handleGetLogLevel(s.level), auth, admin)
+	rt.Handle("PUT /admin/loglevel", handleSetLogLevel(s.level, logger), auth, admin)
+	rt.Handle("POST /admin/rotate", handleRotateKeys(s.manifests, s.manifestLocks, logger), auth, admin)
+	rt.Handle("POST /kex", handleKeyExchange(s.sessions, logger), limitIP, auth, limit)
+	rt.Handle("GET /objects", handleListObjects(s.objects, s.index, int(cfg.ListMaxLimit), logger), auth, compress)
+	rt.Handle("POST /objects", handleUpload(s.objects, s.metas, s.index, objectKey, idSecret, cfg.MaxUploadBytes, s.sessions, s.metrics, logger), limitIP, auth, limit, Idempotent(s.idempotency, cfg.MaxUploadBytes))
+	rt.Handle("GET /objects/{id}", handleDownload(s.objects, s.metas, objectKey, idSecret, cfg.AdminSubjects, s.sessions, s.flights, cfg.SharedDownloadMax, s.metrics, logger), SignedURL(signingKey, auth), compress)
+	rt.Handle("DELETE /objects/{id}", handleDelete(s.objects, s.metas, s.index, objectKey, cfg.AdminSubjects, logger), auth)
+	rt.Handle("POST /objects/{id}/restore", handleRestore(s.objects, s.metas, objectKey, cfg.AdminSubjects, logger), auth)
+	rt.Handle("POST /objects/{id}/url", handleSignURL(s.objects, s.metas, objectKey, signingKey, cfg.AdminSubjects, logger), auth)
+	rt.Handle("POST /objects/{id}/verify", handleVerify(s.objects, s.metas, objectKey, cfg.AdminSubjects, logger), auth)
+	rt.Handle("GET /objects/{id}/meta", handleMetadata(s.objects, s.metas, objectKey, cfg.AdminSubjects, logger), auth)
+	rt.Handle("POST /envelopes", handleSealEnvelope(s.envelopes, s.manifests, cfg.MaxUploadBytes, logger), limitIP, auth, limit)
+	rt.Handle("GET /envelopes/{id}", handleGetEnvelope(s.envelopes, s.manifests, cfg.AdminSubjects, logger), auth)
+	rt.Handle("GET /envelopes/{id}/manifest", handleGetManifest(s.manifests, cfg.AdminSubjects, logger), auth)
+	rt.Handle("POST /uploads", handleCreateUpload(s.uploads, cfg.MaxUploadBytes, logger), limitIP, auth, limit)
+	rt.Handle("HEAD /uploads/{id}", handleUploadStatus(s.uploads, logger), auth)
+	rt.Handle("PATCH /uploads/{id}", handleAppendUpload(s.uploads, s.objects, s.metas, s.index, objectKey, idSecret, s.metrics, logger), auth)
+}
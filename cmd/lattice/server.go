@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+	"github.com/josestg/e2eefs/internal/upload"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"golang.org/x/time/rate"
+)
+
+// Server is the lattice HTTP server. It serves the routes of routes through
+// the global middleware, and implements http.Handler so tests can drive it
+// with httptest without listening.
+type Server struct {
+	cfg     Config
+	logger  log.Logger
+	level   *slog.LevelVar
+	backend string
+
+	objects *tombstoneStore
+	metas   Store
+	index   Store
+	uploads *upload.Store
+	ready   map[string]Checker
+
+	// envelopes holds the content of envelopes, manifests their wrapped
+	// data keys. manifestLocks serializes the rewrites of a manifest.
+	envelopes     Store
+	manifests     Store
+	manifestLocks *KeyedMutex
+
+	registry    Registry
+	metrics     *MetricSet
+	limiter     *RateLimiter
+	idempotency *IdempotencyCache
+	sessions    *SessionStore
+	flights     *FlightGroup
+	auditor     Auditor
+	auth        Middleware
+
+	router *Router
+}
+
+// NewServer returns a Server storing objects in st. Metadata, the listing
+// index, the tombstones of deleted objects, partial uploads and envelopes
+// are kept under cfg.StorageDir. When st has a Ping method it is used as the
+// storage readiness check. Writes refused by a read-only or full volume
+// report the server degraded, see Degraded.
+// level is the level of logger, changed by the loglevel admin route.
+// Security events are recorded to auditor, which may be nil to drop them.
+// The metrics are registered to reg and served from it on /metrics; when
+// reg is nil, a new registry is used with the Go and process collectors.
+func NewServer(cfg Config, st Store, logger log.Logger, level *slog.LevelVar, auditor Auditor, reg Registry) (*Server, error) {
+	if auditor == nil {
+		auditor = discardAuditor{}
+	}
+	if reg == nil {
+		r := prometheus.NewRegistry()
+		r.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		reg = r
+	}
+	metas, err := store.NewFSStore(filepath.Join(cfg.StorageDir, "meta"))
+	if err != nil {
+		return nil, err
+	}
+	index, err := store.NewFSStore(filepath.Join(cfg.StorageDir, "index"))
+	if err != nil {
+		return nil, err
+	}
+	tombstones, err := store.NewFSStore(filepath.Join(cfg.StorageDir, "tombstones"))
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := upload.NewStore(filepath.Join(cfg.StorageDir, "uploads"), cfg.ObjectKey)
+	if err != nil {
+		return nil, err
+	}
+	envelopes, err := store.NewFSStore(filepath.Join(cfg.StorageDir, "envelopes"))
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := store.NewFSStore(filepath.Join(cfg.StorageDir, "manifests"))
+	if err != nil {
+		return nil, err
+	}
+	verify, err := staticTokens(cfg.AuthTokens)
+	if err != nil {
+		return nil, fmt.Errorf("LATTICE_AUTH_TOKENS: %w", err)
+	}
+
+	metrics := NewMetricSet(reg)
+
+	s := &Server{
+		cfg:           cfg,
+		logger:        logger,
+		level:         level,
+		backend:       storageBackend(st),
+		objects:       newTombstoneStore(instrumentStore(st, metrics), tombstones),
+		metas:         metas,
+		index:         index,
+		uploads:       uploads,
+		envelopes:     envelopes,
+		manifests:     manifests,
+		manifestLocks: NewKeyedMutex(),
+		ready:         make(map[string]Checker),
+		registry:      reg,
+		metrics:       metrics,
+		limiter:       NewRateLimiter(rate.Limit(cfg.RateLimit), int(cfg.RateBurst), cfg.RateLimitTTL, cfg.TrustedProxies),
+		idempotency:   NewIdempotencyCache(cfg.IdempotencyTTL),
+		sessions:      NewSessionStore(cfg.SessionTTL),
+		flights:       NewFlightGroup(),
+		auditor:       auditor,
+		auth:          Auth(verify),
+	}
+	if p, ok := st.(interface{ Ping(context.Context) error }); ok {
+		s.ready["storage"] = CheckerFunc(p.Ping)
+	}
+	writables := []writable{metas, index, tombstones, envelopes, manifests}
+	if w, ok := st.(writable); ok {
+		writables = append(writables, w)
+	}
+	s.ready["storage_writes"] = Degraded(CheckerFunc(func(ctx context.Context) error {
+		var errs []error
+		for _, w := range writables {
+			if err := w.Writable(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
+	}))
+
+	s.router = NewRouter(
+		RequestID(logger, cfg.RequestIDHeader),
+		Audit(auditor, cfg.TrustedProxies),
+		LogRequests(logger),
+		CORS(CORSConfig{
+			AllowedOrigins:   cfg.CORSOrigins,
+			AllowedMethods:   []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+			AllowedHeaders:   []string{"Authorization", "Content-Type", "Content-Disposition", "Content-MD5", "Digest", "Idempotency-Key", "If-Match", "If-None-Match", "Lattice-Recipients", "Lattice-Session", "Lattice-Tags", "Range", "Upload-Length", "Upload-Offset", cfg.RequestIDHeader},
+			ExposedHeaders:   []string{"Content-Range", "ETag", "Location", "Retry-After", "Upload-Length", "Upload-Offset", "Want-Digest", cfg.RequestIDHeader},
+			AllowCredentials: cfg.CORSCredentials,
+			MaxAge:           10 * time.Minute,
+		}),
+		Recover(logger),
+		Timeout(cfg.RequestTimeout),
+		Metrics(metrics),
+	)
+	s.routes(s.router)
+	return s, nil
+}
+
+// Registry is where a Server registers its metrics and gathers them from,
+// like a *prometheus.Registry.
+type Registry interface {
+	prometheus.Registerer
+	prometheus.Gatherer
+}
+
+// writable is implemented by stores that can tell whether their volume
+// still accepts writes, like store.FSStore.
+type writable interface {
+	Writable(ctx context.Context) error
+}
+
+// storageBackend names the kind of st for the logs.
+func storageBackend(st Store) string {
+	switch st.(type) {
+	case *store.FSStore:
+		return "fs"
+	case *store.MemStore:
+		return "memory"
+	}
+	return fmt.Sprintf("%T", st)
+}
+
+// ServeHTTP serves r through the global middleware and the routes.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Run starts the background jobs and serves on cfg.Addr until ctx is done,
+// then shuts down gracefully within cfg.ShutdownTimeout. Connections still
+// open after that are closed. It returns nil after a graceful shutdown.
+//
+// At most cfg.MaxConns connections are served at once, further ones wait in
+// the listen backlog until a connection is closed.
+func (s *Server) Run(ctx context.Context) error {
+	jobs, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go s.limiter.Sweep(jobs, s.cfg.RateLimitTTL)
+	go s.idempotency.Sweep(jobs, s.cfg.IdempotencyTTL)
+	go s.sessions.Sweep(jobs, time.Minute)
+	gcTicker := time.NewTicker(s.cfg.UploadGCInterval)
+	defer gcTicker.Stop()
+	go collectEvery(jobs, s.uploads, gcTicker.C, s.cfg.UploadTTL, "stale uploads", s.logger)
+	purgeTicker := time.NewTicker(s.cfg.PurgeInterval)
+	defer purgeTicker.Stop()
+	purge := collectorFunc(func(cutoff time.Time) (int, error) {
+		return purgeDeleted(jobs, s.objects, s.metas, s.index, s.cfg.ObjectKey, cutoff, s.auditor)
+	})
+	go collectEvery(jobs, purge, purgeTicker.C, s.cfg.DeleteGrace, "deleted objects", s.logger)
+
+	// conns tracks connections that are not closed or hijacked yet, so we can
+	// report how many were abandoned when the graceful shutdown gives up.
+	var conns atomic.Int64
+	srv := http.Server{
+		Addr: s.cfg.Addr, // host:port
+		// HTTP/2 is negotiated automatically by ServeTLS.
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+		Handler:   s,
+		// a short header timeout keeps slowloris clients from holding a
+		// connection slot forever.
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				conns.Add(1)
+			case http.StateClosed, http.StateHijacked:
+				conns.Add(-1)
+			}
+		},
+	}
+
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	ln = LimitListener(ln, int(s.cfg.MaxConns))
+
+	build := currentBuild()
+	s.logger.Info("server is listening",
+		"addr", ln.Addr().String(),
+		"tls", s.cfg.TLS(),
+		"storage", s.backend,
+		"storage_dir", s.cfg.StorageDir,
+		"max_conns", s.cfg.MaxConns,
+		"version", build.Version,
+		"commit", build.Commit,
+	)
+	serverErr := make(chan error, 1)
+	go func() {
+		if s.cfg.TLS() {
+			serverErr <- srv.ServeTLS(ln, s.cfg.TLSCert, s.cfg.TLSKey)
+			return
+		}
+		serverErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+		s.logger.Info("shutting down", "timeout", s.cfg.ShutdownTimeout)
+	}
+
+	stopJobs()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancelShutdown()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		abandoned := conns.Load()
+		if err := srv.Close(); err != nil {
+			s.logger.Error("cannot close server", "error", err)
+		}
+		return fmt.Errorf("graceful shutdown failed, abandoned connections: %d: %w", abandoned, err)
+	}
+	if err := <-serverErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
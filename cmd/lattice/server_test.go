@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The tokens of the test server: alice and bob are users, root an admin.
+const (
+	aliceToken = "alice-token"
+	bobToken   = "bob-token"
+	rootToken  = "root-token"
+)
+
+// testServer is a Server over a MemStore, driven with httptest.
+type testServer struct {
+	*Server
+	t     *testing.T
+	store *store.MemStore
+	audit *captureAuditor
+	reg   *prometheus.Registry
+}
+
+// newTestServer returns a testServer configured by the environment, with
+// env, a list of KEY=VALUE pairs, set on top of the defaults of the tests.
+func newTestServer(t *testing.T, env ...string) *testServer {
+	t.Helper()
+	return newWrappedTestServer(t, nil, env...)
+}
+
+// newWrappedTestServer is newTestServer with the MemStore handed to the
+// server through wrap, when not nil.
+func newWrappedTestServer(t *testing.T, wrap func(*store.MemStore) Store, env ...string) *testServer {
+	t.Helper()
+	defaults := []string{
+		"LATTICE_STORAGE_DIR=" + t.TempDir(),
+		"LATTICE_AUTH_TOKENS=" + aliceToken + "=alice," + bobToken + "=bob," + rootToken + "=root",
+		"LATTICE_ADMIN_SUBJECTS=root",
+		"LATTICE_OBJECT_KEY=" + strings.Repeat("01", 32),
+		"LATTICE_CONTENT_ID_KEY=" + strings.Repeat("02", 32),
+		"LATTICE_SIGNING_KEY=" + strings.Repeat("03", 32),
+	}
+	for _, kv := range append(defaults, env...) {
+		k, v, _ := strings.Cut(kv, "=")
+		t.Setenv(k, v)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	ts := &testServer{t: t, store: store.NewMemStore(), audit: new(captureAuditor), reg: prometheus.NewRegistry()}
+	var st Store = ts.store
+	if wrap != nil {
+		st = wrap(ts.store)
+	}
+	ts.Server, err = NewServer(cfg, st, log.New(io.Discard, slog.LevelInfo), new(slog.LevelVar), ts.audit, ts.reg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return ts
+}
+
+// do serves a request with the bearer token, when not empty, and header, a
+// list of name and value pairs.
+func (ts *testServer) do(method, target, token string, body io.Reader, header ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	r := httptest.NewRequest(method, target, body)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	ts.ServeHTTP(w, r)
+	return w
+}
+
+// upload stores content as the identity of token and returns the object.
+func (ts *testServer) upload(token, content string, header ...string) objectResponse {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/objects", token, strings.NewReader(content), header...)
+	if w.Code != http.StatusCreated {
+		ts.t.Fatalf("upload: status %d: %s", w.Code, w.Body)
+	}
+	var obj objectResponse
+	decodeBody(ts.t, w, &obj)
+	return obj
+}
+
+// decodeBody decodes the JSON body of w into v.
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %q: %v", w.Body, err)
+	}
+}
+
+// errorCode returns the code of the error envelope of w.
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp errorResponse
+	decodeBody(t, w, &resp)
+	return resp.Error.Code
+}
+
+// captureAuditor keeps the events recorded to it.
+type captureAuditor struct {
+	mu     sync.Mutex
+	events []AuditEvent
+}
+
+func (a *captureAuditor) Record(_ context.Context, event AuditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.events = append(a.events, event)
+}
+
+// recorded returns the events recorded so far with action.
+func (a *captureAuditor) recorded(action AuditAction) []AuditEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var events []AuditEvent
+	for _, e := range a.events {
+		if e.Action == action {
+			events = append(events, e)
+		}
+	}
+	return events
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/log"
+)
+
+// SessionHeader names the session, created by POST /kex, whose key encrypts
+// the body of an upload or a download on top of TLS.
+const SessionHeader = "Lattice-Session"
+
+// sessionContentType is the media type of a download encrypted with a session
+// key, a stream in the format of crypto.NewEncryptWriter.
+const sessionContentType = "application/vnd.e2eefs.stream"
+
+// SessionStore keeps the keys of the sessions agreed through POST /kex in
+// memory for their TTL. Keys are locked in memory when possible, and wiped
+// once their session expires, by Sweep or by the first lookup after expiry.
+type SessionStore struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	subject string
+	key     *crypto.Key
+	expires time.Time
+}
+
+// NewSessionStore returns an empty SessionStore keeping sessions for ttl.
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{ttl: ttl, sessions: make(map[string]*session)}
+}
+
+// Sweep wipes and forgets expired sessions every interval until ctx is done.
+func (s *SessionStore) Sweep(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.evict(now)
+		}
+	}
+}
+
+func (s *SessionStore) evict(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, sess := range s.sessions {
+		if now.After(sess.expires) {
+			sess.key.Wipe()
+			delete(s.sessions, token)
+		}
+	}
+}
+
+// create stores key as a new session of subject and returns its token and
+// expiry. The store takes ownership of key and wipes it on expiry.
+func (s *SessionStore) create(subject string, key []byte, now time.Time) (string, time.Time, error) {
+	var b [32]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(b[:])
+	sess := &session{subject: subject, key: crypto.NewKey(key), expires: now.Add(s.ttl)}
+	// a key that can't be locked is still wiped on expiry.
+	_ = sess.key.Lock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[token] = sess
+	return token, sess.expires, nil
+}
+
+// lookup returns the live session named by token, provided it belongs to
+// subject.
+func (s *SessionStore) lookup(token, subject string, now time.Time) (*session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[token]
+	if !ok {
+		return nil, false
+	}
+	if now.After(sess.expires) {
+		sess.key.Wipe()
+		delete(s.sessions, token)
+		return nil, false
+	}
+	return sess, sess.subject == subject
+}
+
+// withKey calls fn with a copy of the session key, wiped when fn returns.
+func (sess *session) withKey(fn func(key [32]byte) error) error {
+	return sess.key.With(func(b []byte) error {
+		var key [32]byte
+		copy(key[:], b)
+		defer clear(key[:])
+		return fn(key)
+	})
+}
+
+// requestSession returns the session named by the SessionHeader of r, nil
+// when the header is not set. It replies 403 and reports false when the
+// session is unknown, expired or belongs to another identity.
+func requestSession(w http.ResponseWriter, r *http.Request, sessions *SessionStore) (*session, bool) {
+	token := r.Header.Get(SessionHeader)
+	if token == "" {
+		return nil, true
+	}
+	identity, _ := IdentityFromContext(r.Context())
+	sess, ok := sessions.lookup(token, identity.Subject, time.Now())
+	if !ok {
+		WriteError(w, http.StatusForbidden, "invalid_session", "unknown or expired session")
+		return nil, false
+	}
+	return sess, true
+}
+
+// kexRequest and kexResponse are the bodies of POST /kex.
+type kexRequest struct {
+	PublicKey crypto.PublicKey `json:"public_key"`
+}
+
+type kexResponse struct {
+	PublicKey crypto.PublicKey `json:"public_key"`
+	Session   string           `json:"session"`
+	Expires   time.Time        `json:"expires"`
+}
+
+// handleKeyExchange agrees on a session key with the client by X25519: the
+// client sends the public half of an ephemeral key pair, the server replies
+// with the public half of its own, and each side derives the key with
+// crypto.SessionKey. The key is stored under the returned session token,
+// which is sent in the SessionHeader of later uploads and downloads of the
+// same identity to encrypt their bodies with the session key.
+func handleKeyExchange(sessions *SessionStore, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		var req kexRequest
+		if err := decodeJSON(w, r, &req); err != nil {
+			WriteError(w, http.StatusBadRequest, "bad_request", "invalid JSON body, want a base64 X25519 public_key")
+			return
+		}
+
+		priv, err := crypto.GenerateKey()
+		if err != nil {
+			logger.Error("cannot generate key", "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		defer clear(priv[:])
+		resp := kexResponse{}
+		if resp.PublicKey, err = priv.Public(); err != nil {
+			logger.Error("cannot generate key", "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		key, err := crypto.SessionKey(priv, req.PublicKey)
+		if err != nil {
+			// a low order point, the peer key is unusable.
+			WriteError(w, http.StatusBadRequest, "bad_request", "invalid public key")
+			return
+		}
+
+		identity, _ := IdentityFromContext(r.Context())
+		resp.Session, resp.Expires, err = sessions.create(identity.Subject, key[:], time.Now())
+		if err != nil {
+			clear(key[:])
+			logger.Error("cannot create session", "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		recordAudit(r.Context(), AuditEvent{Action: AuditKeyExchange, Detail: "session expires " + resp.Expires.UTC().Format(time.RFC3339)})
+		w.Header().Set("Cache-Control", "no-store")
+		WriteJSON(w, http.StatusCreated, resp)
+	}
+}
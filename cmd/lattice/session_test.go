@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+)
+
+// keyExchange runs POST /kex as the identity of token and returns the
+// session token with the key derived on the client side.
+func (ts *testServer) keyExchange(token string) (string, [32]byte) {
+	ts.t.Helper()
+	priv, pub := newKeyPair(ts.t)
+	w := ts.do(http.MethodPost, "/kex", token, strings.NewReader(`{"public_key":"`+pub+`"}`))
+	if w.Code != http.StatusCreated {
+		ts.t.Fatalf("kex: status %d: %s", w.Code, w.Body)
+	}
+	var resp kexResponse
+	decodeBody(ts.t, w, &resp)
+	key, err := crypto.SessionKey(priv, resp.PublicKey)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return resp.Session, key
+}
+
+func TestKeyExchange(t *testing.T) {
+	ts := newTestServer(t)
+	token, clientKey := ts.keyExchange(aliceToken)
+
+	sess, ok := ts.sessions.lookup(token, "alice", time.Now())
+	if !ok {
+		t.Fatal("session not stored for alice")
+	}
+	var serverKey [32]byte
+	if err := sess.withKey(func(k [32]byte) error { serverKey = k; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if serverKey != clientKey {
+		t.Fatal("client and server derive different session keys")
+	}
+	if _, ok := ts.sessions.lookup(token, "bob", time.Now()); ok {
+		t.Error("the session of alice is usable by bob")
+	}
+	if got := len(ts.audit.recorded(AuditKeyExchange)); got != 1 {
+		t.Errorf("audited %d key exchanges, want 1", got)
+	}
+
+	for _, body := range []string{`{}`, `{"public_key":"AAAA"}`, `{"public_key":"` + strings.Repeat("A", 43) + `="}`} {
+		if w := ts.do(http.MethodPost, "/kex", aliceToken, strings.NewReader(body)); w.Code != http.StatusBadRequest {
+			t.Errorf("kex %s: status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// TestSessionTransfer uploads a body encrypted with a session key and
+// downloads it encrypted again with the same key.
+func TestSessionTransfer(t *testing.T) {
+	ts := newTestServer(t)
+	token, key := ts.keyExchange(aliceToken)
+	plain := []byte("sent over a session")
+
+	var body bytes.Buffer
+	enc, err := crypto.NewEncryptWriter(&body, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.Write(plain)
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	obj := ts.upload(aliceToken, body.String(), SessionHeader, token)
+	if obj.Size != int64(len(plain)) {
+		t.Errorf("stored %d bytes, want the %d of the plaintext", obj.Size, len(plain))
+	}
+	if w := ts.do(http.MethodPost, "/objects", aliceToken, strings.NewReader("not encrypted"), SessionHeader, token); w.Code != http.StatusBadRequest {
+		t.Errorf("upload of a plaintext body: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil, SessionHeader, token)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != sessionContentType {
+		t.Fatalf("download: %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	dec, err := crypto.NewDecryptReader(w.Body, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(dec)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("download = %q, %v, want %q", got, err, plain)
+	}
+
+	// the plain download is unchanged.
+	if w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil); w.Body.String() != string(plain) {
+		t.Errorf("plain download = %q, want %q", w.Body, plain)
+	}
+	for name, tok := range map[string]string{"unknown": strings.Repeat("00", 32), "of alice": token} {
+		w := ts.do(http.MethodGet, "/objects/"+obj.ID, bobToken, nil, SessionHeader, tok)
+		if w.Code != http.StatusForbidden || errorCode(t, w) != "invalid_session" {
+			t.Errorf("bob with a session %s: status %d: %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	sessions := NewSessionStore(time.Minute)
+	now := time.Now()
+	token, _, err := sessions.create("alice", bytes.Repeat([]byte{1}, 32), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _, err := sessions.create("alice", bytes.Repeat([]byte{2}, 32), now.Add(-2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, _ := sessions.lookup(expired, "alice", now.Add(-2*time.Minute))
+
+	sessions.evict(now)
+	if _, ok := sessions.lookup(expired, "alice", now); ok {
+		t.Error("expired session still found after evict")
+	}
+	if err := sess.withKey(func([32]byte) error { return nil }); err == nil {
+		t.Error("key of an evicted session not wiped")
+	}
+	if _, ok := sessions.lookup(token, "alice", now); !ok {
+		t.Error("live session evicted")
+	}
+	if _, ok := sessions.lookup(token, "alice", now.Add(2*time.Minute)); ok {
+		t.Error("session found past its expiry")
+	}
+	if n := len(sessions.sessions); n != 0 {
+		t.Errorf("%d sessions left, want 0", n)
+	}
+}
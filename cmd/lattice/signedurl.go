@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+const (
+	// defaultSignedURLTTL is the lifetime of a signed URL when none is asked.
+	defaultSignedURLTTL = 15 * time.Minute
+
+	// maxSignedURLTTL bounds the lifetime of a signed URL.
+	maxSignedURLTTL = 7 * 24 * time.Hour
+)
+
+var (
+	errSignatureExpired = errors.New("signature expired")
+	errSignatureInvalid = errors.New("invalid signature")
+)
+
+// SignDownloadURL returns the path of a download link for the object id
+// that is valid for ttl without an Authorization header. The link carries
+// its expiry time and an HMAC-SHA256 of the ID and expiry under key, which
+// must not be the content encryption key.
+func SignDownloadURL(id string, ttl time.Duration, key []byte) (string, error) {
+	return signDownloadURL(id, ttl, key, time.Now())
+}
+
+func signDownloadURL(id string, ttl time.Duration, key []byte, now time.Time) (string, error) {
+	if id == "" {
+		return "", errors.New("signed url: empty object id")
+	}
+	if ttl <= 0 {
+		return "", errors.New("signed url: ttl must be positive")
+	}
+	if len(key) == 0 {
+		return "", errors.New("signed url: empty signing key")
+	}
+	expires := strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	q := url.Values{
+		"expires":   {expires},
+		"signature": {downloadSignature(id, expires, key)},
+	}
+	return "/objects/" + url.PathEscape(id) + "?" + q.Encode(), nil
+}
+
+func downloadSignature(id, expires string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("e2eefs download\x00"))
+	mac.Write([]byte(id))
+	mac.Write([]byte{0})
+	mac.Write([]byte(expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyDownloadSignature checks the expires and signature query parameters
+// of a download of id.
+func verifyDownloadSignature(id string, q url.Values, key []byte, now time.Time) error {
+	expires, sig := q.Get("expires"), q.Get("signature")
+	want := downloadSignature(id, expires, key)
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return errSignatureInvalid
+	}
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errSignatureInvalid
+	}
+	if !now.Before(time.Unix(exp, 0)) {
+		return errSignatureExpired
+	}
+	return nil
+}
+
+// SignedURL lets requests carrying a signature query parameter through when
+// it is a valid signature of the id path value under key, and answers 403
+// when it is expired or doesn't match. Requests without a signature go
+// through fallback, usually Auth.
+func SignedURL(key []byte, fallback Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		authed := fallback(next)
+		return HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			q := r.URL.Query()
+			if !q.Has("signature") {
+				authed.ServeHTTP(w, r)
+				return
+			}
+			id := r.PathValue("id")
+			switch err := verifyDownloadSignature(id, q, key, time.Now()); {
+			case errors.Is(err, errSignatureExpired):
+				recordAudit(r.Context(), AuditEvent{Action: AuditAuthFailure, ObjectID: id, Detail: "signed url expired"})
+				WriteError(w, http.StatusForbidden, "signature_expired", "signed url expired")
+			case err != nil:
+				recordAudit(r.Context(), AuditEvent{Action: AuditAuthFailure, ObjectID: id, Detail: "invalid signature"})
+				WriteError(w, http.StatusForbidden, "forbidden", "invalid signature")
+			default:
+				recordAudit(r.Context(), AuditEvent{Action: AuditSignedURL, ObjectID: id})
+				ctx := context.WithValue(r.Context(), signedKey{}, true)
+				next.ServeHTTP(w, r.WithContext(log.ContextWith(ctx, "signed", true)))
+			}
+		})
+	}
+}
+
+type signedKey struct{}
+
+// signedRequest reports whether the request of ctx went through SignedURL
+// with a valid signature, rather than through its fallback.
+func signedRequest(ctx context.Context) bool {
+	signed, _ := ctx.Value(signedKey{}).(bool)
+	return signed
+}
+
+// signedURLResponse holds a signed download link.
+type signedURLResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// handleSignURL replies with a signed download link for the object named by
+// the id path value. Its lifetime is given by the ttl query parameter, a
+// duration of at most maxSignedURLTTL. Only the owner of an object, or an
+// admin, may sign a link to it.
+func handleSignURL(st, metas Store, objectKey [32]byte, key []byte, admins []string, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		id := r.PathValue("id")
+
+		ttl := defaultSignedURLTTL
+		if v := r.URL.Query().Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > maxSignedURLTTL {
+				WriteError(w, http.StatusBadRequest, "bad_request", "ttl must be a positive duration of at most "+maxSignedURLTTL.String())
+				return
+			}
+			ttl = d
+		}
+
+		if _, err := st.Stat(r.Context(), id); err != nil {
+			if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidID) {
+				WriteError(w, http.StatusNotFound, "not_found", "object not found")
+				return
+			}
+			logger.Error("cannot stat object", "id", id, "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		if !ownsObject(w, r, metas, objectKey, id, isAdmin(r.Context(), admins), logger) {
+			return
+		}
+
+		now := time.Now()
+		u, err := signDownloadURL(id, ttl, key, now)
+		if err != nil {
+			logger.Error("cannot sign url", "id", id, "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		recordAudit(r.Context(), AuditEvent{Action: AuditSignURL, ObjectID: id, Detail: "ttl " + ttl.String()})
+		WriteJSON(w, http.StatusOK, signedURLResponse{URL: u, Expires: now.Add(ttl).UTC().Truncate(time.Second)})
+	}
+}
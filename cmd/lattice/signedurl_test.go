@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signURL asks the server for a signed link to id as the identity of token.
+func (ts *testServer) signURL(token, id, ttl string) *signedURLResponse {
+	ts.t.Helper()
+	w := ts.do(http.MethodPost, "/objects/"+id+"/url?ttl="+ttl, token, nil)
+	if w.Code != http.StatusOK {
+		return nil
+	}
+	var resp signedURLResponse
+	decodeBody(ts.t, w, &resp)
+	return &resp
+}
+
+func TestSignedURL(t *testing.T) {
+	ts := newTestServer(t)
+	obj := ts.upload(aliceToken, "shared content")
+	link := ts.signURL(aliceToken, obj.ID, "1m")
+	if link == nil {
+		t.Fatal("owner cannot sign a link")
+	}
+	if until := time.Until(link.Expires); until <= 0 || until > time.Minute {
+		t.Errorf("expires in %v, want within a minute", until)
+	}
+
+	w := ts.do(http.MethodGet, link.URL, "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "shared content" {
+		t.Fatalf("valid link: %d %q", w.Code, w.Body)
+	}
+	if events := ts.audit.recorded(AuditSignedURL); len(events) != 1 || events[0].ObjectID != obj.ID {
+		t.Errorf("signed url audit events = %+v", events)
+	}
+}
+
+func TestSignedURLRejected(t *testing.T) {
+	ts := newTestServer(t)
+	obj := ts.upload(aliceToken, "shared content")
+	other := ts.upload(aliceToken, "other content")
+	key := ts.cfg.SigningKey[:]
+
+	expired, _ := signDownloadURL(obj.ID, time.Minute, key, time.Now().Add(-2*time.Minute))
+	valid, _ := SignDownloadURL(obj.ID, time.Minute, key)
+	u, _ := url.Parse(valid)
+	q := u.Query()
+	sig := q.Get("signature")
+	q.Set("signature", strings.Repeat("0", len(sig)))
+	tampered := u.Path + "?" + q.Encode()
+	q.Set("signature", sig)
+	q.Set("expires", "9999999999")
+	extended := u.Path + "?" + q.Encode()
+	forOther := "/objects/" + other.ID + "?" + u.RawQuery
+	wrongKey, _ := SignDownloadURL(obj.ID, time.Minute, []byte("another key"))
+
+	for name, tc := range map[string]struct {
+		link, code string
+	}{
+		"expired":            {expired, "signature_expired"},
+		"tampered signature": {tampered, "forbidden"},
+		"extended expiry":    {extended, "forbidden"},
+		"other object":       {forOther, "forbidden"},
+		"wrong signing key":  {wrongKey, "forbidden"},
+		"missing expiry":     {u.Path + "?signature=" + sig, "forbidden"},
+	} {
+		w := ts.do(http.MethodGet, tc.link, "", nil)
+		if w.Code != http.StatusForbidden || errorCode(t, w) != tc.code {
+			t.Errorf("%s: %d %s, want 403 %s", name, w.Code, w.Body, tc.code)
+		}
+	}
+}
+
+func TestSignURLOwner(t *testing.T) {
+	ts := newTestServer(t)
+	obj := ts.upload(aliceToken, "private")
+	if ts.signURL(bobToken, obj.ID, "1m") != nil {
+		t.Error("another user signed a link")
+	}
+	if ts.signURL(rootToken, obj.ID, "1m") == nil {
+		t.Error("an admin cannot sign a link")
+	}
+	for _, ttl := range []string{"0s", "-1m", "x", (maxSignedURLTTL + time.Second).String()} {
+		if w := ts.do(http.MethodPost, "/objects/"+obj.ID+"/url?ttl="+ttl, aliceToken, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("ttl %s: status %d, want 400", ttl, w.Code)
+		}
+	}
+	if _, err := SignDownloadURL(obj.ID, time.Minute, nil); err == nil {
+		t.Error("signed with an empty key")
+	}
+}
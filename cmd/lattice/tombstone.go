@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// tombstoneStore is a Store whose objects can be soft deleted. A soft deleted
+// object keeps its content but gets a tombstone, an empty entry named after
+// it in tombstones, and is reported as not found until it is restored or
+// purged. The time of the tombstone is the time of the deletion.
+type tombstoneStore struct {
+	Store
+	tombstones Store
+}
+
+func newTombstoneStore(st, tombstones Store) *tombstoneStore {
+	return &tombstoneStore{Store: st, tombstones: tombstones}
+}
+
+// deleted reports whether the object stored under id is soft deleted.
+func (s *tombstoneStore) deleted(ctx context.Context, id string) (bool, error) {
+	_, err := s.tombstones.Stat(ctx, id)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, store.ErrNotFound):
+		return false, nil
+	}
+	return false, err
+}
+
+// Put stores the content of r under id. Uploading a soft deleted object
+// again restores it.
+func (s *tombstoneStore) Put(ctx context.Context, id string, r io.Reader) error {
+	if err := s.Store.Put(ctx, id, r); err != nil {
+		return err
+	}
+	if err := s.tombstones.Delete(ctx, id); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Get opens the object stored under id, unless it is soft deleted.
+func (s *tombstoneStore) Get(ctx context.Context, id string) (io.ReadCloser, error) {
+	if err := s.visible(ctx, id); err != nil {
+		return nil, err
+	}
+	return s.Store.Get(ctx, id)
+}
+
+// Stat describes the object stored under id, unless it is soft deleted.
+func (s *tombstoneStore) Stat(ctx context.Context, id string) (store.ObjectInfo, error) {
+	if err := s.visible(ctx, id); err != nil {
+		return store.ObjectInfo{}, err
+	}
+	return s.Store.Stat(ctx, id)
+}
+
+// visible returns store.ErrNotFound when the object stored under id is soft
+// deleted.
+func (s *tombstoneStore) visible(ctx context.Context, id string) error {
+	del, err := s.deleted(ctx, id)
+	if err != nil {
+		return err
+	}
+	if del {
+		return fmt.Errorf("%w: %s", store.ErrNotFound, id)
+	}
+	return nil
+}
+
+// List skips soft deleted objects, so a page may hold fewer than limit IDs
+// even when it is not the last one.
+func (s *tombstoneStore) List(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	ids, next, err := s.Store.List(ctx, prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	live := ids[:0]
+	for _, id := range ids {
+		del, err := s.deleted(ctx, id)
+		if err != nil {
+			return nil, "", err
+		}
+		if !del {
+			live = append(live, id)
+		}
+	}
+	return live, next, nil
+}
+
+// Delete removes the object stored under id for good, along with its
+// tombstone.
+func (s *tombstoneStore) Delete(ctx context.Context, id string) error {
+	if err := s.tombstones.Delete(ctx, id); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	return s.Store.Delete(ctx, id)
+}
+
+// SoftDelete hides the object stored under id until it is restored or
+// purged. Deleting an object that is already soft deleted is a no-op, which
+// keeps the time of the first deletion. It returns store.ErrNotFound when
+// there is no such object.
+func (s *tombstoneStore) SoftDelete(ctx context.Context, id string) error {
+	if del, err := s.deleted(ctx, id); err != nil || del {
+		return err
+	}
+	if _, err := s.Store.Stat(ctx, id); err != nil {
+		return err
+	}
+	return s.tombstones.Put(ctx, id, strings.NewReader(""))
+}
+
+// Restore makes the soft deleted object stored under id visible again.
+// Restoring an object that is not deleted is a no-op. It returns
+// store.ErrNotFound when there is no such object, e.g. after a purge.
+func (s *tombstoneStore) Restore(ctx context.Context, id string) error {
+	if _, err := s.Store.Stat(ctx, id); err != nil {
+		return err
+	}
+	if err := s.tombstones.Delete(ctx, id); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// DeletedBefore returns the IDs of the objects soft deleted before cutoff.
+func (s *tombstoneStore) DeletedBefore(ctx context.Context, cutoff time.Time) ([]string, error) {
+	var (
+		ids    []string
+		cursor string
+	)
+	for {
+		page, next, err := s.tombstones.List(ctx, "", cursor, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range page {
+			info, err := s.tombstones.Stat(ctx, id)
+			if errors.Is(err, store.ErrNotFound) {
+				// restored in the meantime.
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if info.ModTime.Before(cutoff) {
+				ids = append(ids, id)
+			}
+		}
+		if next == "" {
+			return ids, nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/upload"
+)
+
+// uploadResponse describes a resumable upload.
+type uploadResponse struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// handleCreateUpload starts a resumable upload of Upload-Length bytes.
+func handleCreateUpload(uploads *upload.Store, maxBytes int64, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			WriteError(w, http.StatusBadRequest, "bad_request", "missing or invalid Upload-Length")
+			return
+		}
+		if length > maxBytes {
+			WriteError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "upload exceeds the maximum size")
+			return
+		}
+
+		identity, _ := IdentityFromContext(r.Context())
+		info, err := uploads.Create(identity.Subject, length)
+		if err != nil {
+			logger.Error("cannot create upload", "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+
+		w.Header().Set("Location", "/uploads/"+info.ID)
+		writeUpload(w, http.StatusCreated, info)
+	}
+}
+
+// handleUploadStatus reports how many bytes an upload has received, so a
+// client knows where to resume from.
+func handleUploadStatus(uploads *upload.Store, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, ok := ownedUpload(w, r, uploads, logger)
+		if !ok {
+			return
+		}
+		setUploadHeaders(w, info)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAppendUpload appends the request body to an upload at the offset
+// given by Upload-Offset, which must match the bytes received so far. Once
+// the declared length is reached the upload is turned into an object. When
+// the body breaks partway, Upload-Offset tells where to resume from.
+func handleAppendUpload(uploads *upload.Store, st, metas, index Store, key [32]byte, idSecret []byte, m *MetricSet, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			WriteError(w, http.StatusBadRequest, "bad_request", "missing or invalid Upload-Offset")
+			return
+		}
+		info, ok := ownedUpload(w, r, uploads, logger)
+		if !ok {
+			return
+		}
+
+		id := info.ID
+		info, err = uploads.Append(r.Context(), id, offset, r.Body)
+		if err != nil {
+			switch {
+			case errors.Is(err, upload.ErrNotFound):
+				WriteError(w, http.StatusNotFound, "not_found", "upload not found")
+			case errors.Is(err, upload.ErrOffsetMismatch):
+				setUploadHeaders(w, info)
+				WriteError(w, http.StatusConflict, "offset_mismatch", "Upload-Offset doesn't match the received bytes")
+			case errors.Is(err, upload.ErrBusy):
+				WriteError(w, http.StatusConflict, "upload_busy", "another append is in progress")
+			case errors.Is(err, upload.ErrTooLarge):
+				WriteError(w, http.StatusRequestEntityTooLarge, "payload_too_large", "upload exceeds the maximum size")
+			default:
+				logger.Warn("cannot append upload", "upload", id, "error", err)
+				// the whole chunks read before the failure were kept.
+				if info.ID != "" {
+					setUploadHeaders(w, info)
+				}
+				WriteError(w, http.StatusBadRequest, "bad_request", "cannot read request body")
+			}
+			return
+		}
+
+		if !info.Complete() {
+			setUploadHeaders(w, info)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		rc, err := uploads.Open(info.ID)
+		if err != nil {
+			logger.Error("cannot open upload", "upload", info.ID, "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		defer rc.Close()
+
+		obj, err := putObject(r.Context(), st, key, crypto.ContentIDKey(idSecret, info.Owner), rc, m)
+		if err != nil {
+			logger.Error("cannot store object", "upload", info.ID, "error", err)
+			writeStoreError(w, err)
+			return
+		}
+		md := Metadata{Size: obj.Size, CreatedAt: time.Now().UTC(), Owner: info.Owner}
+		if err := putMetadata(r.Context(), metas, key, obj.ID, md); err != nil {
+			logger.Error("cannot store metadata", "id", obj.ID, "error", err)
+			writeStoreError(w, err)
+			return
+		}
+		if err := indexObject(r.Context(), index, info.Owner, obj.ID); err != nil {
+			logger.Error("cannot index object", "id", obj.ID, "error", err)
+			writeStoreError(w, err)
+			return
+		}
+		if err := uploads.Delete(info.ID); err != nil {
+			logger.Warn("cannot delete finished upload", "upload", info.ID, "error", err)
+		}
+
+		recordAudit(r.Context(), AuditEvent{Action: AuditWrite, ObjectID: obj.ID, Detail: "upload " + info.ID})
+		setUploadHeaders(w, info)
+		WriteJSON(w, http.StatusCreated, obj)
+	}
+}
+
+// ownedUpload looks up the upload named by the id path value, replying 404
+// when it doesn't exist or belongs to another identity.
+func ownedUpload(w http.ResponseWriter, r *http.Request, uploads *upload.Store, logger log.Logger) (upload.Info, bool) {
+	info, err := uploads.Stat(r.PathValue("id"))
+	if err != nil {
+		if errors.Is(err, upload.ErrNotFound) {
+			WriteError(w, http.StatusNotFound, "not_found", "upload not found")
+			return upload.Info{}, false
+		}
+		logger.WithContext(r.Context()).Error("cannot stat upload", "error", err)
+		WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+		return upload.Info{}, false
+	}
+	if identity, _ := IdentityFromContext(r.Context()); identity.Subject != info.Owner {
+		WriteError(w, http.StatusNotFound, "not_found", "upload not found")
+		return upload.Info{}, false
+	}
+	return info, true
+}
+
+func setUploadHeaders(w http.ResponseWriter, info upload.Info) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func writeUpload(w http.ResponseWriter, status int, info upload.Info) {
+	setUploadHeaders(w, info)
+	WriteJSON(w, status, uploadResponse{ID: info.ID, Offset: info.Offset, Length: info.Length})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+)
+
+func TestResumableUpload(t *testing.T) {
+	ts := newTestServer(t)
+	content := "hello resumable world"
+	w := ts.do(http.MethodPost, "/uploads", aliceToken, nil, "Upload-Length", "21")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	var up uploadResponse
+	decodeBody(t, w, &up)
+	if w.Header().Get("Location") != "/uploads/"+up.ID || up.Length != 21 {
+		t.Fatalf("create = %+v, Location %q", up, w.Header().Get("Location"))
+	}
+	patch := func(token, offset, body string) *httptest.ResponseRecorder {
+		return ts.do(http.MethodPatch, "/uploads/"+up.ID, token, strings.NewReader(body), "Upload-Offset", offset)
+	}
+
+	if w := patch(aliceToken, "0", content[:6]); w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("first append: status %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	w = patch(aliceToken, "3", content[3:])
+	if w.Code != http.StatusConflict || errorCode(t, w) != "offset_mismatch" {
+		t.Fatalf("append at a stale offset: status %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Upload-Offset") != "6" {
+		t.Errorf("conflict reports offset %q, want 6", w.Header().Get("Upload-Offset"))
+	}
+	if w := patch(bobToken, "6", content[6:]); w.Code != http.StatusNotFound {
+		t.Fatalf("append by another user: status %d, want 404", w.Code)
+	}
+
+	// the client asks where to resume from.
+	w = ts.do(http.MethodHead, "/uploads/"+up.ID, aliceToken, nil)
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "6" {
+		t.Fatalf("status: %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	w = patch(aliceToken, "6", content[6:])
+	if w.Code != http.StatusCreated {
+		t.Fatalf("final append: status %d: %s", w.Code, w.Body)
+	}
+	var obj objectResponse
+	decodeBody(t, w, &obj)
+
+	w = ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil)
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Fatalf("download: status %d, body %q", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodHead, "/uploads/"+up.ID, aliceToken, nil); w.Code != http.StatusNotFound {
+		t.Errorf("finished upload: status %d, want 404", w.Code)
+	}
+}
+
+// TestResumableUploadInterrupted breaks the body of an append partway and
+// resumes from the offset of the reply.
+func TestResumableUploadInterrupted(t *testing.T) {
+	ts := newTestServer(t)
+	content := strings.Repeat("interrupted ", 3*crypto.ChunkSize/12)
+	w := ts.do(http.MethodPost, "/uploads", aliceToken, nil, "Upload-Length", strconv.Itoa(len(content)))
+	var up uploadResponse
+	decodeBody(t, w, &up)
+
+	body := io.MultiReader(strings.NewReader(content[:2*crypto.ChunkSize+10]), iotest.ErrReader(io.ErrUnexpectedEOF))
+	w = ts.do(http.MethodPatch, "/uploads/"+up.ID, aliceToken, body, "Upload-Offset", "0")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("broken append: status %d, want 400: %s", w.Code, w.Body)
+	}
+	offset, _ := strconv.Atoi(w.Header().Get("Upload-Offset"))
+	if offset <= 0 || offset > 2*crypto.ChunkSize+10 {
+		t.Fatalf("broken append reports offset %q, want the bytes kept", w.Header().Get("Upload-Offset"))
+	}
+
+	w = ts.do(http.MethodPatch, "/uploads/"+up.ID, aliceToken, strings.NewReader(content[offset:]), "Upload-Offset", strconv.Itoa(offset))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("resumed append: status %d: %s", w.Code, w.Body)
+	}
+	var obj objectResponse
+	decodeBody(t, w, &obj)
+	if w := ts.do(http.MethodGet, "/objects/"+obj.ID, aliceToken, nil); w.Body.String() != content {
+		t.Fatalf("download: %d bytes, want %d", w.Body.Len(), len(content))
+	}
+}
+
+func TestCreateUploadInvalid(t *testing.T) {
+	ts := newTestServer(t, "LATTICE_MAX_UPLOAD_BYTES=100")
+	for length, status := range map[string]int{"": 400, "-1": 400, "x": 400, "101": 413} {
+		if w := ts.do(http.MethodPost, "/uploads", aliceToken, nil, "Upload-Length", length); w.Code != status {
+			t.Errorf("Upload-Length %q: status %d, want %d", length, w.Code, status)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+	"github.com/josestg/e2eefs/internal/log"
+	"github.com/josestg/e2eefs/internal/store"
+)
+
+// verifyResponse summarizes the integrity check of an object. Size counts
+// the plaintext bytes that passed the check. FailedChunk is the index of the
+// first chunk that failed, set only when OK is false and the failure is in a
+// chunk rather than the header.
+type verifyResponse struct {
+	ID          string  `json:"id"`
+	OK          bool    `json:"ok"`
+	Size        int64   `json:"size"`
+	FailedChunk *uint64 `json:"failed_chunk,omitempty"`
+	Reason      string  `json:"reason,omitempty"`
+}
+
+// handleVerify decrypts the object named by the id path value and discards
+// the plaintext, checking the authentication tag of every chunk. The object
+// is streamed, so the check runs in constant memory. It replies 200 when
+// every chunk is intact and 422 naming the first chunk that is not. Only the
+// owner of an object, or an admin, may verify it.
+func handleVerify(st, metas Store, key [32]byte, admins []string, logger log.Logger) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := logger.WithContext(r.Context())
+		id := r.PathValue("id")
+
+		if !ownsObject(w, r, metas, key, id, isAdmin(r.Context(), admins), logger) {
+			return
+		}
+
+		rc, err := st.Get(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrInvalidID) {
+				WriteError(w, http.StatusNotFound, "not_found", "object not found")
+				return
+			}
+			logger.Error("cannot open object", "id", id, "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+			return
+		}
+		defer rc.Close()
+
+		resp := verifyResponse{ID: id}
+		dec, err := crypto.NewDecryptReader(rc, key)
+		if err == nil {
+			resp.Size, err = io.Copy(io.Discard, dec)
+		}
+		var chunkErr *crypto.ChunkError
+		switch {
+		case err == nil:
+			resp.OK = true
+			WriteJSON(w, http.StatusOK, resp)
+		case errors.As(err, &chunkErr):
+			logger.Warn("object failed verification", "id", id, "chunk", chunkErr.Index, "error", err)
+			resp.FailedChunk, resp.Reason = &chunkErr.Index, chunkErr.Err.Error()
+			WriteJSON(w, http.StatusUnprocessableEntity, resp)
+		case errors.Is(err, crypto.ErrTruncated), errors.Is(err, crypto.ErrUnknownFormat), errors.Is(err, crypto.ErrWrongKey):
+			logger.Warn("object failed verification", "id", id, "error", err)
+			resp.Reason = err.Error()
+			WriteJSON(w, http.StatusUnprocessableEntity, resp)
+		default:
+			logger.Error("cannot verify object", "id", id, "error", err)
+			WriteError(w, http.StatusInternalServerError, "internal", "internal server error")
+		}
+	}
+}
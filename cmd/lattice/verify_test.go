@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+)
+
+// corrupt rewrites the ciphertext of the object id, as stored, with mutate.
+func (ts *testServer) corrupt(id string, mutate func([]byte) []byte) {
+	ts.t.Helper()
+	ctx := context.Background()
+	rc, err := ts.store.Get(ctx, id)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if err := ts.store.Put(ctx, id, bytes.NewReader(mutate(b))); err != nil {
+		ts.t.Fatal(err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ts := newTestServer(t)
+	plain := make([]byte, 3*crypto.ChunkSize+10)
+	rand.Read(plain)
+	obj := ts.upload(aliceToken, string(plain))
+
+	w := ts.do(http.MethodPost, "/objects/"+obj.ID+"/verify", aliceToken, nil)
+	var resp verifyResponse
+	decodeBody(t, w, &resp)
+	if w.Code != http.StatusOK || !resp.OK || resp.Size != int64(len(plain)) || resp.FailedChunk != nil {
+		t.Fatalf("intact object: %d %+v", w.Code, resp)
+	}
+
+	// chunks 0 to 2 are full, the last byte of chunk 2 comes right before
+	// the sealed final chunk of 10 bytes.
+	const tag = 16
+	ts.corrupt(obj.ID, func(b []byte) []byte {
+		b[len(b)-(10+tag)-1] ^= 1
+		return b
+	})
+	w = ts.do(http.MethodPost, "/objects/"+obj.ID+"/verify", aliceToken, nil)
+	resp = verifyResponse{}
+	decodeBody(t, w, &resp)
+	if w.Code != http.StatusUnprocessableEntity || resp.OK || resp.FailedChunk == nil || *resp.FailedChunk != 2 {
+		t.Fatalf("corrupted chunk 2: %d %s", w.Code, w.Body)
+	}
+	if resp.Size != 2*crypto.ChunkSize || resp.Reason == "" {
+		t.Errorf("corrupted chunk 2: size %d reason %q, want the 2 chunks before it", resp.Size, resp.Reason)
+	}
+}
+
+func TestVerifyDamagedStream(t *testing.T) {
+	for name, mutate := range map[string]func([]byte) []byte{
+		"header":    func(b []byte) []byte { b[0] ^= 1; return b },
+		"truncated": func(b []byte) []byte { return b[:len(b)-1] },
+		"final cut": func(b []byte) []byte { return b[:len(b)-(10+16)] },
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestServer(t)
+			obj := ts.upload(aliceToken, string(make([]byte, crypto.ChunkSize+10)))
+			ts.corrupt(obj.ID, mutate)
+			w := ts.do(http.MethodPost, "/objects/"+obj.ID+"/verify", aliceToken, nil)
+			var resp verifyResponse
+			decodeBody(t, w, &resp)
+			if w.Code != http.StatusUnprocessableEntity || resp.OK || resp.Reason == "" {
+				t.Fatalf("got %d %s, want 422 with a reason", w.Code, w.Body)
+			}
+		})
+	}
+}
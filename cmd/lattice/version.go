@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, set at build time with
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD)"
+//
+// When commit is not set, the VCS revision embedded by the go tool is used
+// if there is one.
+var (
+	version = "dev"
+	commit  = "dev"
+)
+
+// buildInfo is the build metadata of the running binary.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+}
+
+func currentBuild() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, GoVersion: runtime.Version()}
+	if b.Commit != "dev" {
+		return b
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				b.Commit = s.Value
+			}
+		}
+	}
+	return b
+}
+
+// handleVersion replies with the build metadata. It needs no credentials, so
+// it helps debugging a deployment whose authentication is broken.
+func handleVersion() HandlerFunc {
+	b := currentBuild()
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, b)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	ts := newTestServer(t)
+	// credentials are not needed, not even checked.
+	for _, token := range []string{"", "wrong-token", aliceToken} {
+		w := ts.do(http.MethodGet, "/version", token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("token %q: status %d, want %d: %s", token, w.Code, http.StatusOK, w.Body)
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+			t.Fatal(err)
+		}
+		keys := slices.Sorted(maps.Keys(fields))
+		if !slices.Equal(keys, []string{"commit", "go_version", "version"}) {
+			t.Errorf("token %q: fields %v, want commit, go_version and version", token, keys)
+		}
+		var b buildInfo
+		decodeBody(t, w, &b)
+		if b.Version != version || b.Commit == "" || b.GoVersion != runtime.Version() {
+			t.Errorf("token %q: build %+v", token, b)
+		}
+	}
+}
+
+func TestCurrentBuildLinkerFlags(t *testing.T) {
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "v1.2.3", "abc123"
+	if b := currentBuild(); b.Version != "v1.2.3" || b.Commit != "abc123" {
+		t.Errorf("currentBuild = %+v, want the values set with -X", b)
+	}
+}
@@ -1,24 +1,57 @@
 package main
 
-import "log/slog"
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// Field is a typed key/value pair. Unlike ...any, a Field can't be misaligned
+// into a dangling key or a value without a key.
+type Field struct {
+	Key   string
+	Value slog.Value
+}
+
+func String(k, v string) Field  { return Field{Key: k, Value: slog.StringValue(v)} }
+func Int(k string, v int) Field { return Field{Key: k, Value: slog.IntValue(v)} }
+func Any(k string, v any) Field { return Field{Key: k, Value: slog.AnyValue(v)} }
 
 type Logger interface {
-	Info(message string, args ...any)
+	Info(message string, fields ...Field)
 }
 
 func New() Logger {
-	return slog.New(nil)
+	return &logger{sl: slog.New(slog.NewTextHandler(os.Stdout, nil))}
+}
+
+type logger struct {
+	sl *slog.Logger
+}
+
+func (l *logger) Info(message string, fields ...Field) {
+	ctx := context.Background()
+	if !l.sl.Enabled(ctx, slog.LevelInfo) {
+		return
+	}
+	// small inline buffer, so a handful of fields stays on the stack.
+	var buf [8]slog.Attr
+	attrs := buf[:0]
+	for _, f := range fields {
+		attrs = append(attrs, slog.Attr{Key: f.Key, Value: f.Value})
+	}
+	l.sl.LogAttrs(ctx, slog.LevelInfo, message, attrs...)
 }
 
 func main() {
 	f(12)
 	f("")
 
-	stdlog := slog.New(nil)
-	stdlog.Info("hello", [2]any{"k", "v"}) // allocation
+	stdlog := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	stdlog.Info("hello", "k", "v") // values are boxed into any
 
 	cstlog := New()
-	cstlog.Info("hello", "k", "v")
+	cstlog.Info("hello", String("k", "v"), Int("n", 1))
 }
 
 func f(x any) {
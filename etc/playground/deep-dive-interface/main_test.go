@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// anyLogger is the Logger of the playground before typed fields, taking
+// key/value pairs as ...any.
+type anyLogger interface {
+	Info(message string, args ...any)
+}
+
+// The loggers are package variables so the calls stay dynamic, the compiler
+// can't devirtualize them and prove their arguments don't escape.
+var (
+	anyLog   anyLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	fieldLog Logger    = &logger{sl: slog.New(slog.NewTextHandler(io.Discard, nil))}
+)
+
+// TestInfoAllocs checks that typed fields make one fewer allocation per call
+// than ...any: the boxed int is gone, the escaping slice is not.
+func TestInfoAllocs(t *testing.T) {
+	if race {
+		t.Skip("the race detector changes which values escape")
+	}
+	// ints below 256 are boxed without allocating, start past them.
+	k, n := "v", 1<<10
+	anyAllocs := testing.AllocsPerRun(100, func() {
+		anyLog.Info("hello", "k", k, "n", n)
+		n++
+	})
+	fieldAllocs := testing.AllocsPerRun(100, func() {
+		fieldLog.Info("hello", String("k", k), Int("n", n))
+		n++
+	})
+	if fieldAllocs != anyAllocs-1 {
+		t.Errorf("fields make %v allocations per call, ...any %v, want one fewer", fieldAllocs, anyAllocs)
+	}
+}
+
+// BenchmarkInfo compares the ...any key/value path against typed fields,
+// both called through an interface like the callers of Logger do. The values
+// are only known at run time, so ...any boxes each of them on the heap while
+// a Field holds them in a slog.Value. Either way the variadic slice escapes
+// through the dynamic call, so typed fields make one fewer allocation, not
+// none.
+func BenchmarkInfo(b *testing.B) {
+	k, n := "v", 0
+	b.Run("any", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			anyLog.Info("hello", "k", k, "n", n)
+			n++
+		}
+	})
+	b.Run("fields", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			fieldLog.Info("hello", String("k", k), Int("n", n))
+			n++
+		}
+	})
+}
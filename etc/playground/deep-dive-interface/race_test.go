@@ -0,0 +1,6 @@
+//go:build race
+
+package main
+
+// race reports whether the race detector is on, which changes what escapes.
+const race = true
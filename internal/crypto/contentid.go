@@ -0,0 +1,75 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+)
+
+// ContentID returns the hex-encoded HMAC-SHA256 of the plaintext read from r
+// under key, to be used as the ID of the object holding it. The reader is
+// streamed, never buffered.
+//
+// Unlike a plain hash of the content, the ID can't be used to confirm that
+// somebody stored a known file without knowing key. The tradeoff is that
+// identical content is only deduplicated when it is stored under the same
+// key; see ContentIDKey to scope keys per user.
+func ContentID(r io.Reader, key []byte) (string, error) {
+	mac := NewContentIDHash(key)
+	if _, err := io.Copy(mac, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// NewContentIDHash returns a hash.Hash computing the ContentID under key of
+// what is written to it, for callers that push the plaintext rather than
+// pull it. The ID is the hex encoding of its Sum.
+func NewContentIDHash(key []byte) hash.Hash {
+	return hmac.New(sha256.New, key)
+}
+
+// ContentIDKey derives the ContentID key of scope, e.g. a user, from a
+// server-wide secret. Different scopes yield unrelated IDs for the same
+// content.
+func ContentIDKey(secret []byte, scope string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("e2eefs content id\x00"))
+	mac.Write([]byte(scope))
+	return mac.Sum(nil)
+}
+
+// ErrContentMismatch is returned by the reader of NewVerifyReader when the
+// content doesn't hash back to the expected ID.
+var ErrContentMismatch = errors.New("crypto: content doesn't match its id")
+
+// NewVerifyReader returns a reader that passes r through while computing its
+// ContentID under key. Once r is exhausted, the reader returns
+// ErrContentMismatch instead of io.EOF if the ID isn't id, which catches both
+// corrupted content and content filed under the wrong ID. The bytes read
+// before the mismatch is reported can't be taken back, so callers streaming
+// them must treat the error as an integrity failure of what they sent.
+func NewVerifyReader(r io.Reader, key []byte, id string) io.Reader {
+	return &verifyReader{r: r, mac: NewContentIDHash(key), id: id}
+}
+
+type verifyReader struct {
+	r   io.Reader
+	mac hash.Hash
+	id  string
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.mac.Write(p[:n])
+	if err == io.EOF {
+		want, decErr := hex.DecodeString(v.id)
+		if decErr != nil || !hmac.Equal(v.mac.Sum(nil), want) {
+			return n, ErrContentMismatch
+		}
+	}
+	return n, err
+}
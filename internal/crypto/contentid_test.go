@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestContentID(t *testing.T) {
+	content := strings.Repeat("same file ", 10000)
+	id := func(key []byte) string {
+		t.Helper()
+		s, err := ContentID(strings.NewReader(content), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	a, b := []byte("key a"), []byte("key b")
+	if id(a) != id(a) {
+		t.Error("same content and key yield different IDs")
+	}
+	if id(a) == id(b) {
+		t.Error("same content under different keys yields the same ID")
+	}
+	sum := sha256.Sum256([]byte(content))
+	if id(a) == hex.EncodeToString(sum[:]) {
+		t.Error("the ID is the plain SHA-256 of the content")
+	}
+	if other, _ := ContentID(strings.NewReader(content+"!"), a); other == id(a) {
+		t.Error("different content under the same key yields the same ID")
+	}
+
+	h := NewContentIDHash(a)
+	h.Write([]byte(content))
+	if hex.EncodeToString(h.Sum(nil)) != id(a) {
+		t.Error("NewContentIDHash and ContentID disagree")
+	}
+	if _, err := ContentID(iotest.ErrReader(iotest.ErrTimeout), a); err != iotest.ErrTimeout {
+		t.Errorf("read error = %v, want it returned", err)
+	}
+}
+
+func TestContentIDKey(t *testing.T) {
+	secret := []byte("server secret")
+	alice, bob := ContentIDKey(secret, "alice"), ContentIDKey(secret, "bob")
+	if bytes.Equal(alice, bob) {
+		t.Error("different scopes yield the same key")
+	}
+	if !bytes.Equal(alice, ContentIDKey(secret, "alice")) {
+		t.Error("the same scope yields different keys")
+	}
+	if bytes.Equal(alice, ContentIDKey([]byte("other secret"), "alice")) {
+		t.Error("different secrets yield the same key")
+	}
+}
+
+func TestVerifyReader(t *testing.T) {
+	key := []byte("key")
+	content := strings.Repeat("verified ", 10000)
+	id, err := ContentID(strings.NewReader(content), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(NewVerifyReader(iotest.OneByteReader(strings.NewReader(content)), key, id))
+	if err != nil || string(got) != content {
+		t.Fatalf("matching content: %d bytes, %v", len(got), err)
+	}
+
+	// content filed under the ID of other content, an ID under another key
+	// and a malformed ID are all mismatches, reported only once the content
+	// is exhausted.
+	other, _ := ContentID(strings.NewReader(content+"!"), key)
+	otherKey, _ := ContentID(strings.NewReader(content), []byte("other key"))
+	for _, id := range []string{other, otherKey, "not hex"} {
+		got, err := io.ReadAll(NewVerifyReader(strings.NewReader(content), key, id))
+		if !errors.Is(err, ErrContentMismatch) {
+			t.Errorf("id %q: error %v, want ErrContentMismatch", id, err)
+		}
+		if string(got) != content {
+			t.Errorf("id %q: read %d bytes before the mismatch, want %d", id, len(got), len(content))
+		}
+	}
+}
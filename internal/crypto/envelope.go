@@ -0,0 +1,311 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotRecipient is returned by Open when none of the wrapped keys of an
+// envelope can be unwrapped with the given private key.
+var ErrNotRecipient = errors.New("crypto: not a recipient of the envelope")
+
+// envelopeInfo binds the key wrapping to this scheme and its version.
+const envelopeInfo = "e2eefs envelope v1"
+
+// PublicKey is an X25519 public key of a recipient.
+type PublicKey [32]byte
+
+// PrivateKey is an X25519 private key of a recipient.
+type PrivateKey [32]byte
+
+// GenerateKey returns a new random X25519 private key.
+func GenerateKey() (PrivateKey, error) {
+	var priv PrivateKey
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return priv, fmt.Errorf("crypto: generate key: %w", err)
+	}
+	copy(priv[:], k.Bytes())
+	return priv, nil
+}
+
+// Public returns the public key of priv.
+func (priv PrivateKey) Public() (PublicKey, error) {
+	var pub PublicKey
+	k, err := ecdh.X25519().NewPrivateKey(priv[:])
+	if err != nil {
+		return pub, fmt.Errorf("crypto: invalid private key: %w", err)
+	}
+	copy(pub[:], k.PublicKey().Bytes())
+	return pub, nil
+}
+
+// MarshalText encodes the key as base64, so manifests stay readable JSON.
+func (pub PublicKey) MarshalText() ([]byte, error) {
+	return base64.StdEncoding.AppendEncode(nil, pub[:]), nil
+}
+
+// UnmarshalText decodes a key encoded by MarshalText.
+func (pub *PublicKey) UnmarshalText(text []byte) error {
+	b, err := base64.StdEncoding.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("crypto: invalid public key: %w", err)
+	}
+	if len(b) != len(pub) {
+		return fmt.Errorf("crypto: invalid public key: got %d bytes, want %d", len(b), len(pub))
+	}
+	copy(pub[:], b)
+	return nil
+}
+
+// WrappedKey is the data key of an envelope encrypted for one recipient.
+type WrappedKey struct {
+	// Recipient is the public key the data key was wrapped for.
+	Recipient PublicKey `json:"recipient"`
+
+	// Ephemeral is the public half of the one-time key pair used to agree
+	// on the wrapping key with Recipient.
+	Ephemeral PublicKey `json:"ephemeral"`
+
+	// Key is the sealed data key.
+	Key []byte `json:"key"`
+}
+
+// Envelope is content encrypted under a random data key, together with a
+// manifest of that data key wrapped for every recipient. Recipients can be
+// added later by wrapping the data key again, the content is never
+// re-encrypted.
+type Envelope struct {
+	// Recipients is the manifest, it holds no secret and is safe to store
+	// next to the content.
+	Recipients []WrappedKey `json:"recipients"`
+
+	// Content is the ciphertext, in the format of NewEncryptWriter. SealFor
+	// encrypts lazily as Content is read.
+	Content io.Reader `json:"-"`
+}
+
+// SealFor encrypts plaintext under a new random data key and wraps that key
+// for each recipient. The plaintext is streamed as Content is read, never
+// buffered as a whole. The data key can't be recovered from the envelope
+// without the private key of a recipient.
+func SealFor(plaintext io.Reader, recipients []PublicKey) (*Envelope, error) {
+	if len(recipients) == 0 {
+		return nil, errors.New("crypto: envelope needs at least one recipient")
+	}
+	var dataKey [32]byte
+	if _, err := io.ReadFull(rand.Reader, dataKey[:]); err != nil {
+		return nil, fmt.Errorf("crypto: generate data key: %w", err)
+	}
+	// the AEAD of the stream expands its own copy of the key when it is
+	// created, so the data key isn't needed once NewEncryptWriter returns.
+	defer clear(dataKey[:])
+	env := &Envelope{Recipients: make([]WrappedKey, 0, len(recipients))}
+	for _, pub := range recipients {
+		wk, err := wrapKey(dataKey, pub)
+		if err != nil {
+			return nil, err
+		}
+		env.Recipients = append(env.Recipients, wk)
+	}
+	r := &encryptReader{src: plaintext}
+	enc, err := NewEncryptWriter(&r.buf, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	r.enc = enc
+	env.Content = r
+	return env, nil
+}
+
+// Open unwraps the data key of env with priv and returns a reader that
+// decrypts its content. It returns ErrNotRecipient if priv isn't one of the
+// recipients.
+func Open(env *Envelope, priv PrivateKey) (io.Reader, error) {
+	dataKey, err := env.dataKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	// NewDecryptReader reads the header and creates the AEAD before it
+	// returns, so the data key can be cleared right after.
+	defer clear(dataKey[:])
+	return NewDecryptReader(env.Content, dataKey)
+}
+
+// AddRecipient wraps the data key of env for pub, given the private key of
+// a current recipient. Adding a key that is already a recipient is a no-op.
+func (env *Envelope) AddRecipient(priv PrivateKey, pub PublicKey) error {
+	for _, wk := range env.Recipients {
+		if wk.Recipient == pub {
+			return nil
+		}
+	}
+	dataKey, err := env.dataKey(priv)
+	if err != nil {
+		return err
+	}
+	defer clear(dataKey[:])
+	wk, err := wrapKey(dataKey, pub)
+	if err != nil {
+		return err
+	}
+	env.Recipients = append(env.Recipients, wk)
+	return nil
+}
+
+// Rotate returns a copy of env whose data key is wrapped for newRecipients
+// only, given the private key of a current recipient. The content is shared
+// with env, not re-encrypted, so rotating the keys of a large object only
+// rewrites its manifest. env is left untouched: the caller stores the new
+// manifest and then swaps it for the old one, so a crash in between leaves
+// one of the two valid.
+func Rotate(env *Envelope, oldPriv PrivateKey, newRecipients []PublicKey) (*Envelope, error) {
+	if len(newRecipients) == 0 {
+		return nil, errors.New("crypto: envelope needs at least one recipient")
+	}
+	dataKey, err := env.dataKey(oldPriv)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(dataKey[:])
+	rotated := &Envelope{
+		Recipients: make([]WrappedKey, 0, len(newRecipients)),
+		Content:    env.Content,
+	}
+	for _, pub := range newRecipients {
+		wk, err := wrapKey(dataKey, pub)
+		if err != nil {
+			return nil, err
+		}
+		rotated.Recipients = append(rotated.Recipients, wk)
+	}
+	return rotated, nil
+}
+
+func (env *Envelope) dataKey(priv PrivateKey) ([32]byte, error) {
+	var dataKey [32]byte
+	pub, err := priv.Public()
+	if err != nil {
+		return dataKey, err
+	}
+	for _, wk := range env.Recipients {
+		if subtle.ConstantTimeCompare(wk.Recipient[:], pub[:]) != 1 {
+			continue
+		}
+		return unwrapKey(wk, priv)
+	}
+	return dataKey, ErrNotRecipient
+}
+
+// wrapKey seals dataKey under a key agreed between a new ephemeral key pair
+// and pub. The wrapping key is used exactly once, so a fixed nonce is safe.
+func wrapKey(dataKey [32]byte, pub PublicKey) (WrappedKey, error) {
+	wk := WrappedKey{Recipient: pub}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return wk, fmt.Errorf("crypto: generate ephemeral key: %w", err)
+	}
+	copy(wk.Ephemeral[:], eph.PublicKey().Bytes())
+	aead, err := wrapAEAD(eph, pub, wk)
+	if err != nil {
+		return wk, err
+	}
+	var nonce [nonceSize]byte
+	wk.Key = aead.Seal(nil, nonce[:], dataKey[:], nil)
+	return wk, nil
+}
+
+func unwrapKey(wk WrappedKey, priv PrivateKey) ([32]byte, error) {
+	var dataKey [32]byte
+	k, err := ecdh.X25519().NewPrivateKey(priv[:])
+	if err != nil {
+		return dataKey, fmt.Errorf("crypto: invalid private key: %w", err)
+	}
+	aead, err := wrapAEAD(k, wk.Ephemeral, wk)
+	if err != nil {
+		return dataKey, err
+	}
+	var nonce [nonceSize]byte
+	b, err := aead.Open(nil, nonce[:], wk.Key, nil)
+	if err != nil || len(b) != len(dataKey) {
+		return dataKey, ErrNotRecipient
+	}
+	copy(dataKey[:], b)
+	return dataKey, nil
+}
+
+// wrapAEAD derives the key wrapping cipher from the X25519 shared secret of
+// priv and peer. The ephemeral and recipient public keys of wk are mixed into
+// the derivation so the wrapped key is bound to both.
+func wrapAEAD(priv *ecdh.PrivateKey, peer PublicKey, wk WrappedKey) (cipher.AEAD, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(peer[:])
+	if err != nil {
+		return nil, fmt.Errorf("crypto: invalid public key: %w", err)
+	}
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("crypto: key agreement: %w", err)
+	}
+	salt := append(wk.Ephemeral[:], wk.Recipient[:]...)
+	key, err := hkdf.Key(sha256.New, shared, salt, envelopeInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("crypto: derive wrapping key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptReader encrypts src as it is read, so the ciphertext can be pulled
+// by a consumer instead of pushed to a writer.
+type encryptReader struct {
+	src   io.Reader
+	enc   io.WriteCloser
+	chunk []byte
+	buf   bytes.Buffer
+	done  bool
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+func (r *encryptReader) fill() error {
+	if r.chunk == nil {
+		r.chunk = make([]byte, ChunkSize)
+	}
+	n, err := io.ReadFull(r.src, r.chunk)
+	if n > 0 {
+		if _, err := r.enc.Write(r.chunk[:n]); err != nil {
+			return err
+		}
+	}
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		r.done = true
+		return r.enc.Close()
+	case err != nil:
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+func newKeyPair(t *testing.T) (PrivateKey, PublicKey) {
+	t.Helper()
+	priv, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := priv.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pub
+}
+
+func TestRotate(t *testing.T) {
+	oldPriv, oldPub := newKeyPair(t)
+	newPriv, newPub := newKeyPair(t)
+	plain := make([]byte, 3*ChunkSize+7)
+	rand.Read(plain)
+
+	env, err := SealFor(bytes.NewReader(plain), []PublicKey{oldPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(env.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &Envelope{Recipients: env.Recipients}
+	rotated, err := Rotate(manifest, oldPriv, []PublicKey{newPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Recipients) != 1 || manifest.Recipients[0].Recipient != oldPub {
+		t.Fatal("Rotate modified the envelope it was given")
+	}
+
+	// the content is stored once, only the manifest is swapped.
+	rotated.Content = bytes.NewReader(content)
+	r, err := Open(rotated, newPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatal("plaintext differs after rotation")
+	}
+	rotated.Content = bytes.NewReader(content)
+	if _, err := Open(rotated, oldPriv); !errors.Is(err, ErrNotRecipient) {
+		t.Fatalf("Open with the rotated away key = %v, want ErrNotRecipient", err)
+	}
+	if _, err := Rotate(manifest, newPriv, []PublicKey{newPub}); !errors.Is(err, ErrNotRecipient) {
+		t.Fatalf("Rotate by a non-recipient = %v, want ErrNotRecipient", err)
+	}
+}
+
+// openAll opens content, the ciphertext of a sealed envelope, with recipients
+// and priv.
+func openAll(recipients []WrappedKey, content []byte, priv PrivateKey) ([]byte, error) {
+	r, err := Open(&Envelope{Recipients: recipients, Content: bytes.NewReader(content)}, priv)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestSealForRecipients(t *testing.T) {
+	alice, alicePub := newKeyPair(t)
+	bob, bobPub := newKeyPair(t)
+	eve, _ := newKeyPair(t)
+	plain := make([]byte, ChunkSize+99)
+	rand.Read(plain)
+
+	env, err := SealFor(bytes.NewReader(plain), []PublicKey{alicePub, bobPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(env.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, plain[:64]) {
+		t.Fatal("content is not encrypted")
+	}
+	for name, priv := range map[string]PrivateKey{"alice": alice, "bob": bob} {
+		got, err := openAll(env.Recipients, content, priv)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%s: Open = %v, plaintext equal %t", name, err, bytes.Equal(got, plain))
+		}
+	}
+	if _, err := openAll(env.Recipients, content, eve); !errors.Is(err, ErrNotRecipient) {
+		t.Errorf("eve: Open = %v, want ErrNotRecipient", err)
+	}
+
+	// a wrapped key moved to another recipient doesn't open.
+	forged := slices.Clone(env.Recipients)
+	forged[0].Recipient = forged[1].Recipient
+	forged = forged[:1]
+	if _, err := openAll(forged, content, bob); !errors.Is(err, ErrNotRecipient) {
+		t.Errorf("swapped recipient: Open = %v, want ErrNotRecipient", err)
+	}
+	if _, err := SealFor(bytes.NewReader(plain), nil); err == nil {
+		t.Error("SealFor without recipients succeeded")
+	}
+}
+
+func TestAddRecipient(t *testing.T) {
+	alice, alicePub := newKeyPair(t)
+	carol, carolPub := newKeyPair(t)
+	eve, _ := newKeyPair(t)
+	env, err := SealFor(bytes.NewReader([]byte("shared later")), []PublicKey{alicePub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(env.Content)
+
+	if err := env.AddRecipient(eve, carolPub); !errors.Is(err, ErrNotRecipient) {
+		t.Fatalf("AddRecipient by a non-recipient = %v, want ErrNotRecipient", err)
+	}
+	if err := env.AddRecipient(alice, carolPub); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.AddRecipient(alice, carolPub); err != nil || len(env.Recipients) != 2 {
+		t.Fatalf("adding carol twice: %v, %d recipients", err, len(env.Recipients))
+	}
+	if got, err := openAll(env.Recipients, content, carol); err != nil || string(got) != "shared later" {
+		t.Fatalf("carol: Open = %q, %v", got, err)
+	}
+}
+
+func TestPublicKeyText(t *testing.T) {
+	_, pub := newKeyPair(t)
+	text, err := pub.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got PublicKey
+	if err := got.UnmarshalText(text); err != nil || got != pub {
+		t.Fatalf("round trip = %v, %v", got, err)
+	}
+	for _, bad := range []string{"not base64!", "AAAA"} {
+		if err := got.UnmarshalText([]byte(bad)); err == nil {
+			t.Errorf("UnmarshalText(%q): no error", bad)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// SaltSize is the size of the salt generated by DeriveKey.
+const SaltSize = 16
+
+// KDFParams tunes the cost of Argon2id.
+type KDFParams struct {
+	Time        uint32 // number of passes over the memory
+	Memory      uint32 // memory size in KiB
+	Parallelism uint8  // number of lanes
+}
+
+// DefaultKDFParams follows the second recommended option of RFC 9106.
+var DefaultKDFParams = KDFParams{
+	Time:        3,
+	Memory:      64 << 10,
+	Parallelism: 4,
+}
+
+// DeriveKey derives a key from passphrase using DefaultKDFParams.
+// See KDFParams.DeriveKey.
+func DeriveKey(passphrase, salt []byte) ([32]byte, []byte, error) {
+	return DefaultKDFParams.DeriveKey(passphrase, salt)
+}
+
+// DeriveKey derives a 32-byte key from passphrase and salt with Argon2id.
+// When salt is empty a random salt of SaltSize bytes is generated. The salt
+// used is returned and must be stored to derive the same key again.
+//
+// The intermediate buffers are wiped, but passphrase is not: the caller owns
+// it and is responsible for wiping it once done.
+func (p KDFParams) DeriveKey(passphrase, salt []byte) ([32]byte, []byte, error) {
+	var key [32]byte
+	if err := p.validate(); err != nil {
+		return key, nil, err
+	}
+	if len(salt) == 0 {
+		salt = make([]byte, SaltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return key, nil, fmt.Errorf("crypto: generate salt: %w", err)
+		}
+	}
+	out := argon2.IDKey(passphrase, salt, p.Time, p.Memory, p.Parallelism, uint32(len(key)))
+	copy(key[:], out)
+	clear(out)
+	return key, salt, nil
+}
+
+func (p KDFParams) validate() error {
+	switch {
+	case p.Time < 1:
+		return errors.New("crypto: kdf time must be at least 1")
+	case p.Parallelism < 1:
+		return errors.New("crypto: kdf parallelism must be at least 1")
+	case p.Memory < 8*uint32(p.Parallelism):
+		return errors.New("crypto: kdf memory must be at least 8 KiB per lane")
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// fastKDF keeps the tests quick, the cost doesn't change the properties.
+var fastKDF = KDFParams{Time: 1, Memory: 64, Parallelism: 1}
+
+func TestDeriveKey(t *testing.T) {
+	pass := []byte("correct horse battery staple")
+	salt := bytes.Repeat([]byte{7}, SaltSize)
+
+	k1, s1, err := fastKDF.DeriveKey(pass, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s1, salt) {
+		t.Errorf("salt = %x, want the one given", s1)
+	}
+	k2, _, err := fastKDF.DeriveKey(pass, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 != k2 {
+		t.Error("same passphrase and salt derived different keys")
+	}
+	k3, _, err := fastKDF.DeriveKey(pass, bytes.Repeat([]byte{8}, SaltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 == k3 {
+		t.Error("different salts derived the same key")
+	}
+	k4, _, err := fastKDF.DeriveKey([]byte("another passphrase"), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 == k4 {
+		t.Error("different passphrases derived the same key")
+	}
+	slow := fastKDF
+	slow.Time++
+	if k5, _, _ := slow.DeriveKey(pass, salt); k1 == k5 {
+		t.Error("different parameters derived the same key")
+	}
+}
+
+func TestDeriveKeyRandomSalt(t *testing.T) {
+	pass := []byte("passphrase")
+	k1, s1, err := fastKDF.DeriveKey(pass, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s1) != SaltSize {
+		t.Fatalf("generated salt of %d bytes, want %d", len(s1), SaltSize)
+	}
+	k2, s2, err := fastKDF.DeriveKey(pass, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(s1, s2) || k1 == k2 {
+		t.Error("two derivations without salt generated the same salt")
+	}
+	if k, _, _ := fastKDF.DeriveKey(pass, s1); k != k1 {
+		t.Error("the returned salt doesn't derive the same key again")
+	}
+}
+
+func TestKDFParamsValidate(t *testing.T) {
+	for _, p := range []KDFParams{
+		{Time: 0, Memory: 64, Parallelism: 1},
+		{Time: 1, Memory: 64, Parallelism: 0},
+		{Time: 1, Memory: 15, Parallelism: 2},
+	} {
+		if _, _, err := p.DeriveKey([]byte("p"), nil); err == nil {
+			t.Errorf("%+v: no error", p)
+		}
+	}
+}
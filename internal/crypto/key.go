@@ -0,0 +1,101 @@
+package crypto
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// ErrKeyWiped is returned when a Key is used after it was wiped.
+var ErrKeyWiped = errors.New("crypto: key wiped")
+
+// Key holds secret key material in a single buffer that is never copied by
+// this package. Keys should be reached through Use and dropped with Wipe
+// rather than copied into values, which Go may duplicate and leave behind
+// in memory.
+type Key struct {
+	mu     sync.Mutex
+	b      []byte
+	locked bool
+	wiped  bool
+}
+
+// NewKey returns a Key that takes ownership of b. The caller must not keep
+// or use b afterwards, it is zeroed by Wipe.
+func NewKey(b []byte) *Key {
+	return &Key{b: b}
+}
+
+// Lock prevents the key from being swapped to disk with mlock. It is a no-op
+// on platforms without mlock. It fails when the process can't lock more
+// memory, e.g. RLIMIT_MEMLOCK is reached, which callers may ignore at the
+// cost of the key being swappable.
+func (k *Key) Lock() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.wiped {
+		return ErrKeyWiped
+	}
+	if k.locked || len(k.b) == 0 {
+		return nil
+	}
+	if err := mlock(k.b); err != nil {
+		return err
+	}
+	k.locked = true
+	return nil
+}
+
+// Locked reports whether the key memory is locked.
+func (k *Key) Locked() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.locked
+}
+
+// Use calls fn with the key bytes and wipes the key when fn returns, for key
+// material that is only needed once, e.g. a derived key. fn must not retain
+// the slice.
+func (k *Key) Use(fn func([]byte) error) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.wiped {
+		return ErrKeyWiped
+	}
+	defer k.wipe()
+	return fn(k.b)
+}
+
+// With calls fn with the key bytes and keeps the key, for key material that
+// is needed more than once. fn must not retain the slice.
+func (k *Key) With(fn func([]byte) error) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.wiped {
+		return ErrKeyWiped
+	}
+	return fn(k.b)
+}
+
+// Wipe zeroes the key and unlocks its memory. Wiping a wiped key is a no-op.
+func (k *Key) Wipe() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.wipe()
+}
+
+func (k *Key) wipe() {
+	if k.wiped {
+		return
+	}
+	clear(k.b)
+	// keep the buffer reachable until it is cleared, so the zeroing can't be
+	// dropped as a dead store.
+	runtime.KeepAlive(k.b)
+	if k.locked {
+		// the key is already zeroed, an unlock failure leaves nothing behind.
+		_ = munlock(k.b)
+		k.locked = false
+	}
+	k.wiped = true
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package crypto
+
+// mlock is not supported on this platform, keys stay swappable.
+func mlock([]byte) error   { return nil }
+func munlock([]byte) error { return nil }
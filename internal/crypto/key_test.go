@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKeyWipe(t *testing.T) {
+	b := bytes.Repeat([]byte{0xaa}, 32)
+	k := NewKey(b)
+	k.Wipe()
+	// b is the buffer the Key owns, Wipe must zero it in place.
+	if !bytes.Equal(b, make([]byte, 32)) {
+		t.Fatalf("buffer after Wipe = %x, want zeros", b)
+	}
+	if err := k.With(func([]byte) error { return nil }); !errors.Is(err, ErrKeyWiped) {
+		t.Errorf("With after Wipe = %v, want ErrKeyWiped", err)
+	}
+	if err := k.Use(func([]byte) error { return nil }); !errors.Is(err, ErrKeyWiped) {
+		t.Errorf("Use after Wipe = %v, want ErrKeyWiped", err)
+	}
+	if err := k.Lock(); !errors.Is(err, ErrKeyWiped) {
+		t.Errorf("Lock after Wipe = %v, want ErrKeyWiped", err)
+	}
+	k.Wipe()
+}
+
+func TestKeyUse(t *testing.T) {
+	b := bytes.Repeat([]byte{0x55}, 32)
+	k := NewKey(b)
+	fail := errors.New("fail")
+	err := k.Use(func(key []byte) error {
+		if !bytes.Equal(key, bytes.Repeat([]byte{0x55}, 32)) {
+			t.Errorf("Use got %x", key)
+		}
+		return fail
+	})
+	if err != fail {
+		t.Errorf("Use = %v, want the error of fn", err)
+	}
+	// Use wipes even when fn fails.
+	if !bytes.Equal(b, make([]byte, 32)) {
+		t.Fatalf("buffer after Use = %x, want zeros", b)
+	}
+}
+
+func TestKeyWith(t *testing.T) {
+	b := bytes.Repeat([]byte{0x11}, 32)
+	k := NewKey(b)
+	for range 2 {
+		if err := k.With(func(key []byte) error {
+			if key[0] != 0x11 {
+				t.Errorf("With got %x", key)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k.Wipe()
+	if !bytes.Equal(b, make([]byte, 32)) {
+		t.Fatalf("buffer after Wipe = %x, want zeros", b)
+	}
+}
+
+func TestKeyLock(t *testing.T) {
+	k := NewKey(bytes.Repeat([]byte{1}, 32))
+	if err := k.Lock(); err != nil {
+		// RLIMIT_MEMLOCK may be too low in the test environment.
+		t.Skipf("cannot mlock: %v", err)
+	}
+	if err := k.Lock(); err != nil {
+		t.Fatalf("second Lock = %v", err)
+	}
+	k.Wipe()
+	if k.Locked() {
+		t.Error("key still locked after Wipe")
+	}
+}
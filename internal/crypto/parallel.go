@@ -0,0 +1,125 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"io"
+	"slices"
+)
+
+// parallelEncryptWriter seals up to n chunks concurrently. Every chunk is
+// sealed on a goroutine of its own, and the sealed chunks are written out in
+// stream order by Write and Close, so the pending list acts as the reorder
+// buffer and bounds the chunks in flight. No goroutine outlives the chunk it
+// seals, so a writer abandoned without Close, like one of an aborted upload,
+// leaves nothing running behind.
+type parallelEncryptWriter struct {
+	dst       io.Writer
+	aead      cipher.AEAD
+	base      []byte
+	aad       []byte
+	chunkSize int
+	n         int
+	counter   uint64
+	buf       []byte
+	err       error
+
+	pending []*sealJob
+	free    [][]byte
+}
+
+// sealJob is a chunk being sealed, done is closed once sealed holds its
+// ciphertext.
+type sealJob struct {
+	sealed []byte
+	done   chan struct{}
+}
+
+func newParallelEncryptWriter(dst io.Writer, aead cipher.AEAD, h header, n int) *parallelEncryptWriter {
+	return &parallelEncryptWriter{
+		dst:       dst,
+		aead:      aead,
+		base:      h.nonce,
+		aad:       h.aad(),
+		chunkSize: h.chunkSize,
+		n:         n,
+		buf:       make([]byte, 0, h.chunkSize+tagSize),
+	}
+}
+
+func (w *parallelEncryptWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	total := len(p)
+	for len(p) > 0 {
+		// like encryptWriter, a full buffer is only sealed once more data
+		// arrives, so the final chunk is never empty unless the stream is.
+		if len(w.buf) == w.chunkSize {
+			if err := w.submit(false); err != nil {
+				return total - len(p), err
+			}
+		}
+		n := copy(w.buf[len(w.buf):w.chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// submit starts sealing the buffered chunk, writing out the oldest pending
+// chunk first when n of them are in flight.
+func (w *parallelEncryptWriter) submit(final bool) error {
+	if len(w.pending) == w.n {
+		if err := w.writeOldest(); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	// the AEADs keep no state between calls, so the goroutines share aead.
+	aead, buf, j := w.aead, w.buf, &sealJob{done: make(chan struct{})}
+	nonce := chunkNonce(make([]byte, len(w.base)), w.base, w.counter)
+	aad := chunkAAD(slices.Clone(w.aad), w.counter, final)
+	go func() {
+		j.sealed = aead.Seal(buf[:0], nonce, buf, aad)
+		close(j.done)
+	}()
+	w.pending = append(w.pending, j)
+	w.counter++
+	if k := len(w.free); k > 0 {
+		w.buf, w.free = w.free[k-1], w.free[:k-1]
+	} else {
+		w.buf = make([]byte, 0, w.chunkSize+tagSize)
+	}
+	return nil
+}
+
+// writeOldest waits for the oldest pending chunk to be sealed and writes it
+// to dst, keeping its buffer for a later chunk.
+func (w *parallelEncryptWriter) writeOldest() error {
+	j := w.pending[0]
+	w.pending = append(w.pending[:0], w.pending[1:]...)
+	<-j.done
+	_, err := w.dst.Write(j.sealed)
+	w.free = append(w.free, j.sealed[:0])
+	return err
+}
+
+func (w *parallelEncryptWriter) Close() error {
+	if w.err != nil {
+		if w.err == errClosed {
+			return nil
+		}
+		return w.err
+	}
+	if err := w.submit(true); err != nil {
+		return err
+	}
+	for len(w.pending) > 0 {
+		if err := w.writeOldest(); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	w.err = errClosed
+	return nil
+}
@@ -0,0 +1,134 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParallelEncryptWriter(t *testing.T) {
+	var key [32]byte
+	rand.Read(key[:])
+	plain := make([]byte, 10*MinChunkSize+123)
+	rand.Read(plain)
+
+	for _, n := range []int{2, 3, 8} {
+		for _, size := range []int{0, 1, MinChunkSize, 4 * MinChunkSize, len(plain)} {
+			var buf bytes.Buffer
+			w, err := NewEncryptWriter(&buf, key, WithChunkSize(MinChunkSize), WithParallelism(n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// odd sized writes cross the chunk boundaries.
+			for p := plain[:size]; len(p) > 0; {
+				k := min(len(p), 1000)
+				if _, err := w.Write(p[:k]); err != nil {
+					t.Fatal(err)
+				}
+				p = p[k:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewDecryptReader(&buf, key)
+			if err != nil {
+				t.Fatalf("n=%d size=%d: %v", n, size, err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("n=%d size=%d: %v", n, size, err)
+			}
+			if !bytes.Equal(got, plain[:size]) {
+				t.Fatalf("n=%d size=%d: plaintext differs", n, size)
+			}
+		}
+	}
+}
+
+type failingWriter struct{ n int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("disk full")
+	}
+	w.n--
+	return len(p), nil
+}
+
+func TestParallelEncryptWriterWriteError(t *testing.T) {
+	var key [32]byte
+	// the header and the first chunk go through.
+	w, err := NewEncryptWriter(&failingWriter{n: 2}, key, WithChunkSize(MinChunkSize), WithParallelism(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := make([]byte, MinChunkSize)
+	var werr error
+	for range 10 {
+		if _, werr = w.Write(chunk); werr != nil {
+			break
+		}
+	}
+	if err := w.Close(); err == nil || (werr != nil && err != werr) {
+		t.Fatalf("Close = %v after Write = %v, want the write error", err, werr)
+	}
+}
+
+func TestParallelEncryptWriterAbandoned(t *testing.T) {
+	var key [32]byte
+	before := runtime.NumGoroutine()
+	for range 10 {
+		w, err := NewEncryptWriter(io.Discard, key, WithChunkSize(MinChunkSize), WithParallelism(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// abandoned mid-stream, without Close, like an aborted upload.
+		w.Write(make([]byte, 20*MinChunkSize))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkEncrypt256MiB compares serial and parallel encryption of a
+// 256 MiB stream.
+func BenchmarkEncrypt256MiB(b *testing.B) {
+	const size = 256 << 20
+	var key [32]byte
+	block := make([]byte, 1<<20)
+	rand.Read(block)
+
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"serial", nil},
+		{"parallel", []Option{WithParallelism(runtime.GOMAXPROCS(0))}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for b.Loop() {
+				w, err := NewEncryptWriter(io.Discard, key, bc.opts...)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for range size / len(block) {
+					if _, err := w.Write(block); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"fmt"
+)
+
+// sessionInfo binds session keys to this scheme and its version.
+const sessionInfo = "e2eefs session v1"
+
+// SessionKey derives the key of a session agreed with X25519 between priv and
+// peer, the public key of the other party. Both parties get the same key, each
+// from its own private key and the public key of the other: the two public
+// keys are mixed into the derivation in a fixed order, whichever side
+// initiated the exchange. priv should be ephemeral, so a leaked key only
+// exposes its own session.
+func SessionKey(priv PrivateKey, peer PublicKey) ([32]byte, error) {
+	var key [32]byte
+	k, err := ecdh.X25519().NewPrivateKey(priv[:])
+	if err != nil {
+		return key, fmt.Errorf("crypto: invalid private key: %w", err)
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(peer[:])
+	if err != nil {
+		return key, fmt.Errorf("crypto: invalid public key: %w", err)
+	}
+	shared, err := k.ECDH(peerKey)
+	if err != nil {
+		return key, fmt.Errorf("crypto: key agreement: %w", err)
+	}
+	defer clear(shared)
+
+	own := k.PublicKey().Bytes()
+	salt := append(own, peer[:]...)
+	if bytes.Compare(own, peer[:]) > 0 {
+		salt = append(peer[:], own...)
+	}
+	b, err := hkdf.Key(sha256.New, shared, salt, sessionInfo, len(key))
+	if err != nil {
+		return key, fmt.Errorf("crypto: derive session key: %w", err)
+	}
+	copy(key[:], b)
+	clear(b)
+	return key, nil
+}
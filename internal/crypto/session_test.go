@@ -0,0 +1,34 @@
+package crypto
+
+import "testing"
+
+func TestSessionKey(t *testing.T) {
+	client, clientPub := newKeyPair(t)
+	server, serverPub := newKeyPair(t)
+
+	a, err := SessionKey(client, serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SessionKey(server, clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("the two sides derive different session keys")
+	}
+
+	other, _ := newKeyPair(t)
+	c, err := SessionKey(other, serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == a {
+		t.Error("another client derives the same session key")
+	}
+
+	// the all zero point is of low order, the shared secret would be zero.
+	if _, err := SessionKey(client, PublicKey{}); err == nil {
+		t.Error("SessionKey with a low order public key succeeded")
+	}
+}
@@ -0,0 +1,610 @@
+// Package crypto implements the encryption primitives used to store files.
+//
+// Content is encrypted as a stream of fixed-size chunks with AES-256-GCM, or
+// XChaCha20-Poly1305 when selected with WithAlgorithm. The stream starts
+// with a header made of a magic string, a format version, the algorithm, the
+// chunk size, a random base nonce and a key check, a MAC of the rest of the
+// header under the key which tells a wrong key from a modified chunk.
+// Streams of version 1 have no chunk size in their header and always use
+// 64 KiB chunks, streams of version 1 and 2 have no algorithm and always use
+// AES-256-GCM, and streams before version 4 have no key check. Every chunk
+// is sealed with its own nonce derived from the base nonce and the chunk
+// index, so each chunk carries its own authentication tag. The additional
+// data of a chunk binds the header, any data given with WithAssociatedData,
+// the chunk index and whether it is the last chunk, so a reordered chunk or a stream whose trailing chunks were
+// dropped fails authentication. Every chunk but the last has the same sealed
+// size, so a plaintext range maps to a known ciphertext range and can be
+// decrypted without reading the chunks before it.
+package crypto
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ChunkSize is the default size of a plaintext chunk, and the size of the
+// chunks of version 1 streams.
+const ChunkSize = 64 << 10
+
+// MinChunkSize and MaxChunkSize bound the sizes accepted by WithChunkSize.
+const (
+	MinChunkSize = 4 << 10
+	MaxChunkSize = 16 << 20
+)
+
+const (
+	nonceSize  = 12
+	xNonceSize = chacha20poly1305.NonceSizeX
+	tagSize    = 16
+	checkSize  = 16
+
+	// version1 streams have no chunk size in their header.
+	version1 = 1
+	// version2 streams have no algorithm in their header.
+	version2 = 2
+	// version3 streams have no key check in their header.
+	version3 = 3
+	// version is the format version written by NewEncryptWriter.
+	version = 4
+
+	// maxHeaderSize is the size of magic, version, algorithm, chunk size,
+	// the longest base nonce and the key check.
+	maxHeaderSize = len(magic) + 1 + 1 + 4 + xNonceSize + checkSize
+
+	// aadTrailer is the size of the chunk index and final flag that follow
+	// the header in the additional data of a chunk.
+	aadTrailer = 8 + 1
+)
+
+// magic starts every encrypted stream.
+const magic = "E2EF"
+
+// checkLabel separates the key check from other uses of the key.
+const checkLabel = "e2eefs key check v1"
+
+var (
+	// ErrAuthFailed is returned when a chunk fails its authentication check,
+	// meaning the ciphertext was modified, or for streams with no key check
+	// that the key is wrong.
+	ErrAuthFailed = errors.New("crypto: chunk authentication failed")
+
+	// ErrWrongKey is returned when the key check of a stream doesn't match
+	// the key, meaning the stream was encrypted with another key.
+	ErrWrongKey = errors.New("crypto: wrong key")
+
+	// ErrTruncated is returned when the stream ends before its final chunk.
+	ErrTruncated = errors.New("crypto: ciphertext truncated")
+
+	// ErrUnknownFormat is returned when a stream doesn't start with the
+	// expected magic, or uses a format version or algorithm this package
+	// can't read.
+	ErrUnknownFormat = errors.New("crypto: unknown format")
+)
+
+// ChunkError reports the chunk of a stream that failed to decrypt. Err is
+// ErrAuthFailed or ErrTruncated.
+type ChunkError struct {
+	Index uint64
+	Err   error
+}
+
+func (e *ChunkError) Error() string { return fmt.Sprintf("%s: chunk %d", e.Err, e.Index) }
+
+func (e *ChunkError) Unwrap() error { return e.Err }
+
+// Algorithm is the AEAD sealing the chunks of a stream.
+type Algorithm byte
+
+const (
+	// AES256GCM is the default, fast on platforms with AES instructions. Its
+	// 96-bit random base nonce makes collisions a concern only after about
+	// 2^32 streams under the same key.
+	AES256GCM Algorithm = 1
+
+	// XChaCha20Poly1305 has a 192-bit random base nonce, so streams under
+	// the same key can't practically collide, and is fast in software on
+	// platforms without AES instructions.
+	XChaCha20Poly1305 Algorithm = 2
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case AES256GCM:
+		return "AES-256-GCM"
+	case XChaCha20Poly1305:
+		return "XChaCha20-Poly1305"
+	}
+	return fmt.Sprintf("Algorithm(%d)", byte(a))
+}
+
+func (a Algorithm) valid() bool { return a == AES256GCM || a == XChaCha20Poly1305 }
+
+// nonceSize returns the size of the nonces of a.
+func (a Algorithm) nonceSize() int {
+	if a == XChaCha20Poly1305 {
+		return xNonceSize
+	}
+	return nonceSize
+}
+
+// Option configures NewEncryptWriter. Only WithAssociatedData applies to
+// NewDecryptReader, the other settings are read from the header.
+type Option func(*options)
+
+type options struct {
+	parallelism int
+	chunkSize   int
+	algorithm   Algorithm
+	ad          []byte
+}
+
+// WithAlgorithm sets the AEAD sealing the chunks, AES256GCM by default. The
+// algorithm is stored in the header, so readers need no option.
+func WithAlgorithm(a Algorithm) Option {
+	return func(o *options) { o.algorithm = a }
+}
+
+// WithChunkSize sets the plaintext size of the chunks. It must be a power of
+// two between MinChunkSize and MaxChunkSize. Small chunks waste less on tags
+// for small objects and make ranges cheaper, large ones go faster through
+// big objects. The size is stored in the header, so readers need no option.
+func WithChunkSize(n int) Option {
+	return func(o *options) { o.chunkSize = n }
+}
+
+// WithAssociatedData binds the stream to ad, which is authenticated with
+// every chunk but not stored. The stream only opens when NewDecryptReader is
+// given the same ad, so a stream moved to where other data is expected fails
+// with ErrAuthFailed.
+func WithAssociatedData(ad []byte) Option {
+	return func(o *options) { o.ad = ad }
+}
+
+// WithParallelism encrypts up to n chunks concurrently, which speeds up large
+// streams on multi-core machines at the cost of about n chunks of memory.
+// The output is identical in format to the serial one and is written in
+// order. Values below 2 keep encryption serial, the default.
+func WithParallelism(n int) Option {
+	return func(o *options) { o.parallelism = n }
+}
+
+// NewEncryptWriter returns a writer that encrypts everything written to it
+// and writes the ciphertext to dst. Close must be called to flush the final
+// chunk; it does not close dst. A writer abandoned before Close leaves no
+// goroutine behind, even with WithParallelism.
+func NewEncryptWriter(dst io.Writer, key [32]byte, opts ...Option) (io.WriteCloser, error) {
+	o := options{chunkSize: ChunkSize, algorithm: AES256GCM}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !validChunkSize(o.chunkSize) {
+		return nil, fmt.Errorf("crypto: invalid chunk size %d, want a power of two in [%d, %d]", o.chunkSize, MinChunkSize, MaxChunkSize)
+	}
+	if !o.algorithm.valid() {
+		return nil, fmt.Errorf("crypto: unsupported algorithm %s", o.algorithm)
+	}
+	aead, err := newAEAD(o.algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+	h := header{version: version, algorithm: o.algorithm, chunkSize: o.chunkSize, ad: o.ad}
+	h.nonce = make([]byte, o.algorithm.nonceSize())
+	if _, err := io.ReadFull(rand.Reader, h.nonce); err != nil {
+		return nil, fmt.Errorf("crypto: generate nonce: %w", err)
+	}
+	h.check = h.keyCheck(key)
+	hdr := h.marshal()
+	if _, err := dst.Write(hdr); err != nil {
+		return nil, err
+	}
+	if o.parallelism > 1 {
+		return newParallelEncryptWriter(dst, aead, h, o.parallelism), nil
+	}
+	w := &encryptWriter{
+		dst:       dst,
+		aead:      aead,
+		base:      h.nonce,
+		nonce:     make([]byte, len(h.nonce)),
+		aad:       h.aad(),
+		chunkSize: h.chunkSize,
+		buf:       make([]byte, 0, h.chunkSize+tagSize),
+	}
+	return w, nil
+}
+
+type encryptWriter struct {
+	dst       io.Writer
+	aead      cipher.AEAD
+	base      []byte
+	nonce     []byte
+	aad       []byte
+	chunkSize int
+	counter   uint64
+	buf       []byte
+	err       error
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	total := len(p)
+	for len(p) > 0 {
+		// a full buffer is only sealed once more data arrives, so the final
+		// chunk sealed by Close is never empty unless the stream is.
+		if len(w.buf) == w.chunkSize {
+			if err := w.flush(false); err != nil {
+				return total - len(p), err
+			}
+		}
+		n := copy(w.buf[len(w.buf):w.chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (w *encryptWriter) Close() error {
+	if w.err != nil {
+		if w.err == errClosed {
+			return nil
+		}
+		return w.err
+	}
+	if err := w.flush(true); err != nil {
+		return err
+	}
+	w.err = errClosed
+	return nil
+}
+
+var errClosed = errors.New("crypto: write to closed writer")
+
+func (w *encryptWriter) flush(final bool) error {
+	nonce := chunkNonce(w.nonce, w.base, w.counter)
+	sealed := w.aead.Seal(w.buf[:0], nonce, w.buf, chunkAAD(w.aad, w.counter, final))
+	if _, err := w.dst.Write(sealed); err != nil {
+		w.err = err
+		return err
+	}
+	w.counter++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// NewDecryptReader returns a reader that decrypts the stream produced by
+// NewEncryptWriter, whatever its chunk size and algorithm. It fails with
+// ErrUnknownFormat or ErrTruncated when the header can't be read, and with
+// ErrWrongKey when the stream was encrypted with another key. Reads fail
+// with ErrAuthFailed if a chunk was modified and with ErrTruncated if the
+// stream ends before its final chunk, wrapped in a *ChunkError naming the
+// chunk. A stream sealed with WithAssociatedData needs the same option.
+func NewDecryptReader(src io.Reader, key [32]byte, opts ...Option) (io.Reader, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	h, aead, err := openHeader(src, key)
+	if err != nil {
+		return nil, err
+	}
+	h.ad = o.ad
+	return newDecryptReader(src, aead, h, 0), nil
+}
+
+// NewDecryptRangeReader returns a reader that decrypts length bytes of
+// plaintext starting at off, from a stream of size bytes produced by
+// NewEncryptWriter. Only the chunks overlapping the range are decrypted; the
+// preceding ones are skipped with Seek when src implements io.Seeker, or
+// discarded otherwise. src must be positioned at the start of the stream.
+func NewDecryptRangeReader(src io.Reader, size int64, key [32]byte, off, length int64) (io.Reader, error) {
+	h, aead, err := openHeader(src, key)
+	if err != nil {
+		return nil, err
+	}
+	plainSize, err := h.plaintextSize(size)
+	if err != nil {
+		return nil, err
+	}
+	if off < 0 || length < 0 || off+length > plainSize {
+		return nil, fmt.Errorf("crypto: range [%d, %d) out of bounds [0, %d)", off, off+length, plainSize)
+	}
+
+	chunk := int64(h.chunkSize)
+	first := off / chunk
+	skip := first * (chunk + tagSize)
+	if s, ok := src.(io.Seeker); ok {
+		_, err = s.Seek(skip, io.SeekCurrent)
+	} else {
+		_, err = io.CopyN(io.Discard, src, skip)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r := newDecryptReader(src, aead, h, uint64(first))
+	if _, err := io.CopyN(io.Discard, r, off-first*chunk); err != nil {
+		return nil, err
+	}
+	return io.LimitReader(r, length), nil
+}
+
+// PlaintextSize returns the size of the plaintext encrypted in a stream of
+// size bytes, without decrypting it. Only the header is read from src, so
+// callers that go on decrypting must rewind it.
+func PlaintextSize(src io.Reader, size int64) (int64, error) {
+	h, err := readHeader(src)
+	if err != nil {
+		return 0, err
+	}
+	return h.plaintextSize(size)
+}
+
+// header starts every encrypted stream.
+type header struct {
+	version   byte
+	algorithm Algorithm
+	chunkSize int
+	nonce     []byte
+	check     []byte
+
+	// ad is the associated data of the stream, authenticated with every
+	// chunk but not encoded.
+	ad []byte
+}
+
+// size returns the encoded size of h.
+func (h header) size() int {
+	switch h.version {
+	case version1:
+		return len(magic) + 1 + nonceSize
+	case version2:
+		return len(magic) + 1 + 4 + nonceSize
+	case version3:
+		return len(magic) + 1 + 1 + 4 + len(h.nonce)
+	}
+	return len(magic) + 1 + 1 + 4 + len(h.nonce) + checkSize
+}
+
+func (h header) marshal() []byte {
+	b := make([]byte, 0, maxHeaderSize)
+	b = append(b, magic...)
+	b = append(b, h.version)
+	if h.version >= version3 {
+		b = append(b, byte(h.algorithm))
+	}
+	if h.version != version1 {
+		b = binary.BigEndian.AppendUint32(b, uint32(h.chunkSize))
+	}
+	b = append(b, h.nonce...)
+	return append(b, h.check...)
+}
+
+// keyCheck returns the key check of h under key, a MAC of the header
+// without its key check.
+func (h header) keyCheck(key [32]byte) []byte {
+	h.check = nil
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(checkLabel))
+	mac.Write(h.marshal())
+	return mac.Sum(nil)[:checkSize]
+}
+
+// openHeader reads the header of the stream in src and returns it with the
+// AEAD opening its chunks under key, once its key check matches.
+func openHeader(src io.Reader, key [32]byte) (header, cipher.AEAD, error) {
+	h, err := readHeader(src)
+	if err != nil {
+		return h, nil, err
+	}
+	if h.version >= version && !hmac.Equal(h.check, h.keyCheck(key)) {
+		return h, nil, ErrWrongKey
+	}
+	aead, err := newAEAD(h.algorithm, key)
+	if err != nil {
+		return h, nil, err
+	}
+	return h, aead, nil
+}
+
+// aad returns a buffer for the additional data of the chunks of the stream,
+// starting with its encoded header and associated data. The size of the
+// header follows from its version and algorithm, and the trailer has a fixed
+// size, so the associated data needs no length.
+func (h header) aad() []byte {
+	b := append(h.marshal(), h.ad...)
+	return append(b, make([]byte, aadTrailer)...)
+}
+
+// plaintextSize returns the size of the plaintext in a stream of size bytes
+// starting with h.
+func (h header) plaintextSize(size int64) (int64, error) {
+	body := size - int64(h.size())
+	if body < tagSize {
+		return 0, ErrTruncated
+	}
+	sealedChunk := int64(h.chunkSize) + tagSize
+	chunks := (body + sealedChunk - 1) / sealedChunk
+	if last := body - (chunks-1)*sealedChunk; last < tagSize {
+		return 0, ErrTruncated
+	}
+	return body - chunks*tagSize, nil
+}
+
+func readHeader(src io.Reader) (header, error) {
+	var (
+		h   header
+		buf [maxHeaderSize]byte
+	)
+	if err := readFull(src, buf[:len(magic)+1]); err != nil {
+		return h, err
+	}
+	if string(buf[:len(magic)]) != magic {
+		return h, fmt.Errorf("%w: bad magic", ErrUnknownFormat)
+	}
+	h.version, h.algorithm, h.chunkSize = buf[len(magic)], AES256GCM, ChunkSize
+	if h.version < version1 || h.version > version {
+		return h, fmt.Errorf("%w: unsupported version %d", ErrUnknownFormat, h.version)
+	}
+	if h.version >= version3 {
+		if err := readFull(src, buf[:1]); err != nil {
+			return h, err
+		}
+		if h.algorithm = Algorithm(buf[0]); !h.algorithm.valid() {
+			return h, fmt.Errorf("%w: unsupported algorithm %d", ErrUnknownFormat, buf[0])
+		}
+	}
+	if h.version != version1 {
+		if err := readFull(src, buf[:4]); err != nil {
+			return h, err
+		}
+		n := binary.BigEndian.Uint32(buf[:4])
+		if !validChunkSize(int(n)) {
+			return h, fmt.Errorf("%w: invalid chunk size %d", ErrUnknownFormat, n)
+		}
+		h.chunkSize = int(n)
+	}
+	h.nonce = make([]byte, h.algorithm.nonceSize())
+	if err := readFull(src, h.nonce); err != nil {
+		return h, err
+	}
+	if h.version >= version {
+		h.check = make([]byte, checkSize)
+		if err := readFull(src, h.check); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// readFull is io.ReadFull reporting a short read as ErrTruncated.
+func readFull(src io.Reader, buf []byte) error {
+	_, err := io.ReadFull(src, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+func validChunkSize(n int) bool {
+	return n >= MinChunkSize && n <= MaxChunkSize && n&(n-1) == 0
+}
+
+func newDecryptReader(src io.Reader, aead cipher.AEAD, h header, counter uint64) *decryptReader {
+	return &decryptReader{
+		src:     bufio.NewReaderSize(src, h.chunkSize+tagSize),
+		aead:    aead,
+		base:    h.nonce,
+		nonce:   make([]byte, len(h.nonce)),
+		aad:     h.aad(),
+		counter: counter,
+		chunk:   make([]byte, h.chunkSize+tagSize),
+	}
+}
+
+type decryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	base    []byte
+	nonce   []byte
+	aad     []byte
+	counter uint64
+	chunk   []byte
+	plain   []byte
+	done    bool
+	err     error
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into r.plain.
+func (r *decryptReader) next() error {
+	n, err := io.ReadFull(r.src, r.chunk)
+	final := false
+	switch {
+	case err == io.EOF:
+		return &ChunkError{Index: r.counter, Err: ErrTruncated}
+	case err == io.ErrUnexpectedEOF:
+		// only the final chunk may be shorter than a full one.
+		final = true
+	case err != nil:
+		return err
+	default:
+		if _, err := r.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < tagSize {
+		return &ChunkError{Index: r.counter, Err: ErrTruncated}
+	}
+
+	nonce := chunkNonce(r.nonce, r.base, r.counter)
+	plain, err := r.aead.Open(r.chunk[:0], nonce, r.chunk[:n], chunkAAD(r.aad, r.counter, final))
+	if err != nil {
+		return &ChunkError{Index: r.counter, Err: ErrAuthFailed}
+	}
+	r.counter++
+	r.plain = plain
+	r.done = final
+	return nil
+}
+
+func newAEAD(a Algorithm, key [32]byte) (cipher.AEAD, error) {
+	if a == XChaCha20Poly1305 {
+		return chacha20poly1305.NewX(key[:])
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkAAD fills the chunk-specific trailer of aad, which starts with the
+// stream header, and returns it.
+func chunkAAD(aad []byte, i uint64, final bool) []byte {
+	binary.BigEndian.PutUint64(aad[len(aad)-aadTrailer:], i)
+	aad[len(aad)-1] = 0
+	if final {
+		aad[len(aad)-1] = 1
+	}
+	return aad
+}
+
+// chunkNonce derives the nonce of chunk i into dst, which has the size of
+// base, by XOR-ing its big-endian counter into the last 8 bytes of the base
+// nonce.
+func chunkNonce(dst, base []byte, i uint64) []byte {
+	copy(dst, base)
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], i)
+	for j := range ctr {
+		dst[len(dst)-8+j] ^= ctr[j]
+	}
+	return dst
+}
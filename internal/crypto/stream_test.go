@@ -0,0 +1,427 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testKey(t testing.TB) [32]byte {
+	t.Helper()
+	var key [32]byte
+	rand.Read(key[:])
+	return key
+}
+
+// encrypt encrypts plain under key, writing it in one call.
+func encrypt(t testing.TB, key [32]byte, plain []byte, opts ...Option) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, key, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decrypt decrypts all of ct under key.
+func decrypt(ct []byte, key [32]byte, opts ...Option) ([]byte, error) {
+	r, err := NewDecryptReader(bytes.NewReader(ct), key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// splitChunks splits ct, a stream of chunkSize chunks, into its header and
+// its sealed chunks.
+func splitChunks(ct []byte, plainSize, chunkSize int) (hdr []byte, chunks [][]byte) {
+	n := max(1, (plainSize+chunkSize-1)/chunkSize)
+	body := plainSize + n*tagSize
+	hdr, ct = ct[:len(ct)-body], ct[len(ct)-body:]
+	for len(ct) > 0 {
+		k := min(len(ct), chunkSize+tagSize)
+		chunks, ct = append(chunks, ct[:k]), ct[k:]
+	}
+	return hdr, chunks
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize, 3*ChunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		ct := encrypt(t, key, plain)
+		_, chunks := splitChunks(ct, size, ChunkSize)
+		if want := max(1, (size+ChunkSize-1)/ChunkSize); len(chunks) != want {
+			t.Errorf("size %d: %d chunks, want %d", size, len(chunks), want)
+		}
+		got, err := decrypt(ct, key)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: plaintext differs", size)
+		}
+	}
+}
+
+func TestEncryptSmallWrites(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 2*ChunkSize+5)
+	rand.Read(plain)
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := plain; len(p) > 0; {
+		k := min(len(p), 999)
+		if _, err := w.Write(p[:k]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[k:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := decrypt(buf.Bytes(), key)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("decrypt = %v, plaintext equal %t", err, bytes.Equal(got, plain))
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 2*ChunkSize+100)
+	rand.Read(plain)
+	ct := encrypt(t, key, plain)
+	hdr, _ := splitChunks(ct, len(plain), ChunkSize)
+
+	for _, i := range []int{len(hdr), len(hdr) + ChunkSize + tagSize + 1, len(ct) - 1} {
+		bad := slices.Clone(ct)
+		bad[i] ^= 1
+		_, err := decrypt(bad, key)
+		var ce *ChunkError
+		if !errors.Is(err, ErrAuthFailed) || !errors.As(err, &ce) {
+			t.Errorf("flipped byte %d: err = %v, want a ChunkError of ErrAuthFailed", i, err)
+		}
+	}
+	bad := slices.Clone(ct)
+	bad[len(hdr)-1] ^= 1
+	if _, err := decrypt(bad, key); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("flipped key check: err = %v, want ErrWrongKey", err)
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	ct := encrypt(t, testKey(t), []byte("secret"))
+	if _, err := decrypt(ct, testKey(t)); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("err = %v, want ErrWrongKey", err)
+	}
+}
+
+func TestAssociatedData(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 2*ChunkSize+100)
+	rand.Read(plain)
+	for _, opts := range [][]Option{nil, {WithParallelism(4)}} {
+		ct := encrypt(t, key, plain, append(opts, WithAssociatedData([]byte("id1")))...)
+		if got, err := decrypt(ct, key, WithAssociatedData([]byte("id1"))); err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("decrypt with the same data = %d bytes, %v", len(got), err)
+		}
+		for _, ad := range [][]byte{nil, []byte("id2"), []byte("id1\x00")} {
+			if _, err := decrypt(ct, key, WithAssociatedData(ad)); !errors.Is(err, ErrAuthFailed) {
+				t.Errorf("decrypt with data %q: err = %v, want ErrAuthFailed", ad, err)
+			}
+		}
+	}
+}
+
+func TestDecryptTruncated(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 3*ChunkSize+100)
+	rand.Read(plain)
+	ct := encrypt(t, key, plain)
+	hdr, chunks := splitChunks(ct, len(plain), ChunkSize)
+
+	// dropping whole trailing chunks leaves a stream without its final chunk.
+	for keep := 1; keep < len(chunks); keep++ {
+		cut := slices.Concat(append([][]byte{hdr}, chunks[:keep]...)...)
+		if _, err := decrypt(cut, key); !errors.Is(err, ErrAuthFailed) && !errors.Is(err, ErrTruncated) {
+			t.Errorf("%d of %d chunks: err = %v, want a failure", keep, len(chunks), err)
+		}
+	}
+	// cutting at a chunk boundary, right after the header, and mid chunk.
+	for _, n := range []int{len(hdr), len(hdr) + ChunkSize + tagSize, len(hdr) + 100, len(ct) - 1} {
+		if _, err := decrypt(ct[:n], key); err == nil {
+			t.Errorf("truncated to %d bytes: no error", n)
+		}
+	}
+	if _, err := decrypt(ct[:len(hdr)-1], key); !errors.Is(err, ErrTruncated) && !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("truncated header: err = %v", err)
+	}
+}
+
+func TestDecryptReordered(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 3*ChunkSize+100)
+	rand.Read(plain)
+	ct := encrypt(t, key, plain)
+	hdr, chunks := splitChunks(ct, len(plain), ChunkSize)
+
+	swapped := slices.Clone(chunks)
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+	_, err := decrypt(slices.Concat(append([][]byte{hdr}, swapped...)...), key)
+	var ce *ChunkError
+	if !errors.As(err, &ce) || ce.Index != 0 || !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("swapped chunks: err = %v, want ErrAuthFailed at chunk 0", err)
+	}
+
+	// a chunk of another stream under the same key doesn't fit either.
+	other := encrypt(t, key, plain)
+	_, otherChunks := splitChunks(other, len(plain), ChunkSize)
+	mixed := slices.Clone(chunks)
+	mixed[1] = otherChunks[1]
+	if _, err := decrypt(slices.Concat(append([][]byte{hdr}, mixed...)...), key); !errors.Is(err, ErrAuthFailed) {
+		t.Fatalf("spliced chunk: err = %v, want ErrAuthFailed", err)
+	}
+}
+
+func TestDecryptUnknownFormat(t *testing.T) {
+	key := testKey(t)
+	ct := encrypt(t, key, []byte("hello"))
+	if string(ct[:len(magic)]) != magic || ct[len(magic)] != version {
+		t.Fatalf("stream starts with %q, want magic and version %d", ct[:len(magic)+1], version)
+	}
+
+	for name, mutate := range map[string]func([]byte){
+		"bad magic":  func(b []byte) { b[0] = 'X' },
+		"version 0":  func(b []byte) { b[len(magic)] = 0 },
+		"future":     func(b []byte) { b[len(magic)] = version + 1 },
+		"algorithm":  func(b []byte) { b[len(magic)+1] = 0xff },
+		"chunk size": func(b []byte) { b[len(magic)+2] = 0xff },
+	} {
+		bad := slices.Clone(ct)
+		mutate(bad)
+		_, err := decrypt(bad, key)
+		if !errors.Is(err, ErrUnknownFormat) {
+			t.Errorf("%s: err = %v, want ErrUnknownFormat", name, err)
+		}
+	}
+	future := slices.Clone(ct)
+	future[len(magic)] = version + 1
+	if _, err := decrypt(future, key); err == nil || !strings.Contains(err.Error(), "unsupported version") {
+		t.Errorf("future version: err = %v, want it named", err)
+	}
+	if _, err := decrypt(nil, key); !errors.Is(err, ErrTruncated) && !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("empty stream: err = %v", err)
+	}
+}
+
+// legacyEncrypt encrypts plain in the format of version v, as written
+// before the later versions existed, with chunks of ChunkSize.
+func legacyEncrypt(t *testing.T, key [32]byte, plain []byte, v byte) []byte {
+	t.Helper()
+	h := header{version: v, algorithm: AES256GCM, chunkSize: ChunkSize, nonce: make([]byte, nonceSize)}
+	rand.Read(h.nonce)
+	if v >= version {
+		h.check = h.keyCheck(key)
+	}
+	aead, err := newAEAD(h.algorithm, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, aad := h.marshal(), h.aad()
+	if len(out) != h.size() {
+		t.Fatalf("version %d header of %d bytes, want %d", v, len(out), h.size())
+	}
+	for i := uint64(0); ; i++ {
+		n := min(len(plain), ChunkSize)
+		final := n == len(plain)
+		nonce := chunkNonce(make([]byte, nonceSize), h.nonce, i)
+		out = aead.Seal(out, nonce, plain[:n], chunkAAD(aad, i, final))
+		if plain = plain[n:]; final {
+			return out
+		}
+	}
+}
+
+func TestDecryptLegacyVersions(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 2*ChunkSize+3)
+	rand.Read(plain)
+	for _, v := range []byte{version1, version2, version3} {
+		ct := legacyEncrypt(t, key, plain, v)
+		got, err := decrypt(ct, key)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("version %d: %v, plaintext equal %t", v, err, bytes.Equal(got, plain))
+		}
+		if size, err := PlaintextSize(bytes.NewReader(ct), int64(len(ct))); err != nil || size != int64(len(plain)) {
+			t.Errorf("version %d: PlaintextSize = %d, %v", v, size, err)
+		}
+	}
+}
+
+func TestChunkSizes(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 5*MinChunkSize+1)
+	rand.Read(plain)
+
+	// objects written with different chunk sizes sit side by side and all
+	// decrypt with the same reader.
+	var objects [][]byte
+	for _, n := range []int{MinChunkSize, 2 * MinChunkSize, ChunkSize, MaxChunkSize} {
+		ct := encrypt(t, key, plain, WithChunkSize(n))
+		if _, chunks := splitChunks(ct, len(plain), n); len(chunks) != (len(plain)+n-1)/n {
+			t.Errorf("chunk size %d: %d chunks", n, len(chunks))
+		}
+		objects = append(objects, ct)
+	}
+	objects = append(objects, legacyEncrypt(t, key, plain, version1))
+	for i, ct := range objects {
+		got, err := decrypt(ct, key)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("object %d: %v, plaintext equal %t", i, err, bytes.Equal(got, plain))
+		}
+	}
+
+	for _, n := range []int{0, MinChunkSize - 1, MinChunkSize / 2, MinChunkSize + 1, 3 * MinChunkSize, 2 * MaxChunkSize} {
+		if _, err := NewEncryptWriter(io.Discard, key, WithChunkSize(n)); err == nil {
+			t.Errorf("WithChunkSize(%d): no error", n)
+		}
+	}
+}
+
+func TestDecryptRangeChunkSizes(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 3*MinChunkSize+77)
+	rand.Read(plain)
+	for _, ct := range [][]byte{encrypt(t, key, plain, WithChunkSize(MinChunkSize)), legacyEncrypt(t, key, plain, version1)} {
+		for _, rg := range [][2]int64{{0, 0}, {0, 10}, {MinChunkSize - 1, 2}, {MinChunkSize, MinChunkSize}, {100, int64(len(plain)) - 100}} {
+			r, err := NewDecryptRangeReader(bytes.NewReader(ct), int64(len(ct)), key, rg[0], rg[1])
+			if err != nil {
+				t.Fatalf("range %v: %v", rg, err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, plain[rg[0]:rg[0]+rg[1]]) {
+				t.Errorf("range %v: %v, plaintext equal %t", rg, err, bytes.Equal(got, plain[rg[0]:rg[0]+rg[1]]))
+			}
+		}
+		if _, err := NewDecryptRangeReader(bytes.NewReader(ct), int64(len(ct)), key, 1, int64(len(plain))); err == nil {
+			t.Error("range past the end: no error")
+		}
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, 3*MinChunkSize+77)
+	rand.Read(plain)
+	for _, alg := range []Algorithm{AES256GCM, XChaCha20Poly1305} {
+		t.Run(alg.String(), func(t *testing.T) {
+			ct := encrypt(t, key, plain, WithAlgorithm(alg), WithChunkSize(MinChunkSize))
+			if got := Algorithm(ct[len(magic)+1]); got != alg {
+				t.Fatalf("algorithm byte = %s, want %s", got, alg)
+			}
+			if hdr, _ := splitChunks(ct, len(plain), MinChunkSize); len(hdr) != len(magic)+1+1+4+alg.nonceSize()+checkSize {
+				t.Errorf("header of %d bytes, want a nonce of %d", len(hdr), alg.nonceSize())
+			}
+
+			// readers take no option, the AEAD is the one named by the
+			// header.
+			h, aead, err := openHeader(bytes.NewReader(ct), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.algorithm != alg || aead.NonceSize() != alg.nonceSize() {
+				t.Errorf("opened %s with a nonce of %d, want %s", h.algorithm, aead.NonceSize(), alg)
+			}
+			got, err := decrypt(ct, key)
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Fatalf("decrypt = %v, plaintext equal %t", err, bytes.Equal(got, plain))
+			}
+			for _, rg := range [][2]int64{{0, 10}, {MinChunkSize - 1, 2}, {MinChunkSize - 5, MinChunkSize + 10}, {100, int64(len(plain)) - 100}} {
+				r, err := NewDecryptRangeReader(bytes.NewReader(ct), int64(len(ct)), key, rg[0], rg[1])
+				if err != nil {
+					t.Fatalf("range %v: %v", rg, err)
+				}
+				got, err := io.ReadAll(r)
+				if err != nil || !bytes.Equal(got, plain[rg[0]:rg[0]+rg[1]]) {
+					t.Errorf("range %v: %v, plaintext equal %t", rg, err, bytes.Equal(got, plain[rg[0]:rg[0]+rg[1]]))
+				}
+			}
+		})
+	}
+}
+
+// TestAlgorithmFromHeader rewrites the algorithm byte of a stream, with a
+// key check that matches, and checks the chunks are then opened with the
+// AEAD the byte names, which fails.
+func TestAlgorithmFromHeader(t *testing.T) {
+	key := testKey(t)
+	plain := []byte("sealed with XChaCha20-Poly1305")
+	ct := encrypt(t, key, plain, WithAlgorithm(XChaCha20Poly1305))
+	h, err := readHeader(bytes.NewReader(ct))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := ct[h.size():]
+
+	// the first 12 bytes of the nonce stand for an AES-256-GCM one.
+	h.algorithm, h.nonce = AES256GCM, h.nonce[:nonceSize]
+	h.check = h.keyCheck(key)
+	swapped := append(h.marshal(), body...)
+	_, aead, err := openHeader(bytes.NewReader(swapped), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aead.NonceSize() != nonceSize {
+		t.Errorf("opened with a nonce of %d, want AES-256-GCM", aead.NonceSize())
+	}
+	if _, err := decrypt(swapped, key); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("chunks opened with the other AEAD: err = %v, want ErrAuthFailed", err)
+	}
+
+	for _, b := range []byte{0, 3, 0xff} {
+		bad := slices.Clone(ct)
+		bad[len(magic)+1] = b
+		if _, err := decrypt(bad, key); !errors.Is(err, ErrUnknownFormat) {
+			t.Errorf("algorithm byte %d: err = %v, want ErrUnknownFormat", b, err)
+		}
+		if _, err := NewEncryptWriter(io.Discard, key, WithAlgorithm(Algorithm(b))); err == nil {
+			t.Errorf("WithAlgorithm(%d): no error", b)
+		}
+	}
+}
+
+// TestLegacyAlgorithm checks that streams written before the algorithm byte
+// existed open as AES-256-GCM.
+func TestLegacyAlgorithm(t *testing.T) {
+	key := testKey(t)
+	plain := make([]byte, ChunkSize+3)
+	rand.Read(plain)
+	for _, v := range []byte{version1, version2} {
+		ct := legacyEncrypt(t, key, plain, v)
+		h, aead, err := openHeader(bytes.NewReader(ct), key)
+		if err != nil {
+			t.Fatalf("version %d: %v", v, err)
+		}
+		if h.algorithm != AES256GCM || aead.NonceSize() != nonceSize {
+			t.Errorf("version %d: opened as %s with a nonce of %d, want AES-256-GCM", v, h.algorithm, aead.NonceSize())
+		}
+		if got, err := decrypt(ct, key); err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("version %d: %v, plaintext equal %t", v, err, bytes.Equal(got, plain))
+		}
+	}
+}
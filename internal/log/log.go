@@ -0,0 +1,124 @@
+// Package log provides the structured logger used across e2eefs.
+package log
+
+import (
+	"context"
+	"io"
+	"log/slog"
+)
+
+// Logger logs a message with optional key/value pairs, in the same form
+// accepted by slog.Logger.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+
+	// WithContext returns a Logger that includes the fields stored in ctx by
+	// ContextWith on every entry. Call-site args win on key collision.
+	WithContext(ctx context.Context) Logger
+}
+
+// New returns a Logger that writes JSON lines to w, dropping records below
+// level. A *slog.LevelVar can be passed to change the level of the Logger,
+// and every Logger derived from it, while it is in use.
+func New(w io.Writer, level slog.Leveler) Logger {
+	return &logger{sl: slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))}
+}
+
+// Nop returns a Logger that discards everything, useful in tests.
+func Nop() Logger {
+	return &logger{sl: slog.New(slog.DiscardHandler)}
+}
+
+type fieldsKey struct{}
+
+// ContextWith returns a copy of ctx carrying args as request-scoped fields,
+// appended to any fields already stored in ctx.
+func ContextWith(ctx context.Context, args ...any) context.Context {
+	prev := fieldsFrom(ctx)
+	fields := make([]any, 0, len(prev)+len(args))
+	fields = append(fields, prev...)
+	fields = append(fields, args...)
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+func fieldsFrom(ctx context.Context) []any {
+	fields, _ := ctx.Value(fieldsKey{}).([]any)
+	return fields
+}
+
+type logger struct {
+	sl     *slog.Logger
+	fields []any
+}
+
+func (l *logger) Debug(msg string, args ...any) { l.log(slog.LevelDebug, msg, args) }
+func (l *logger) Info(msg string, args ...any)  { l.log(slog.LevelInfo, msg, args) }
+func (l *logger) Warn(msg string, args ...any)  { l.log(slog.LevelWarn, msg, args) }
+func (l *logger) Error(msg string, args ...any) { l.log(slog.LevelError, msg, args) }
+
+func (l *logger) WithContext(ctx context.Context) Logger {
+	fields := fieldsFrom(ctx)
+	if len(fields) == 0 {
+		return l
+	}
+	return &logger{sl: l.sl, fields: fields}
+}
+
+func (l *logger) log(level slog.Level, msg string, args []any) {
+	ctx := context.Background()
+	if len(l.fields) == 0 {
+		l.sl.Log(ctx, level, msg, args...)
+		return
+	}
+	if !l.sl.Enabled(ctx, level) {
+		return
+	}
+	l.sl.LogAttrs(ctx, level, msg, merge(l.fields, args)...)
+}
+
+// merge combines context fields and call-site args into attributes. For a
+// key present more than once, only the last occurrence is kept, which lets
+// call-site args override context fields.
+func merge(fields, args []any) []slog.Attr {
+	attrs := append(toAttrs(fields), toAttrs(args)...)
+	last := make(map[string]int, len(attrs))
+	for i, a := range attrs {
+		last[a.Key] = i
+	}
+	out := attrs[:0]
+	for i, a := range attrs {
+		if last[a.Key] == i {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// toAttrs converts key/value pairs into attributes using the same rules as
+// slog: a string key consumes the next value, a slog.Attr stands alone, and
+// anything else is reported under "!BADKEY".
+func toAttrs(args []any) []slog.Attr {
+	attrs := make([]slog.Attr, 0, len(args)/2+1)
+	for len(args) > 0 {
+		switch k := args[0].(type) {
+		case string:
+			if len(args) == 1 {
+				attrs = append(attrs, slog.String("!BADKEY", k))
+				args = args[1:]
+				continue
+			}
+			attrs = append(attrs, slog.Any(k, args[1]))
+			args = args[2:]
+		case slog.Attr:
+			attrs = append(attrs, k)
+			args = args[1:]
+		default:
+			attrs = append(attrs, slog.Any("!BADKEY", k))
+			args = args[1:]
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,72 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestWithContext(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, slog.LevelInfo)
+	ctx := ContextWith(context.Background(), "request_id", "r1", "user", "alice")
+	ctx = ContextWith(ctx, "route", "/objects")
+
+	l.WithContext(ctx).Info("hello", "user", "bob", "n", 1)
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"request_id": "r1", "user": "bob", "route": "/objects", "n": 1.0}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if bytes.Count(buf.Bytes(), []byte(`"user"`)) != 1 {
+		t.Errorf("user logged more than once: %s", buf.Bytes())
+	}
+}
+
+func TestWithContextEmpty(t *testing.T) {
+	l := New(io.Discard, slog.LevelInfo)
+	if l.WithContext(context.Background()) != l {
+		t.Error("WithContext of a context without fields returned a new Logger")
+	}
+	if n := testing.AllocsPerRun(100, func() { l.WithContext(context.Background()) }); n != 0 {
+		t.Errorf("WithContext allocates %v times, want 0", n)
+	}
+}
+
+func TestWithContextDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := ContextWith(context.Background(), "request_id", "r1")
+	New(&buf, slog.LevelWarn).WithContext(ctx).Info("dropped")
+	if buf.Len() != 0 {
+		t.Errorf("record below the level was written: %s", buf.Bytes())
+	}
+}
+
+// BenchmarkWithContext shows that deriving a Logger from a context without
+// fields doesn't allocate, unlike deriving one from a context with fields.
+// Neither logs, so they differ by the derivation alone.
+func BenchmarkWithContext(b *testing.B) {
+	l := New(io.Discard, slog.LevelInfo)
+	b.Run("no fields", func(b *testing.B) {
+		ctx := context.Background()
+		b.ReportAllocs()
+		for b.Loop() {
+			l.WithContext(ctx)
+		}
+	})
+	b.Run("fields", func(b *testing.B) {
+		ctx := ContextWith(context.Background(), "request_id", "r1")
+		b.ReportAllocs()
+		for b.Loop() {
+			l.WithContext(ctx)
+		}
+	})
+}
@@ -0,0 +1,298 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// FSStore stores objects as files under a root directory. Objects are
+// sharded into subdirectories named after the first two characters of their
+// ID, so no single directory grows too large.
+type FSStore struct {
+	root string
+
+	mu sync.Mutex
+	// refusedErr is the error of the last write refused by the volume, until
+	// a Put succeeds again.
+	refusedErr error
+}
+
+// NewFSStore returns a FSStore rooted at root, creating it if needed.
+func NewFSStore(root string) (*FSStore, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+	return &FSStore{root: root}, nil
+}
+
+// Put stores the content of r under id, replacing any existing object. The
+// content is written to a temporary file in the shard directory, synced and
+// renamed over the final name, so a crash or a failed write never leaves a
+// partial object behind. The directory is synced after the rename, so a
+// successful Put survives a crash. Temporary files start with a dot, which
+// keeps them out of List. When the volume is read-only or full, the error
+// is an ErrStorageUnavailable.
+func (s *FSStore) Put(ctx context.Context, id string, r io.Reader) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	newShard := false
+	switch err := os.Mkdir(dir, 0o700); {
+	case err == nil:
+		newShard = true
+	case !errors.Is(err, fs.ErrExist):
+		return s.writeError(err)
+	}
+
+	f, err := os.CreateTemp(dir, "."+id+".*.tmp")
+	if err != nil {
+		return s.writeError(err)
+	}
+	if err := writeFile(ctx, f, r); err != nil {
+		_ = os.Remove(f.Name())
+		return s.writeError(err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		_ = os.Remove(f.Name())
+		return s.writeError(err)
+	}
+	if err := syncDir(dir); err != nil {
+		return s.writeError(err)
+	}
+	if newShard {
+		if err := syncDir(s.root); err != nil {
+			return s.writeError(err)
+		}
+	}
+	s.setRefused(nil)
+	return nil
+}
+
+// writeError wraps the error of a write, as an ErrStorageUnavailable when
+// the volume refused it, which Writable reports until a Put succeeds.
+func (s *FSStore) writeError(err error) error {
+	if !refused(err) {
+		return fmt.Errorf("store: %w", err)
+	}
+	s.setRefused(err)
+	return fmt.Errorf("%w: %w", ErrStorageUnavailable, err)
+}
+
+func (s *FSStore) setRefused(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refusedErr = err
+}
+
+// Writable returns an ErrStorageUnavailable when the last write was refused
+// by the volume, nil otherwise. It doesn't write anything itself, so it is
+// cheap enough for readiness checks.
+func (s *FSStore) Writable(_ context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refusedErr != nil {
+		return fmt.Errorf("%w: %w", ErrStorageUnavailable, s.refusedErr)
+	}
+	return nil
+}
+
+// writeFile copies r into f, syncs f to disk and closes it.
+func writeFile(ctx context.Context, f *os.File, r io.Reader) error {
+	if _, err := io.Copy(f, contextReader{ctx: ctx, r: r}); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs the directory dir, making the entries created or renamed in
+// it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// Get opens the object stored under id. The returned reader also implements
+// io.Seeker.
+func (s *FSStore) Get(_ context.Context, id string) (io.ReadCloser, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, pathError(id, err)
+	}
+	return f, nil
+}
+
+// Delete removes the object stored under id.
+func (s *FSStore) Delete(_ context.Context, id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return notFound(id)
+		}
+		return s.writeError(err)
+	}
+	return nil
+}
+
+// Stat describes the object stored under id.
+func (s *FSStore) Stat(_ context.Context, id string) (ObjectInfo, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, pathError(id, err)
+	}
+	return ObjectInfo{ID: id, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// List returns up to limit IDs starting with prefix, in ascending order and
+// strictly after cursor, along with the cursor of the next page, which is
+// empty once the listing is exhausted. Shards are read one at a time and the
+// entries of a shard are streamed, keeping only the smallest ones that may
+// end up in the page, so memory usage is bounded by limit rather than by the
+// size of a shard, which a prefix shared by many IDs can make large.
+func (s *FSStore) List(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", nil
+	}
+	shards, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, "", fmt.Errorf("store: %w", err)
+	}
+	var ids []string
+	for _, shard := range shards {
+		name := shard.Name()
+		if !shard.IsDir() || len(name) != 2 || !validID(name) || !shardMatches(name, prefix, cursor) {
+			continue
+		}
+		// one more than asked tells whether there is a next page.
+		page, err := s.listShard(ctx, name, prefix, cursor, limit+1-len(ids))
+		if err != nil {
+			return nil, "", err
+		}
+		if ids = append(ids, page...); len(ids) > limit {
+			return ids[:limit], ids[limit-1], nil
+		}
+	}
+	return ids, "", nil
+}
+
+// listDirBatch is how many directory entries List reads at a time.
+const listDirBatch = 256
+
+// listShard returns the n smallest IDs of shard starting with prefix and
+// sorting after cursor, in ascending order.
+func (s *FSStore) listShard(ctx context.Context, shard, prefix, cursor string, n int) ([]string, error) {
+	dir, err := os.Open(filepath.Join(s.root, shard))
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+	defer dir.Close()
+
+	var ids []string
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		entries, err := dir.ReadDir(listDirBatch)
+		for _, e := range entries {
+			id := e.Name()
+			if !e.Type().IsRegular() || !validID(id) || !strings.HasPrefix(id, prefix) || id <= cursor {
+				continue
+			}
+			if len(ids) == n && id > ids[n-1] {
+				continue
+			}
+			i, _ := slices.BinarySearch(ids, id)
+			if ids = slices.Insert(ids, i, id); len(ids) > n {
+				ids = ids[:n]
+			}
+		}
+		if err == io.EOF {
+			return ids, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("store: %w", err)
+		}
+	}
+}
+
+// shardMatches reports whether shard may hold IDs starting with prefix that
+// sort after cursor.
+func shardMatches(shard, prefix, cursor string) bool {
+	n := min(len(prefix), 2)
+	if shard[:n] != prefix[:n] {
+		return false
+	}
+	return cursor == "" || shard >= cursor[:min(len(cursor), 2)]
+}
+
+// Ping checks that the root directory is still reachable.
+func (s *FSStore) Ping(_ context.Context) error {
+	fi, err := os.Stat(s.root)
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("store: %s is not a directory", s.root)
+	}
+	return nil
+}
+
+func (s *FSStore) path(id string) (string, error) {
+	if !validID(id) {
+		return "", ErrInvalidID
+	}
+	return filepath.Join(s.root, id[:2], id), nil
+}
+
+// pathError maps a missing file to ErrNotFound.
+func pathError(id string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return notFound(id)
+	}
+	return fmt.Errorf("store: %w", err)
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// failingReader returns its data, then err.
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestFSStorePut(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const id = "ab01"
+	shard := filepath.Join(root, "ab")
+
+	// shardFiles returns the names of the files in the shard of id.
+	shardFiles := func() []string {
+		t.Helper()
+		entries, err := os.ReadDir(shard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	errWrite := errors.New("write failed")
+	err = s.Put(ctx, id, &failingReader{data: "partial", err: errWrite})
+	if !errors.Is(err, errWrite) {
+		t.Fatalf("Put with a failing reader = %v, want %v", err, errWrite)
+	}
+	if names := shardFiles(); len(names) != 0 {
+		t.Fatalf("failed Put left %v behind", names)
+	}
+	if _, err := s.Stat(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat after failed Put = %v, want ErrNotFound", err)
+	}
+
+	if err := s.Put(ctx, id, strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	if names := shardFiles(); len(names) != 1 || names[0] != id {
+		t.Fatalf("shard holds %v, want only %s", names, id)
+	}
+
+	// a failed overwrite keeps the previous object whole.
+	if err := s.Put(ctx, id, &failingReader{data: "other", err: errWrite}); !errors.Is(err, errWrite) {
+		t.Fatalf("overwrite with a failing reader = %v, want %v", err, errWrite)
+	}
+	if names := shardFiles(); len(names) != 1 {
+		t.Fatalf("failed overwrite left %v behind", names)
+	}
+	rc, err := s.Get(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "content" {
+		t.Errorf("Get = %q, want %q", got, "content")
+	}
+}
+
+func TestFSStorePutCanceled(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Put(ctx, "cd01", strings.NewReader("content")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Put with a canceled context = %v, want %v", err, context.Canceled)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "cd"))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("canceled Put left %v, %v", entries, err)
+	}
+}
+
+// TestFSStoreListLargeShard pages through a shard holding more entries than
+// a directory read returns at once.
+func TestFSStoreListLargeShard(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "ab"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := range 3*listDirBatch + 5 {
+		id := fmt.Sprintf("ab%04x", (i*7919)%0x10000)
+		if err := os.WriteFile(filepath.Join(root, "ab", id), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, id)
+	}
+	slices.Sort(want)
+
+	var got []string
+	for cursor, pages := "", 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("listing doesn't end")
+		}
+		ids, next, err := s.List(ctx, "ab", cursor, 50)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ids...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("listed %d IDs, want the %d of the shard in order", len(got), len(want))
+	}
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStore keeps objects in memory. It is safe for concurrent use and mostly
+// useful in tests, or as a reference of the expected behavior of a store.
+type MemStore struct {
+	mu      sync.RWMutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{objects: make(map[string]memObject)}
+}
+
+// Put stores the content of r under id, replacing any existing object.
+func (s *MemStore) Put(ctx context.Context, id string, r io.Reader) error {
+	if !validID(id) {
+		return ErrInvalidID
+	}
+	data, err := io.ReadAll(contextReader{ctx: ctx, r: r})
+	if err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	s.mu.Lock()
+	s.objects[id] = memObject{data: data, modTime: time.Now()}
+	s.mu.Unlock()
+	return nil
+}
+
+// Get returns the object stored under id. The returned reader also
+// implements io.Seeker.
+func (s *MemStore) Get(_ context.Context, id string) (io.ReadCloser, error) {
+	obj, err := s.lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	// stored slices are never mutated, so readers can share them.
+	return nopSeekCloser{bytes.NewReader(obj.data)}, nil
+}
+
+// Delete removes the object stored under id.
+func (s *MemStore) Delete(_ context.Context, id string) error {
+	if !validID(id) {
+		return ErrInvalidID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objects[id]; !ok {
+		return notFound(id)
+	}
+	delete(s.objects, id)
+	return nil
+}
+
+// Stat describes the object stored under id.
+func (s *MemStore) Stat(_ context.Context, id string) (ObjectInfo, error) {
+	obj, err := s.lookup(id)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{ID: id, Size: int64(len(obj.data)), ModTime: obj.modTime}, nil
+}
+
+// List returns up to limit IDs starting with prefix, in ascending order and
+// strictly after cursor, along with the cursor of the next page, which is
+// empty once the listing is exhausted.
+func (s *MemStore) List(_ context.Context, prefix, cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", nil
+	}
+	s.mu.RLock()
+	var ids []string
+	for id := range s.objects {
+		if strings.HasPrefix(id, prefix) && id > cursor {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.RUnlock()
+	slices.Sort(ids)
+	if len(ids) > limit {
+		return ids[:limit], ids[limit-1], nil
+	}
+	return ids, "", nil
+}
+
+// Ping always succeeds, a MemStore is always reachable.
+func (s *MemStore) Ping(_ context.Context) error { return nil }
+
+func (s *MemStore) lookup(id string) (memObject, error) {
+	if !validID(id) {
+		return memObject{}, ErrInvalidID
+	}
+	s.mu.RLock()
+	obj, ok := s.objects[id]
+	s.mu.RUnlock()
+	if !ok {
+		return memObject{}, notFound(id)
+	}
+	return obj, nil
+}
+
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
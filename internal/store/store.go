@@ -0,0 +1,47 @@
+// Package store provides storage backends for encrypted objects.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when no object is stored under an ID.
+	ErrNotFound = errors.New("store: object not found")
+
+	// ErrInvalidID is returned for IDs that can't name an object.
+	ErrInvalidID = errors.New("store: invalid object id")
+
+	// ErrStorageUnavailable is returned when the storage refuses writes, e.g.
+	// because its volume turned read-only or ran out of space. Reads may
+	// still work.
+	ErrStorageUnavailable = errors.New("store: storage unavailable")
+)
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	ID      string
+	Size    int64
+	ModTime time.Time
+}
+
+// validID reports whether id is a lowercase hex string long enough to be
+// sharded.
+func validID(id string) bool {
+	if len(id) < 2 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func notFound(id string) error {
+	return fmt.Errorf("%w: %s", ErrNotFound, id)
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type listStore interface {
+	Put(ctx context.Context, id string, r io.Reader) error
+	List(ctx context.Context, prefix, cursor string, limit int) ([]string, string, error)
+}
+
+func TestList(t *testing.T) {
+	fs, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for name, st := range map[string]listStore{"fs": fs, "mem": NewMemStore()} {
+		t.Run(name, func(t *testing.T) {
+			// IDs spread over several shards, two of them with prefix ab.
+			var want []string
+			for _, id := range []string{"ab01", "ab02", "ab03", "abff", "ac00", "0f00", "ffff", "ab00"} {
+				if err := st.Put(ctx, id, strings.NewReader("x")); err != nil {
+					t.Fatal(err)
+				}
+				if strings.HasPrefix(id, "ab") {
+					want = append(want, id)
+				}
+			}
+			slices.Sort(want)
+
+			var got []string
+			pages := 0
+			for cursor := ""; ; {
+				ids, next, err := st.List(ctx, "ab", cursor, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(ids) > 2 {
+					t.Fatalf("page of %d IDs, want at most 2", len(ids))
+				}
+				got = append(got, ids...)
+				pages++
+				if next == "" {
+					break
+				}
+				cursor = next
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("listed %v, want %v", got, want)
+			}
+			if pages != 3 {
+				t.Errorf("%d pages, want 3", pages)
+			}
+
+			all, next, err := st.List(ctx, "", "", 100)
+			if err != nil || len(all) != 8 || next != "" || !slices.IsSorted(all) {
+				t.Errorf("List of everything = %v, %q, %v", all, next, err)
+			}
+			if ids, _, _ := st.List(ctx, "", "", 0); len(ids) != 0 {
+				t.Errorf("List with limit 0 = %v", ids)
+			}
+		})
+	}
+}
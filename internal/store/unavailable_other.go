@@ -0,0 +1,6 @@
+//go:build !unix
+
+package store
+
+// refused is not supported on this platform, write errors stay opaque.
+func refused(error) bool { return false }
@@ -0,0 +1,14 @@
+//go:build unix
+
+package store
+
+import (
+	"errors"
+	"syscall"
+)
+
+// refused reports whether err tells that the volume refuses writes, because
+// it is read-only or out of space.
+func refused(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
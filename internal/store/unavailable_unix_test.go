@@ -0,0 +1,43 @@
+//go:build unix
+
+package store
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestFSStoreRefusedWrites(t *testing.T) {
+	s, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, errno := range []syscall.Errno{syscall.EROFS, syscall.ENOSPC, syscall.EDQUOT} {
+		err := s.writeError(&fs.PathError{Op: "write", Path: "x", Err: errno})
+		if !errors.Is(err, ErrStorageUnavailable) || !errors.Is(err, errno) {
+			t.Errorf("%v: error %v, want ErrStorageUnavailable wrapping it", errno, err)
+		}
+		if err := s.Writable(ctx); !errors.Is(err, ErrStorageUnavailable) {
+			t.Errorf("%v: Writable = %v, want ErrStorageUnavailable", errno, err)
+		}
+	}
+
+	// a successful write clears the state, other errors stay opaque.
+	if err := s.Put(ctx, "ab", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Writable(ctx); err != nil {
+		t.Errorf("Writable after a Put = %v, want nil", err)
+	}
+	if err := s.writeError(syscall.EIO); errors.Is(err, ErrStorageUnavailable) {
+		t.Errorf("EIO: error %v, want it not classified as unavailable", err)
+	}
+	if err := s.Writable(ctx); err != nil {
+		t.Errorf("Writable after EIO = %v, want nil", err)
+	}
+}
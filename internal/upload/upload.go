@@ -0,0 +1,457 @@
+// Package upload persists the state of resumable uploads.
+//
+// Every upload is a directory holding its declared info and the segments
+// received so far. A segment is the body of a single append, encrypted with
+// the stream format of the crypto package and named after the offset it
+// starts at, so the current offset is recovered from the segments alone and
+// survives a restart. Segments are written to a temporary file and renamed
+// into place once complete, so an interrupted append keeps only the whole
+// chunks it read and leaves no partial segment behind.
+package upload
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+)
+
+var (
+	// ErrNotFound is returned when there is no upload with the given ID.
+	ErrNotFound = errors.New("upload: not found")
+
+	// ErrOffsetMismatch is returned when an append doesn't start where the
+	// previous one ended.
+	ErrOffsetMismatch = errors.New("upload: offset mismatch")
+
+	// ErrBusy is returned when another append to the same upload is in
+	// progress.
+	ErrBusy = errors.New("upload: append in progress")
+
+	// ErrTooLarge is returned when an append goes past the declared length.
+	ErrTooLarge = errors.New("upload: exceeds declared length")
+)
+
+const (
+	infoFile   = "info.json"
+	segmentExt = ".seg"
+)
+
+// Info describes an upload.
+type Info struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	ModTime   time.Time `json:"-"`
+}
+
+// Complete reports whether all the declared bytes have been received.
+func (i Info) Complete() bool { return i.Offset == i.Length }
+
+// Store keeps resumable uploads under a directory.
+type Store struct {
+	dir string
+	key [32]byte
+
+	mu    sync.Mutex
+	locks map[string]bool
+}
+
+// NewStore returns a Store rooted at dir, creating it if needed. Segments
+// are encrypted with key.
+func NewStore(dir string, key [32]byte) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("upload: %w", err)
+	}
+	return &Store{dir: dir, key: key, locks: make(map[string]bool)}, nil
+}
+
+// Create starts an upload of length bytes owned by owner.
+func (s *Store) Create(owner string, length int64) (Info, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return Info{}, fmt.Errorf("upload: generate id: %w", err)
+	}
+	info := Info{
+		ID:        hex.EncodeToString(b[:]),
+		Owner:     owner,
+		Length:    length,
+		CreatedAt: time.Now().UTC(),
+	}
+	dir := filepath.Join(s.dir, info.ID)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return Info{}, fmt.Errorf("upload: %w", err)
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return Info{}, fmt.Errorf("upload: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, infoFile), data, 0o600); err != nil {
+		_ = os.RemoveAll(dir)
+		return Info{}, fmt.Errorf("upload: %w", err)
+	}
+	info.ModTime = info.CreatedAt
+	return info, nil
+}
+
+// Stat returns the info of the upload id, including its current offset.
+func (s *Store) Stat(id string) (Info, error) {
+	if !validID(id) {
+		return Info{}, ErrNotFound
+	}
+	dir := filepath.Join(s.dir, id)
+	data, err := os.ReadFile(filepath.Join(dir, infoFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Info{}, ErrNotFound
+		}
+		return Info{}, fmt.Errorf("upload: %w", err)
+	}
+	var info Info
+	if err := json.Unmarshal(data, &info); err != nil {
+		return Info{}, fmt.Errorf("upload: corrupted info: %w", err)
+	}
+	info.ID = id
+	info.ModTime = info.CreatedAt
+
+	segs, err := s.segments(id)
+	if err != nil {
+		return Info{}, err
+	}
+	for _, seg := range segs {
+		info.Offset += seg.size
+		info.ModTime = seg.modTime
+	}
+	return info, nil
+}
+
+// Append adds the content of r to the upload id, which must have received
+// exactly offset bytes so far. Only one append per upload may run at a time.
+// When r fails partway, the whole chunks read before the failure are kept
+// and the returned Info holds the offset after them, along with the error.
+func (s *Store) Append(ctx context.Context, id string, offset int64, r io.Reader) (Info, error) {
+	if !s.lock(id) {
+		return Info{}, ErrBusy
+	}
+	defer s.unlock(id)
+
+	info, err := s.Stat(id)
+	if err != nil {
+		return Info{}, err
+	}
+	if offset != info.Offset {
+		return info, ErrOffsetMismatch
+	}
+
+	dir := filepath.Join(s.dir, id)
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return Info{}, fmt.Errorf("upload: %w", err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	enc, err := crypto.NewEncryptWriter(tmp, s.key)
+	if err != nil {
+		return Info{}, err
+	}
+	// read one byte past the remaining length to detect overflow.
+	remaining := info.Length - info.Offset
+	n, readErr := copyChunks(enc, io.LimitReader(contextReader{ctx: ctx, r: r}, remaining+1))
+	var werr *writeError
+	if errors.As(readErr, &werr) {
+		return Info{}, werr.err
+	}
+	if n > remaining {
+		return Info{}, ErrTooLarge
+	}
+	if n == 0 {
+		if readErr != nil {
+			return info, fmt.Errorf("upload: %w", readErr)
+		}
+		return info, nil
+	}
+	if err := enc.Close(); err != nil {
+		return Info{}, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return Info{}, fmt.Errorf("upload: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, segmentName(offset))); err != nil {
+		return Info{}, fmt.Errorf("upload: %w", err)
+	}
+
+	info.Offset += n
+	info.ModTime = time.Now()
+	if readErr != nil {
+		return info, fmt.Errorf("upload: %w", readErr)
+	}
+	return info, nil
+}
+
+// copyChunks copies src to enc one chunk at a time and returns the bytes
+// written. On a read error, the chunk being read is dropped, so only whole
+// chunks are written; write errors are wrapped in a *writeError.
+func copyChunks(enc io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, crypto.ChunkSize)
+	var n int64
+	for {
+		m, err := 0, error(nil)
+		for m < len(buf) && err == nil {
+			var k int
+			k, err = src.Read(buf[m:])
+			m += k
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if _, werr := enc.Write(buf[:m]); werr != nil {
+			return n, &writeError{err: werr}
+		}
+		n += int64(m)
+		if err == io.EOF {
+			return n, nil
+		}
+	}
+}
+
+// writeError tells a failed write from a failed read in copyChunks.
+type writeError struct{ err error }
+
+func (e *writeError) Error() string { return e.err.Error() }
+
+func (e *writeError) Unwrap() error { return e.err }
+
+// Open returns the plaintext received so far by the upload id.
+func (s *Store) Open(id string) (io.ReadCloser, error) {
+	if _, err := s.Stat(id); err != nil {
+		return nil, err
+	}
+	segs, err := s.segments(id)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentsReader{key: s.key, segs: segs}, nil
+}
+
+// Delete removes the upload id and everything it received.
+func (s *Store) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	if err := os.RemoveAll(filepath.Join(s.dir, id)); err != nil {
+		return fmt.Errorf("upload: %w", err)
+	}
+	return nil
+}
+
+// Collect deletes the uploads whose last append, or creation when nothing
+// was appended, happened before cutoff, and returns how many it deleted.
+// Uploads with an append in progress are skipped, and an append can't start
+// while its upload is being collected.
+func (s *Store) Collect(cutoff time.Time) (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, fmt.Errorf("upload: %w", err)
+	}
+	var (
+		n    int
+		errs []error
+	)
+	for _, e := range entries {
+		id := e.Name()
+		if !e.IsDir() || !validID(id) || !s.lock(id) {
+			continue
+		}
+		deleted, err := s.collect(id, cutoff)
+		s.unlock(id)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if deleted {
+			n++
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// collect deletes the upload id if it is idle since before cutoff. The
+// caller holds its lock.
+func (s *Store) collect(id string, cutoff time.Time) (bool, error) {
+	info, err := s.Stat(id)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.ModTime.Before(cutoff) {
+		return false, nil
+	}
+	if err := s.Delete(id); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locks[id] {
+		return false
+	}
+	s.locks[id] = true
+	return true
+}
+
+func (s *Store) unlock(id string) {
+	s.mu.Lock()
+	delete(s.locks, id)
+	s.mu.Unlock()
+}
+
+type segment struct {
+	path    string
+	offset  int64
+	size    int64
+	modTime time.Time
+}
+
+// segments lists the segments of upload id in offset order.
+func (s *Store) segments(id string) ([]segment, error) {
+	dir := filepath.Join(s.dir, id)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("upload: %w", err)
+	}
+	var segs []segment
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok {
+			continue
+		}
+		offset, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, fmt.Errorf("upload: %w", err)
+		}
+		size, err := segmentSize(filepath.Join(dir, e.Name()), fi.Size())
+		if err != nil {
+			return nil, fmt.Errorf("upload: corrupted segment %s: %w", e.Name(), err)
+		}
+		segs = append(segs, segment{
+			path:    filepath.Join(dir, e.Name()),
+			offset:  offset,
+			size:    size,
+			modTime: fi.ModTime(),
+		})
+	}
+	slices.SortFunc(segs, func(a, b segment) int { return cmp.Compare(a.offset, b.offset) })
+	return segs, nil
+}
+
+// segmentSize returns the plaintext size of the segment at path, whose
+// ciphertext is size bytes long.
+func segmentSize(path string, size int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return crypto.PlaintextSize(f, size)
+}
+
+// segmentName zero-pads offset, so that names sort like offsets.
+func segmentName(offset int64) string {
+	return fmt.Sprintf("%020d%s", offset, segmentExt)
+}
+
+// segmentsReader decrypts segments one after the other.
+type segmentsReader struct {
+	key  [32]byte
+	segs []segment
+	f    *os.File
+	r    io.Reader
+}
+
+func (sr *segmentsReader) Read(p []byte) (int, error) {
+	for {
+		if sr.r == nil {
+			if len(sr.segs) == 0 {
+				return 0, io.EOF
+			}
+			f, err := os.Open(sr.segs[0].path)
+			if err != nil {
+				return 0, fmt.Errorf("upload: %w", err)
+			}
+			r, err := crypto.NewDecryptReader(f, sr.key)
+			if err != nil {
+				_ = f.Close()
+				return 0, err
+			}
+			sr.f, sr.r, sr.segs = f, r, sr.segs[1:]
+		}
+		n, err := sr.r.Read(p)
+		if err == io.EOF {
+			_ = sr.f.Close()
+			sr.f, sr.r = nil, nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (sr *segmentsReader) Close() error {
+	if sr.f != nil {
+		return sr.f.Close()
+	}
+	return nil
+}
+
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
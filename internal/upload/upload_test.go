@@ -0,0 +1,191 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/josestg/e2eefs/internal/crypto"
+)
+
+func newStore(t *testing.T, dir string) *Store {
+	t.Helper()
+	s, err := NewStore(dir, [32]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAppendResume(t *testing.T) {
+	dir := t.TempDir()
+	s := newStore(t, dir)
+	info, err := s.Create("alice", 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if info, err = s.Append(ctx, info.ID, 0, strings.NewReader("hello ")); err != nil {
+		t.Fatal(err)
+	}
+	if info.Offset != 6 || info.Complete() {
+		t.Fatalf("offset = %d, complete %t after the first append", info.Offset, info.Complete())
+	}
+
+	// a restarted server recovers the offset from the segments on disk.
+	s = newStore(t, dir)
+	info, err = s.Stat(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Offset != 6 || info.Owner != "alice" || info.Length != 11 {
+		t.Fatalf("info after restart = %+v", info)
+	}
+	if info, err = s.Append(ctx, info.ID, 6, strings.NewReader("world")); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Complete() {
+		t.Fatalf("upload not complete at offset %d", info.Offset)
+	}
+
+	rc, err := s.Open(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if got, err := io.ReadAll(rc); err != nil || string(got) != "hello world" {
+		t.Fatalf("content = %q, %v", got, err)
+	}
+}
+
+func TestAppendOffsetMismatch(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	info, _ := s.Create("alice", 10)
+	ctx := context.Background()
+	if _, err := s.Append(ctx, info.ID, 0, strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{0, 2, 4} {
+		got, err := s.Append(ctx, info.ID, off, strings.NewReader("def"))
+		if !errors.Is(err, ErrOffsetMismatch) {
+			t.Errorf("append at %d: err = %v, want ErrOffsetMismatch", off, err)
+		}
+		if got.Offset != 3 {
+			t.Errorf("append at %d: reported offset %d, want 3", off, got.Offset)
+		}
+	}
+	if _, err := s.Append(ctx, info.ID, 3, strings.NewReader("too long body")); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("append past the length: err = %v, want ErrTooLarge", err)
+	}
+	if info, _ = s.Stat(info.ID); info.Offset != 3 {
+		t.Errorf("offset after failed appends = %d, want 3", info.Offset)
+	}
+}
+
+func TestAppendInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	s := newStore(t, dir)
+	info, _ := s.Create("alice", 10)
+	body := io.MultiReader(strings.NewReader("abc"), errReader{})
+	if _, err := s.Append(context.Background(), info.ID, 0, body); err == nil {
+		t.Fatal("append of a failing body succeeded")
+	}
+	if info, _ = s.Stat(info.ID); info.Offset != 0 {
+		t.Errorf("offset after an interrupted append = %d, want 0", info.Offset)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, info.ID))
+	if len(entries) != 1 {
+		t.Errorf("upload directory holds %d entries, want only %s", len(entries), infoFile)
+	}
+}
+
+// TestAppendInterruptedChunks cuts a body after more than two chunks and
+// resumes the upload from the last whole chunk kept.
+func TestAppendInterruptedChunks(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	content := strings.Repeat("0123456789", 3*crypto.ChunkSize/10)
+	info, _ := s.Create("alice", int64(len(content)))
+	ctx := context.Background()
+
+	cut := 2*crypto.ChunkSize + 100
+	body := io.MultiReader(strings.NewReader(content[:cut]), errReader{})
+	got, err := s.Append(ctx, info.ID, 0, body)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("append of a failing body: err = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if got.Offset != 2*crypto.ChunkSize {
+		t.Fatalf("reported offset %d, want the %d bytes of the whole chunks", got.Offset, 2*crypto.ChunkSize)
+	}
+	if info, _ = s.Stat(info.ID); info.Offset != got.Offset {
+		t.Fatalf("offset after an interrupted append = %d, want %d", info.Offset, got.Offset)
+	}
+
+	if info, err = s.Append(ctx, info.ID, info.Offset, strings.NewReader(content[info.Offset:])); err != nil {
+		t.Fatal(err)
+	}
+	if !info.Complete() {
+		t.Fatalf("upload not complete at offset %d", info.Offset)
+	}
+	rc, err := s.Open(info.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if b, err := io.ReadAll(rc); err != nil || string(b) != content {
+		t.Fatalf("resumed content: %d bytes, %v, want %d", len(b), err, len(content))
+	}
+}
+
+func TestStatNotFound(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	for _, id := range []string{"", "../etc", "00000000000000000000000000000000"} {
+		if _, err := s.Stat(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Stat(%q) = %v, want ErrNotFound", id, err)
+		}
+	}
+	info, _ := s.Create("alice", 1)
+	if err := s.Delete(info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(info.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
+
+func TestCollect(t *testing.T) {
+	s := newStore(t, t.TempDir())
+	a, _ := s.Create("alice", 1)
+	b, _ := s.Create("alice", 1)
+	busy, _ := s.Create("alice", 1)
+	if !s.lock(busy.ID) {
+		t.Fatal("cannot lock the busy upload")
+	}
+
+	// a cutoff in the past keeps everything.
+	if n, err := s.Collect(time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Fatalf("Collect before every upload = %d, %v", n, err)
+	}
+	n, err := s.Collect(time.Now().Add(time.Hour))
+	if err != nil || n != 2 {
+		t.Fatalf("Collect after every upload = %d, %v, want 2", n, err)
+	}
+	for _, id := range []string{a.ID, b.ID} {
+		if _, err := s.Stat(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("idle upload %s: Stat = %v", id, err)
+		}
+	}
+	// an upload with an append in progress is never collected.
+	if _, err := s.Stat(busy.ID); err != nil {
+		t.Errorf("busy upload: Stat = %v, want it kept", err)
+	}
+	s.unlock(busy.ID)
+}